@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/margostino/babel-agent/internal/ask"
+	"github.com/margostino/babel-agent/internal/db"
+	"github.com/margostino/babel-agent/internal/llm"
+)
+
+func runAsk(ctx context.Context, args []string, stdout io.Writer) error {
+	flags, configPath := newFlagSet("ask")
+	limit := flags.Int("limit", 5, "Number of passages or notes the answer is grounded on")
+	maxTokens := flags.Int("max-tokens", 1500, "Maximum tokens of every note sent to the model")
+	category := flags.String("category", "", "Only notes of this category (e.g. Resources)")
+	tags := flags.String("tags", "", "Only notes with any of these comma separated tags")
+	folder := flags.String("folder", "", "Only notes under this folder (e.g. RESOURCES/books)")
+	asJSON := flags.Bool("json", false, "Print the answer and its sources as JSON")
+	words, err := parseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(words) == 0 {
+		return fmt.Errorf("usage: babel-agent ask [flags] \"<question>\"")
+	}
+
+	options := ask.Options{
+		Limit:            *limit,
+		MaxTokensPerNote: *maxTokens,
+		Category:         *category,
+		Folder:           *folder,
+	}
+	if *tags != "" {
+		options.Tags = strings.Split(*tags, ",")
+	}
+
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	provider, err := llm.NewProvider(c)
+	if err != nil {
+		return err
+	}
+	storage, err := db.NewStorage(c)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	answer, err := ask.Ask(ctx, storage, provider, c, strings.Join(words, " "), options)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(answer)
+	}
+	fmt.Fprintln(stdout, answer.Text)
+	if citations := answer.Citations(); len(citations) > 0 {
+		fmt.Fprintln(stdout, "\nSources:")
+		for _, source := range citations {
+			if passage := source.Passage; passage != nil {
+				fmt.Fprintf(stdout, "  [%d] %s#%s (bytes %d-%d)\n", source.Number, source.Path, passage.Heading, passage.Start, passage.End)
+				continue
+			}
+			fmt.Fprintf(stdout, "  [%d] %s\n", source.Number, source.Path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/margostino/babel-agent/internal/config"
+)
+
+// command runs a subcommand with the arguments following its name.
+type command func(ctx context.Context, args []string, stdout io.Writer) error
+
+// commands are the subcommands, anything else starts the daemon.
+var commands = map[string]command{
+	"reindex": runReindex,
+	"doctor":  runDoctor,
+	"search":  runSearch,
+	"mcp":     runMCP,
+	"ask":     runAsk,
+	"status":  runStatus,
+}
+
+// newFlagSet returns the flags of a subcommand, with the path to the
+// configuration file every subcommand reads.
+func newFlagSet(name string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	configPath := flags.String("config", config.DefaultPath(), "Path to config file")
+	return flags, configPath
+}
+
+func loadConfig(configPath string) (*config.Config, error) {
+	c := &config.Config{}
+	if err := c.Init([]string{os.Args[0], "--config", configPath}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseInterspersed parses the flags wherever they are among the arguments, so
+// that flags may follow a quoted query. It returns the other arguments.
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
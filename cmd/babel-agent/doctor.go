@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/margostino/babel-agent/internal/agent"
+	"github.com/margostino/babel-agent/internal/tools"
+)
+
+func runDoctor(ctx context.Context, args []string, stdout io.Writer) error {
+	flags, configPath := newFlagSet("doctor")
+	fix := flags.Bool("fix", false, "Reconcile the issues found")
+	asJSON := flags.Bool("json", false, "Print the issues as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	a, err := agent.NewAgent(c)
+	if err != nil {
+		return fmt.Errorf("%w (is the agent running? stop it while running the doctor)", err)
+	}
+	defer a.Close()
+
+	issues, err := a.Doctor(ctx, *fix)
+	if *asJSON {
+		printIssuesJSON(stdout, issues)
+	} else {
+		printIssues(stdout, issues, *fix)
+	}
+	if err != nil {
+		return err
+	}
+	for _, issue := range issues {
+		if *fix && !issue.Fixed {
+			return fmt.Errorf("some issues could not be fixed")
+		}
+	}
+	return nil
+}
+
+func printIssues(stdout io.Writer, issues []*tools.Issue, fix bool) {
+	if len(issues) == 0 {
+		fmt.Fprintln(stdout, "No issues found")
+		return
+	}
+	for _, issue := range issues {
+		switch {
+		case !fix:
+			fmt.Fprintf(stdout, "%s\n", issue)
+		case issue.Fixed:
+			fmt.Fprintf(stdout, "fixed   %s\n", issue)
+		default:
+			fmt.Fprintf(stdout, "failed  %s: %v\n", issue, issue.Err)
+		}
+	}
+	fmt.Fprintf(stdout, "%d issues found\n", len(issues))
+}
+
+func printIssuesJSON(stdout io.Writer, issues []*tools.Issue) {
+	type issueOutput struct {
+		*tools.Issue
+		Error string `json:"error,omitempty"`
+	}
+	output := make([]issueOutput, 0, len(issues))
+	for _, issue := range issues {
+		item := issueOutput{Issue: issue}
+		if issue.Err != nil {
+			item.Error = issue.Err.Error()
+		}
+		output = append(output, item)
+	}
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(output)
+}
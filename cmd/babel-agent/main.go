@@ -15,6 +15,20 @@ import (
 
 func main() {
 	log.SetOutput(os.Stdout)
+
+	if len(os.Args) > 1 {
+		if command, found := commands[os.Args[1]]; found {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			err := command(ctx, os.Args[2:], os.Stdout)
+			stop()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 
@@ -54,6 +68,10 @@ func main() {
 }
 
 func run(ctx context.Context, c *config.Config, stdout io.Writer) error {
-	agent := agent.NewAgent(c)
+	agent, err := agent.NewAgent(c)
+	if err != nil {
+		return err
+	}
+	defer agent.Close()
 	return agent.Run(ctx)
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/margostino/babel-agent/internal/db"
+	"github.com/margostino/babel-agent/internal/mcp"
+)
+
+func runMCP(ctx context.Context, args []string, stdout io.Writer) error {
+	flags, configPath := newFlagSet("mcp")
+	transport := flags.String("transport", "stdio", "Transport: stdio or http")
+	address := flags.String("address", "127.0.0.1:8687", "Address the http transport listens on")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	storage, err := db.NewStorage(c)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	server := mcp.NewServer(c, storage)
+
+	switch *transport {
+	case "stdio":
+		// stdout carries the protocol messages only.
+		log.SetOutput(os.Stderr)
+		return server.ServeStdio(ctx, os.Stdin, stdout)
+	case "http":
+		return server.ServeHTTP(ctx, *address)
+	default:
+		return fmt.Errorf("unknown transport %q, expected stdio or http", *transport)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/margostino/babel-agent/internal/agent"
+	"github.com/margostino/babel-agent/internal/tools"
+)
+
+func runReindex(ctx context.Context, args []string, stdout io.Writer) error {
+	flags, configPath := newFlagSet("reindex")
+	var options tools.ReindexOptions
+	flags.BoolVar(&options.OnlyMissing, "only-missing", false, "Only reindex the notes without metadata")
+	flags.StringVar(&options.Since, "since", "", "Only reindex the notes changed since this commit")
+	flags.StringVar(&options.Folder, "folder", "", "Only reindex the notes under this folder (e.g. RESOURCES)")
+	flags.IntVar(&options.BatchSize, "batch-size", 0, "Notes processed and written to the database at once (defaults to the database batch size)")
+	flags.BoolVar(&options.Restart, "restart", false, "Start over instead of resuming an interrupted reindex")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	a, err := agent.NewAgent(c)
+	if err != nil {
+		return fmt.Errorf("%w (is the agent running? stop it while reindexing)", err)
+	}
+	defer a.Close()
+
+	report, err := a.Reindex(ctx, options)
+	if report != nil {
+		fmt.Fprintf(stdout, "Files: %d (resumed: %d upserted: %d enriched: %d failed: %d)\n",
+			report.Files, report.Resumed, report.Upserted, report.Enriched, len(report.Failures))
+		for _, failure := range report.Failures {
+			fmt.Fprintf(stdout, "  %s: %v\n", failure.Change.Path, failure.Err)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("reindex stopped, run it again to resume: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/margostino/babel-agent/internal/db"
+	"github.com/margostino/babel-agent/internal/search"
+)
+
+// summaryWidth is the width the summaries and highlights are cut to in tables.
+const summaryWidth = 60
+
+func runSearch(ctx context.Context, args []string, stdout io.Writer) error {
+	flags, configPath := newFlagSet("search")
+	mode := flags.String("mode", string(search.Hybrid), "Search mode: hybrid (BM25 + vector) or neartext (vector only)")
+	alpha := flags.Float64("alpha", 0.5, "Weight of the vector ranking in hybrid searches, from 0 (keywords only) to 1")
+	limit := flags.Int("limit", 10, "Maximum number of results")
+	category := flags.String("category", "", "Only notes of this category (e.g. Resources)")
+	tags := flags.String("tags", "", "Only notes with any of these comma separated tags")
+	folder := flags.String("folder", "", "Only notes under this folder (e.g. RESOURCES/books)")
+	chunks := flags.Bool("chunks", false, "Search the passages of the notes instead of whole notes")
+	asJSON := flags.Bool("json", false, "Print the results as JSON")
+	words, err := parseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(words) == 0 {
+		return fmt.Errorf("usage: babel-agent search [flags] \"<query>\"")
+	}
+
+	searchMode, err := search.ParseMode(*mode)
+	if err != nil {
+		return err
+	}
+	query := &search.Query{
+		Text:     strings.Join(words, " "),
+		Mode:     searchMode,
+		Alpha:    float32(*alpha),
+		Limit:    *limit,
+		Category: *category,
+		Folder:   *folder,
+	}
+	if *tags != "" {
+		query.Tags = strings.Split(*tags, ",")
+	}
+
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	storage, err := db.NewStorage(c)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	if *chunks {
+		results, err := search.SearchChunks(ctx, storage, query)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(stdout, results)
+		}
+		printChunkResults(stdout, results)
+		return nil
+	}
+	results, err := search.Search(ctx, storage, query)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(stdout, results)
+	}
+	printResults(stdout, results)
+	return nil
+}
+
+func printJSON(stdout io.Writer, value interface{}) error {
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func printResults(stdout io.Writer, results []*search.Result) {
+	if len(results) == 0 {
+		fmt.Fprintln(stdout, "No results")
+		return
+	}
+	table := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "SCORE\tPATH\tSUMMARY")
+	for _, result := range results {
+		fmt.Fprintf(table, "%.3f\t%s\t%s\n", result.Score, result.Path, truncate(result.Summary, summaryWidth))
+		for _, highlight := range result.Highlights {
+			fmt.Fprintf(table, "\t\t- %s\n", truncate(highlight, summaryWidth))
+		}
+	}
+	table.Flush()
+}
+
+func printChunkResults(stdout io.Writer, results []*search.ChunkResult) {
+	if len(results) == 0 {
+		fmt.Fprintln(stdout, "No results")
+		return
+	}
+	table := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "SCORE\tPATH\tBYTES\tHEADING")
+	for _, result := range results {
+		fmt.Fprintf(table, "%.3f\t%s\t%d-%d\t%s\n", result.Score, result.Path, result.Start, result.End, truncate(result.Heading, summaryWidth))
+		fmt.Fprintf(table, "\t\t\t%s\n", truncate(result.Content, summaryWidth))
+	}
+	table.Flush()
+}
+
+// truncate cuts the text to the width in runes, on a single line.
+func truncate(text string, width int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	runes := []rune(text)
+	if len(runes) <= width {
+		return text
+	}
+	return string(runes[:width-3]) + "..."
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/margostino/babel-agent/internal/api"
+)
+
+func runStatus(ctx context.Context, args []string, stdout io.Writer) error {
+	flags, configPath := newFlagSet("status")
+	asJSON := flags.Bool("json", false, "Print the status as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s/status", c.Api.Address), nil)
+	if err != nil {
+		return err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("%w (is the agent running with the API enabled?)", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("status request failed: %s", response.Status)
+	}
+
+	var status api.Status
+	if err := json.NewDecoder(response.Body).Decode(&status); err != nil {
+		return err
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(status)
+	}
+	printStatus(stdout, &status)
+	return nil
+}
+
+func printStatus(stdout io.Writer, status *api.Status) {
+	fmt.Fprintf(stdout, "Running since     %s\n", status.StartedAt.Format(time.RFC3339))
+	switch {
+	case status.Offline && status.NextProbeAt != nil:
+		fmt.Fprintf(stdout, "Remote            offline since %s, next probe at %s\n", status.OfflineSince.Format(time.RFC3339), status.NextProbeAt.Format(time.RFC3339))
+	case status.Offline:
+		fmt.Fprintf(stdout, "Remote            offline since %s\n", status.OfflineSince.Format(time.RFC3339))
+	default:
+		fmt.Fprintln(stdout, "Remote            online")
+	}
+	fmt.Fprintf(stdout, "Unpushed commits  %d\n", status.UnpushedCommits)
+	fmt.Fprintf(stdout, "Pending files     %d\n", status.PendingFiles)
+	if status.Conflict != "" {
+		fmt.Fprintf(stdout, "Conflict          %s\n", status.Conflict)
+	}
+	if status.Syncing {
+		fmt.Fprintln(stdout, "Syncing           now")
+	}
+
+	run := status.LastRun
+	if run == nil {
+		return
+	}
+	fmt.Fprintf(stdout, "Last sync         %s (%s), %d changes, %d failures\n", run.FinishedAt.Format(time.RFC3339), run.Trigger, run.Changes, len(run.Failures))
+	if run.Error != "" {
+		fmt.Fprintf(stdout, "Last error        %s\n", run.Error)
+	}
+	for _, failure := range run.Failures {
+		fmt.Fprintf(stdout, "  %s: %s\n", failure.Path, failure.Error)
+	}
+}
@@ -2,53 +2,410 @@ package agent
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/go-git/go-git/v5"
+	"github.com/margostino/babel-agent/internal/api"
 	"github.com/margostino/babel-agent/internal/config"
 	"github.com/margostino/babel-agent/internal/db"
+	"github.com/margostino/babel-agent/internal/llm"
+	"github.com/margostino/babel-agent/internal/queue"
+	"github.com/margostino/babel-agent/internal/state"
 	"github.com/margostino/babel-agent/internal/tools"
-	"github.com/weaviate/weaviate-go-client/v4/weaviate"
+	"github.com/margostino/babel-agent/internal/watcher"
 )
 
-type Tools struct {
-	UpdateGit func(dbClient *weaviate.Client, config *config.Config) (bool, error)
-}
+var watcherSkipNames = []string{".git", "z-metadata", ".DS_Store"}
 
 type Agent struct {
-	config   *config.Config
-	tools    Tools
-	dbClient *weaviate.Client
+	config      *config.Config
+	registry    *tools.Registry
+	queue       *queue.Queue
+	storage     db.Storage
+	store       *state.Store
+	provider    llm.Provider
+	enricher    *tools.MetadataEnricher
+	schemaReady bool
+
+	// syncRequests holds at most one sync asked for through the API.
+	syncRequests chan struct{}
+	statusLock   sync.Mutex
+	status       api.Status
+	// probeBackoff is the wait before the next connectivity probe while the
+	// remote is unreachable.
+	probeBackoff time.Duration
 }
 
-func NewAgent(config *config.Config) *Agent {
-	return &Agent{
-		config:   config,
-		dbClient: db.NewDBClient(config.OpenAi.ApiKey, config.Db.Port),
-		tools: Tools{
-			UpdateGit: tools.UpdateGit,
+func NewAgent(config *config.Config) (*Agent, error) {
+	store, err := state.Open(filepath.Join(config.Agent.StateDir, "state.db"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state store: %w", err)
+	}
+
+	provider, err := llm.NewProvider(config)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	storage, err := db.NewStorage(config)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	jobs := queue.NewQueue(queue.Options{
+		IsRetryable: func(err error) bool {
+			return tools.KindOf(err) == tools.Transient
 		},
+		Workers:           config.Queue.Workers,
+		MaxRetries:        config.Queue.MaxRetries,
+		Backoff:           config.Queue.Backoff,
+		MaxBackoff:        config.Queue.MaxBackoff,
+		RequestsPerMinute: config.Queue.RequestsPerMinute,
+		TokensPerMinute:   config.Queue.TokensPerMinute,
+	})
+	// Every request counts against the rate limits, a job may make several.
+	provider = llm.Limit(provider, jobs.Limiter())
+	enricher := tools.NewMetadataEnricher(storage, provider, config, jobs, store)
+	registry := tools.NewRegistry(config)
+	for _, tool := range []tools.Tool{tools.NewAssetsCleaner(config), enricher} {
+		if err := registry.Register(tool); err != nil {
+			storage.Close()
+			store.Close()
+			return nil, err
+		}
 	}
+
+	return &Agent{
+		config:   config,
+		registry: registry,
+		queue:    jobs,
+		storage:  storage,
+		store:    store,
+		provider: provider,
+		enricher: enricher,
+
+		syncRequests: make(chan struct{}, 1),
+		status:       api.Status{StartedAt: time.Now()},
+	}, nil
+}
+
+func (a *Agent) Close() error {
+	a.storage.Close()
+	return a.store.Close()
+}
+
+// RegisterTool adds a tool to the pipeline run over every change set.
+func (a *Agent) RegisterTool(tool tools.Tool) error {
+	return a.registry.Register(tool)
 }
 
 func (a *Agent) Run(ctx context.Context) error {
+	a.queue.Start(ctx)
+
+	if a.config.Tools.GitUpdaterEnabled {
+		if err := tools.RecoverSync(a.config, a.store); err != nil {
+			return err
+		}
+	}
+
+	if a.config.Api.Enabled {
+		server := api.NewServer(a.config, a.storage, a)
+		go func() {
+			if err := server.Run(ctx); err != nil {
+				log.Printf("API server stopped: %v\n", err)
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(a.config.Agent.Tick)
+	defer ticker.Stop()
+
+	// A nil channel blocks forever, so without a watcher only the ticker fires.
+	var changes <-chan []string
+	if a.config.Agent.Watch {
+		w, err := watcher.NewWatcher(a.config.Repository.Path, a.config.Agent.Debounce, watcherSkipNames)
+		if err != nil {
+			log.Printf("Failed to start watcher, falling back to ticking only: %v\n", err)
+		} else {
+			changes = w.Changes()
+			go w.Run(ctx)
+		}
+	}
+
+	// probe fires the next connectivity probe while offline.
+	var probe <-chan time.Time
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
-		case <-time.NewTicker(a.config.Agent.Tick).C:
-			var wg sync.WaitGroup
-			if a.config.Tools.GitUpdaterEnabled {
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					a.tools.UpdateGit(a.dbClient, a.config)
-				}()
-				wg.Wait()
-			} else {
-				log.Println("Git updater tool is disabled.")
+		case changedPaths := <-changes:
+			log.Printf("Detected changes in %d paths\n", len(changedPaths))
+			if err := a.updateGit(ctx, "watch", changedPaths); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := a.updateGit(ctx, "tick", nil); err != nil {
+				return err
 			}
+		case <-a.syncRequests:
+			log.Println("Sync requested through the API")
+			if err := a.updateGit(ctx, "api", nil); err != nil {
+				return err
+			}
+		case <-probe:
+			probe = nil
+			if err := a.probeRemote(ctx); err != nil {
+				return err
+			}
+		}
+		if probe == nil && a.isOffline() {
+			probe = a.scheduleProbe()
+		}
+	}
+}
+
+// TriggerSync asks the run loop for a sync cycle. It returns false when one is
+// already waiting.
+func (a *Agent) TriggerSync() bool {
+	select {
+	case a.syncRequests <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Status returns the state of the agent and the outcome of the last sync.
+func (a *Agent) Status() api.Status {
+	a.statusLock.Lock()
+	status := a.status
+	a.statusLock.Unlock()
+
+	if pending, err := a.store.Pending(); err == nil {
+		status.PendingFiles = len(pending)
+	}
+	return status
+}
+
+func (a *Agent) updateStatus(update func(status *api.Status)) {
+	a.statusLock.Lock()
+	defer a.statusLock.Unlock()
+	update(&a.status)
+}
+
+// updateGit runs a sync cycle and only returns the errors that must stop the
+// agent. Files left pending in the state store, because they failed with a
+// transient error or the agent stopped while processing them, are retried.
+func (a *Agent) updateGit(ctx context.Context, trigger string, changedPaths []string) error {
+	if !a.config.Tools.GitUpdaterEnabled {
+		log.Println("Git updater tool is disabled.")
+		return nil
+	}
+
+	run := &api.Run{Trigger: trigger, StartedAt: time.Now()}
+	offline := a.isOffline()
+	a.updateStatus(func(status *api.Status) {
+		status.Syncing = true
+	})
+	defer func() {
+		unpushed, err := tools.UnpushedCommits(a.config)
+		if err != nil {
+			log.Printf("Failed to count unpushed commits: %v\n", err)
 		}
+		a.updateStatus(func(status *api.Status) {
+			run.FinishedAt = time.Now()
+			status.Syncing = false
+			status.LastRun = run
+			if err != nil {
+				return
+			}
+			if offline && unpushed != status.UnpushedCommits {
+				log.Printf("Offline, %d commits waiting to be pushed\n", unpushed)
+			}
+			status.UnpushedCommits = unpushed
+		})
+	}()
+
+	a.ensureSchema(ctx)
+
+	pending, err := a.store.Pending()
+	if err != nil {
+		return fmt.Errorf("failed to get pending files: %w", err)
+	}
+	retries := make([]*tools.FileChange, 0, len(pending))
+	for _, fileState := range pending {
+		status := git.Modified
+		if fileState.Pending == state.DeleteOperation {
+			status = git.Deleted
+		}
+		retries = append(retries, &tools.FileChange{Path: fileState.Path, Status: status})
+	}
+	if len(retries) > 0 {
+		log.Printf("Retrying %d pending files\n", len(retries))
+	}
+
+	changeSet, err := tools.UpdateGit(ctx, a.registry, a.config, a.store, a.provider, tools.SyncOptions{
+		ChangedPaths: changedPaths,
+		Retries:      retries,
+		Offline:      offline,
+	})
+	if err != nil {
+		run.Error = err.Error()
+		kind := tools.KindOf(err)
+		if kind == tools.Fatal {
+			return err
+		}
+		if kind == tools.Conflict {
+			a.stopOnConflict(ctx, err)
+			return nil
+		}
+		if kind == tools.Offline {
+			a.goOffline(err)
+			return nil
+		}
+		log.Printf("Sync failed (%s error), will try again: %v\n", kind, err)
+		return nil
+	}
+	a.updateStatus(func(status *api.Status) {
+		if status.Conflict != "" {
+			log.Println("Conflict resolved, syncing again")
+		}
+		status.Conflict = ""
+	})
+
+	run.Changes = len(changeSet.Changes)
+	if failures := changeSet.Failures(); len(failures) > 0 {
+		log.Printf("%d files failed in this run\n", len(failures))
+		for _, failure := range failures {
+			run.Failures = append(run.Failures, api.Failure{Path: failure.Change.Path, Error: failure.Err.Error()})
+		}
+	}
+	return nil
+}
+
+// stopOnConflict records the conflict and notifies it once. Local changes are
+// not committed while it lasts, every sync checks again whether it was resolved.
+func (a *Agent) stopOnConflict(ctx context.Context, err error) {
+	message := fmt.Sprintf("Babel sync stopped, resolve the conflict in %s: %v", a.config.Repository.Path, err)
+	notify := false
+	a.updateStatus(func(status *api.Status) {
+		notify = status.Conflict != err.Error()
+		status.Conflict = err.Error()
+	})
+	if !notify {
+		return
+	}
+
+	log.Println(message)
+	fields := strings.Fields(a.config.Sync.NotifyCommand)
+	if len(fields) == 0 {
+		return
+	}
+	command := exec.CommandContext(ctx, fields[0], append(fields[1:], message)...)
+	if output, err := command.CombinedOutput(); err != nil {
+		log.Printf("Failed to run the notify command: %v %s\n", err, strings.TrimSpace(string(output)))
+	}
+}
+
+func (a *Agent) isOffline() bool {
+	a.statusLock.Lock()
+	defer a.statusLock.Unlock()
+	return a.status.Offline
+}
+
+// goOffline records that the remote cannot be reached. Until a probe reaches it
+// again, sync cycles only commit locally.
+func (a *Agent) goOffline(err error) {
+	now := time.Now()
+	a.probeBackoff = a.config.Sync.ProbeBackoff
+	a.updateStatus(func(status *api.Status) {
+		status.Offline = true
+		status.OfflineSince = &now
+	})
+	log.Printf("Remote unreachable, working offline and committing locally: %v\n", err)
+}
+
+// scheduleProbe returns the channel firing the next connectivity probe.
+func (a *Agent) scheduleProbe() <-chan time.Time {
+	next := time.Now().Add(a.probeBackoff)
+	a.updateStatus(func(status *api.Status) {
+		status.NextProbeAt = &next
+	})
+	return time.After(a.probeBackoff)
+}
+
+// probeRemote checks whether the unreachable remote is back. When it is, a sync
+// pushes the commits made offline, otherwise the next probe waits twice as long.
+func (a *Agent) probeRemote(ctx context.Context) error {
+	err := tools.ProbeRemote(ctx, a.config)
+	if err != nil {
+		if tools.KindOf(err) == tools.Fatal {
+			return err
+		}
+		a.probeBackoff *= 2
+		if a.probeBackoff > a.config.Sync.MaxProbeBackoff {
+			a.probeBackoff = a.config.Sync.MaxProbeBackoff
+		}
+		log.Printf("Remote still unreachable, probing again in %s: %v\n", a.probeBackoff, err)
+		return nil
+	}
+
+	var since time.Time
+	unpushed := 0
+	a.updateStatus(func(status *api.Status) {
+		since = *status.OfflineSince
+		unpushed = status.UnpushedCommits
+		status.Offline = false
+		status.OfflineSince = nil
+		status.NextProbeAt = nil
+	})
+	log.Printf("Remote reachable again after %s offline, pushing %d unpushed commits\n", time.Since(since).Round(time.Second), unpushed)
+	return a.updateGit(ctx, "probe", nil)
+}
+
+// ensureSchema creates or migrates the database class once. Weaviate may not be
+// up when the agent starts, so it is tried again before every sync until it
+// succeeds; in the meantime enrichment fails with transient errors and is retried.
+func (a *Agent) ensureSchema(ctx context.Context) {
+	if a.schemaReady || !a.config.Tools.MetadataEnricherEnabled {
+		return
+	}
+	if err := a.storage.EnsureSchema(ctx); err != nil {
+		log.Printf("Failed to ensure the database schema, will try again: %v\n", err)
+		return
+	}
+	a.schemaReady = true
+}
+
+// Reindex enriches or re-upserts the notes selected by the options, whether git
+// reports them as changed or not. The metadata written to z-metadata is
+// committed by the next sync of the daemon.
+func (a *Agent) Reindex(ctx context.Context, options tools.ReindexOptions) (*tools.ReindexReport, error) {
+	a.queue.Start(ctx)
+	if err := a.storage.EnsureSchema(ctx); err != nil {
+		return nil, err
+	}
+	return a.enricher.Reindex(ctx, options)
+}
+
+// Doctor checks the consistency of the notes, z-metadata and the database, and
+// fixes the issues found when asked to.
+func (a *Agent) Doctor(ctx context.Context, fix bool) ([]*tools.Issue, error) {
+	a.queue.Start(ctx)
+	doctor := tools.NewDoctor(a.storage, a.config, a.store, a.enricher)
+	issues, err := doctor.Check(ctx)
+	if err != nil || !fix || len(issues) == 0 {
+		return issues, err
+	}
+	if err := a.storage.EnsureSchema(ctx); err != nil {
+		return issues, err
 	}
+	return issues, doctor.Fix(ctx, issues)
 }
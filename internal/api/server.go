@@ -0,0 +1,305 @@
+// Package api serves a small HTTP API on a local address, so that editor
+// plugins and scripts query the notes through the agent instead of talking to
+// Weaviate directly.
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/margostino/babel-agent/internal/config"
+	"github.com/margostino/babel-agent/internal/db"
+	"github.com/margostino/babel-agent/internal/metadata"
+	"github.com/margostino/babel-agent/internal/search"
+	"github.com/margostino/babel-agent/internal/tools"
+	"github.com/margostino/babel-agent/internal/utils"
+)
+
+const shutdownTimeout = 5 * time.Second
+
+// Agent is the part of the agent the API drives.
+type Agent interface {
+	// TriggerSync asks for a sync cycle as soon as possible. It returns false
+	// when one is already waiting to run.
+	TriggerSync() bool
+	Status() Status
+}
+
+type Server struct {
+	config  *config.Config
+	storage db.Storage
+	agent   Agent
+}
+
+func NewServer(config *config.Config, storage db.Storage, agent Agent) *Server {
+	return &Server{
+		config:  config,
+		storage: storage,
+		agent:   agent,
+	}
+}
+
+// Count is the number of notes with a tag or a category.
+type Count struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// Handler returns the routes of the API, only served to local clients.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search", s.handleSearch)
+	mux.HandleFunc("/metadata", s.handleMetadata)
+	mux.HandleFunc("/tags", s.handleTags)
+	mux.HandleFunc("/categories", s.handleCategories)
+	mux.HandleFunc("/sync", s.handleSync)
+	mux.HandleFunc("/status", s.handleStatus)
+	return s.localOnly(mux)
+}
+
+// localOnly refuses the requests of foreign web pages. Browsers send an Origin
+// with cross-site requests, and a DNS rebinding attack reaches the server with
+// the Host of the attacker, so both must be local. The configured address is
+// accepted as Host when the API deliberately listens beyond loopback.
+func (s *Server) localOnly(next http.Handler) http.Handler {
+	listenHost, _, _ := net.SplitHostPort(s.config.Api.Address)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" && !utils.IsLocalOrigin(origin) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("forbidden origin %s", origin))
+			return
+		}
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = hostname
+		}
+		host = strings.Trim(host, "[]")
+		if !utils.IsLoopbackHost(host) && (host == "" || host != listenHost) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("forbidden host %s", r.Host))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Run serves the API until the context is done.
+func (s *Server) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.config.Api.Address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.config.Api.Address, err)
+	}
+	if host, _, err := net.SplitHostPort(s.config.Api.Address); err == nil {
+		if !utils.IsLoopbackHost(host) {
+			log.Printf("The API listens on %s, which is not a loopback address\n", s.config.Api.Address)
+		}
+	}
+
+	server := &http.Server{Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Serving the API on http://%s\n", listener.Addr())
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return false
+	}
+	return true
+}
+
+// handleSearch runs a search, e.g. /search?q=go+cli&mode=hybrid&limit=5&tags=go,cli.
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	params := r.URL.Query()
+	query := &search.Query{
+		Text:     params.Get("q"),
+		Alpha:    0.5,
+		Category: params.Get("category"),
+		Folder:   params.Get("folder"),
+	}
+	if query.Text == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing q parameter"))
+		return
+	}
+	if tags := params.Get("tags"); tags != "" {
+		query.Tags = strings.Split(tags, ",")
+	}
+
+	var err error
+	if mode := params.Get("mode"); mode != "" {
+		if query.Mode, err = search.ParseMode(mode); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit: %w", err))
+			return
+		}
+	}
+	if alpha := params.Get("alpha"); alpha != "" {
+		value, err := strconv.ParseFloat(alpha, 32)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid alpha: %w", err))
+			return
+		}
+		query.Alpha = float32(value)
+	}
+
+	results, err := search.Search(r.Context(), s.storage, query)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+// handleMetadata returns the metadata of a note, e.g. /metadata?path=RESOURCES/go.
+func (s *Server) handleMetadata(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	path := r.URL.Query().Get("path")
+	if path == "" || !filepath.IsLocal(path) {
+		writeError(w, http.StatusBadRequest, errors.New("path must be relative to the repository root"))
+		return
+	}
+	data, err := tools.ReadMetadata(s.config, filepath.ToSlash(filepath.Clean(path)))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if data == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no metadata for %s", path))
+		return
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// countMetadata counts the notes by the values of a metadata field.
+func (s *Server) countMetadata(field string) ([]Count, error) {
+	paths, err := tools.MetadataPaths(s.config)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int{}
+	for _, path := range paths {
+		data, err := tools.ReadMetadata(s.config, path)
+		if err != nil {
+			log.Printf("Skipping metadata of %s: %v\n", path, err)
+			continue
+		}
+		switch value := data[field].(type) {
+		case string:
+			counts[value]++
+		case []interface{}:
+			for _, item := range value {
+				if name, ok := item.(string); ok {
+					counts[name]++
+				}
+			}
+		}
+	}
+	return sortCounts(counts), nil
+}
+
+// sortCounts returns the counts from the most to the least used name.
+func sortCounts(counts map[string]int) []Count {
+	sorted := make([]Count, 0, len(counts))
+	for name, count := range counts {
+		sorted = append(sorted, Count{Name: name, Count: count})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+func (s *Server) handleTags(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	counts, err := s.countMetadata("tags")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, counts)
+}
+
+// handleCategories lists every category of the metadata schema, including the
+// ones without notes.
+func (s *Server) handleCategories(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	schema, err := metadata.LoadSchema()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	counts, err := s.countMetadata("category")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	found := map[string]int{}
+	for _, count := range counts {
+		found[count.Name] = count.Count
+	}
+	for _, category := range schema.Categories() {
+		found[category] += 0
+	}
+	writeJSON(w, http.StatusOK, sortCounts(found))
+}
+
+func (s *Server) handleSync(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]bool{"queued": s.agent.TriggerSync()})
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.agent.Status())
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"time"
+)
+
+// Failure is a file that failed in a sync cycle.
+type Failure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// Run is the outcome of a sync cycle.
+type Run struct {
+	// Trigger is what started the cycle: watch, tick, api or probe.
+	Trigger    string    `json:"trigger"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Changes    int       `json:"changes"`
+	Failures   []Failure `json:"failures,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Status is the state of the running agent.
+type Status struct {
+	StartedAt    time.Time `json:"startedAt"`
+	Syncing      bool      `json:"syncing"`
+	PendingFiles int       `json:"pendingFiles"`
+	LastRun      *Run      `json:"lastRun,omitempty"`
+	// Conflict is set while syncing is stopped on local and remote changes the
+	// conflict strategy does not integrate.
+	Conflict string `json:"conflict,omitempty"`
+	// Offline is set while the remote cannot be reached. Changes are committed
+	// locally and the remote is probed again at NextProbeAt.
+	Offline         bool       `json:"offline"`
+	OfflineSince    *time.Time `json:"offlineSince,omitempty"`
+	NextProbeAt     *time.Time `json:"nextProbeAt,omitempty"`
+	UnpushedCommits int        `json:"unpushedCommits"`
+}
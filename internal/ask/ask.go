@@ -0,0 +1,178 @@
+// Package ask answers questions over the notes: the passages, or the notes
+// when passages are not indexed, most relevant to the question are retrieved
+// from the index and the chat model answers grounded on them, citing the notes
+// it used.
+package ask
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/margostino/babel-agent/internal/config"
+	"github.com/margostino/babel-agent/internal/db"
+	"github.com/margostino/babel-agent/internal/llm"
+	"github.com/margostino/babel-agent/internal/openai"
+	"github.com/margostino/babel-agent/internal/search"
+	"github.com/margostino/babel-agent/internal/tools"
+)
+
+const (
+	defaultLimit            = 5
+	defaultMaxTokensPerNote = 1500
+	// alpha leans on vectors, questions rarely share their words with the answer.
+	alpha = 0.75
+)
+
+// citationPattern matches the citations of the answer, e.g. [1] or [1, 3].
+var citationPattern = regexp.MustCompile(`\[(\d+(?:\s*,\s*\d+)*)\]`)
+
+// Options narrow the notes the answer is grounded on.
+type Options struct {
+	// Limit is the number of passages or notes retrieved.
+	Limit int
+	// MaxTokensPerNote cuts the notes sent to the model.
+	MaxTokensPerNote int
+	Category         string
+	Tags             []string
+	Folder           string
+}
+
+// Source is a note the answer was grounded on, numbered as cited in the answer.
+// Passage is the part of the note retrieved, when passages are indexed.
+type Source struct {
+	Number  int      `json:"number"`
+	Path    string   `json:"path"`
+	Score   float64  `json:"score"`
+	Passage *Passage `json:"passage,omitempty"`
+	Cited   bool     `json:"cited"`
+}
+
+// Passage locates a passage in its note: the headings it is under and its byte
+// offsets.
+type Passage struct {
+	Heading string `json:"heading"`
+	Start   int    `json:"start"`
+	End     int    `json:"end"`
+}
+
+type Answer struct {
+	Question string    `json:"question"`
+	Text     string    `json:"answer"`
+	Sources  []*Source `json:"sources"`
+}
+
+// Citations returns the sources cited in the answer.
+func (a *Answer) Citations() []*Source {
+	var cited []*Source
+	for _, source := range a.Sources {
+		if source.Cited {
+			cited = append(cited, source)
+		}
+	}
+	return cited
+}
+
+// Ask retrieves the passages most relevant to the question, or the notes when
+// no passage is indexed, and asks the model to answer from them only.
+func Ask(ctx context.Context, storage db.Storage, provider llm.Provider, config *config.Config, question string, options Options) (*Answer, error) {
+	if options.Limit <= 0 {
+		options.Limit = defaultLimit
+	}
+	if options.MaxTokensPerNote <= 0 {
+		options.MaxTokensPerNote = defaultMaxTokensPerNote
+	}
+
+	query := &search.Query{
+		Text:     question,
+		Mode:     search.Hybrid,
+		Alpha:    alpha,
+		Limit:    options.Limit,
+		Category: options.Category,
+		Tags:     options.Tags,
+		Folder:   options.Folder,
+	}
+	answer := &Answer{Question: question}
+	var sources strings.Builder
+	if config.Db.ChunkTokens > 0 {
+		chunks, err := search.SearchChunks(ctx, storage, query)
+		if err != nil {
+			return nil, err
+		}
+		for i, chunk := range chunks {
+			answer.Sources = append(answer.Sources, &Source{
+				Number:  i + 1,
+				Path:    chunk.Path,
+				Score:   chunk.Score,
+				Passage: &Passage{Heading: chunk.Heading, Start: chunk.Start, End: chunk.End},
+			})
+			fmt.Fprintf(&sources, "[%d] Path: %s\n%s\n\n", i+1, chunk.Path, passage(chunk, options.MaxTokensPerNote))
+		}
+	}
+	// Notes indexed before passages were, or with passages disabled, are
+	// retrieved whole.
+	if len(answer.Sources) == 0 {
+		results, err := search.Search(ctx, storage, query)
+		if err != nil {
+			return nil, err
+		}
+		for i, result := range results {
+			answer.Sources = append(answer.Sources, &Source{Number: i + 1, Path: result.Path, Score: result.Score})
+			fmt.Fprintf(&sources, "[%d] Path: %s\n%s\n\n", i+1, result.Path, excerpt(config, result, options.MaxTokensPerNote))
+		}
+	}
+	if len(answer.Sources) == 0 {
+		answer.Text = "No notes match the question."
+		return answer, nil
+	}
+
+	text, err := openai.GetChatCompletionForAnswer(ctx, provider, question, sources.String())
+	if err != nil {
+		return nil, err
+	}
+	answer.Text = strings.TrimSpace(text)
+	markCitations(answer)
+	return answer, nil
+}
+
+// excerpt returns the content of the note, or its summary and highlights when
+// the note cannot be read, e.g. when the index is ahead of the local copy.
+func excerpt(config *config.Config, result *search.Result, maxTokens int) string {
+	text, err := tools.NoteExcerpt(config, result.Path, maxTokens)
+	if err == nil {
+		return text
+	}
+	log.Printf("Using the summary of %s: %v\n", result.Path, err)
+	var fallback strings.Builder
+	fallback.WriteString(result.Summary)
+	for _, highlight := range result.Highlights {
+		fmt.Fprintf(&fallback, "\n- %s", highlight)
+	}
+	return fallback.String()
+}
+
+// passage returns the content of the chunk under its headings, cut to maxTokens.
+func passage(chunk *search.ChunkResult, maxTokens int) string {
+	content := tools.TruncateToTokens(chunk.Content, maxTokens)
+	if chunk.Heading == "" {
+		return content
+	}
+	return fmt.Sprintf("Section: %s\n%s", chunk.Heading, content)
+}
+
+// markCitations flags the sources cited in the answer. Numbers without a source
+// are ignored.
+func markCitations(answer *Answer) {
+	for _, match := range citationPattern.FindAllStringSubmatch(answer.Text, -1) {
+		for _, number := range strings.Split(match[1], ",") {
+			index, err := strconv.Atoi(strings.TrimSpace(number))
+			if err != nil || index < 1 || index > len(answer.Sources) {
+				continue
+			}
+			answer.Sources[index-1].Cited = true
+		}
+	}
+}
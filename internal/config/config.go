@@ -2,15 +2,39 @@ package config
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	"github.com/margostino/babel-agent/internal/common"
 	"github.com/margostino/babel-agent/internal/ssh"
 )
 
 const defaultTick = 10 * time.Second
+const defaultDebounce = 2 * time.Second
+
+// minProbeBackoff keeps an offline agent from probing the remote in a loop.
+const minProbeBackoff = time.Second
+
+func defaultStateDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".babel"
+	}
+	return filepath.Join(home, ".babel")
+}
+
+// DefaultPath is the configuration file read by the subcommands when no other is
+// given.
+func DefaultPath() string {
+	return filepath.Join(defaultStateDir(), "babel.toml")
+}
 
 func IsExecutable() bool {
 	return isExecutable
@@ -18,15 +42,26 @@ func IsExecutable() bool {
 
 type Config struct {
 	Repository struct {
-		Path    string `toml:"path"`
-		Message string `toml:"message"`
+		Path            string `toml:"path"`
+		Message         string `toml:"message"`
+		GenerateMessage bool   `toml:"generateMessage"`
 	}
 	User struct {
 		Username string `toml:"username"`
 		Email    string `toml:"email"`
 	}
 	Agent struct {
-		Tick time.Duration `toml:"tick"`
+		Tick     time.Duration `toml:"tick"`
+		Watch    bool          `toml:"watch"`
+		Debounce time.Duration `toml:"debounce"`
+		StateDir string        `toml:"stateDir"`
+	}
+	Sync struct {
+		ConflictStrategy string        `toml:"conflictStrategy"`
+		NotifyCommand    string        `toml:"notifyCommand"`
+		PushRetries      int           `toml:"pushRetries"`
+		ProbeBackoff     time.Duration `toml:"probeBackoff"`
+		MaxProbeBackoff  time.Duration `toml:"maxProbeBackoff"`
 	}
 	Ssh struct {
 		Passphrase string `toml:"passphrase"`
@@ -36,14 +71,60 @@ type Config struct {
 	OpenAi struct {
 		ApiKey string `toml:"apiKey"`
 	}
+	Llm struct {
+		Provider string        `toml:"provider"`
+		BaseUrl  string        `toml:"baseUrl"`
+		Model    string        `toml:"model"`
+		ApiKey   string        `toml:"apiKey"`
+		Timeout  time.Duration `toml:"timeout"`
+	}
 	Tools struct {
-		GitUpdaterEnabled       bool `toml:"gitUpdaterEnabled"`
-		AssetsCleanerEnabled    bool `toml:"assetsCleanerEnabled"`
-		MetadataEnricherEnabled bool `toml:"metadataEnricherEnabled"`
+		GitUpdaterEnabled       bool     `toml:"gitUpdaterEnabled"`
+		AssetsCleanerEnabled    bool     `toml:"assetsCleanerEnabled"`
+		MetadataEnricherEnabled bool     `toml:"metadataEnricherEnabled"`
+		Pipeline                []string `toml:"pipeline"`
 	}
 	Db struct {
-		Port int `toml:"port"`
+		Backend        string `toml:"backend"`
+		Path           string `toml:"path"`
+		Port           int    `toml:"port"`
+		EmbeddingModel string `toml:"embeddingModel"`
+		BatchSize      int    `toml:"batchSize"`
+		ChunkTokens    int    `toml:"chunkTokens"`
 	}
+	Enrichment struct {
+		MinChangeRatio   float64 `toml:"minChangeRatio"`
+		ChunkTokens      int     `toml:"chunkTokens"`
+		MaxTokensPerFile int     `toml:"maxTokensPerFile"`
+		RepairAttempts   int     `toml:"repairAttempts"`
+	}
+	Api struct {
+		Enabled bool   `toml:"enabled"`
+		Address string `toml:"address"`
+	}
+	Queue struct {
+		Workers           int           `toml:"workers"`
+		MaxRetries        int           `toml:"maxRetries"`
+		Backoff           time.Duration `toml:"backoff"`
+		MaxBackoff        time.Duration `toml:"maxBackoff"`
+		RequestsPerMinute int           `toml:"requestsPerMinute"`
+		TokensPerMinute   int           `toml:"tokensPerMinute"`
+	}
+}
+
+// GitAuth returns the authentication for the remote, or nil when no SSH key is
+// loaded (e.g. for local remotes).
+func (c *Config) GitAuth() transport.AuthMethod {
+	if c.Ssh.PublicKey == nil {
+		return nil
+	}
+	return c.Ssh.PublicKey
+}
+
+// MessageTemplate parses the commit message, a text/template which can also
+// call join (strings.Join).
+func (c *Config) MessageTemplate() (*template.Template, error) {
+	return template.New("message").Funcs(template.FuncMap{"join": strings.Join}).Parse(c.Repository.Message)
 }
 
 func (c *Config) Init(args []string) error {
@@ -65,17 +146,49 @@ func (c *Config) Init(args []string) error {
 
 	var (
 		tick                    = flags.Duration("tick", defaultTick, "Ticking interval")
+		watch                   = flags.Bool("watch", true, "Watch the repository for changes")
+		debounce                = flags.Duration("debounce", defaultDebounce, "Quiet period before a burst of changes is processed")
+		stateDir                = flags.String("stateDir", defaultStateDir(), "Directory for the agent state")
 		repo                    = flags.String("repo", "", "Path to local repository")
+		conflictStrategy        = flags.String("conflictStrategy", "rebase", "What to do when the remote diverged: rebase, keep-both or stop")
+		notifyCommand           = flags.String("notifyCommand", "", "Command run with the message when syncing stops on a conflict")
+		pushRetries             = flags.Int("pushRetries", 3, "Times a push rejected because the remote moved is retried after integrating it")
+		probeBackoff            = flags.Duration("probeBackoff", 30*time.Second, "Initial backoff between connectivity probes while offline")
+		maxProbeBackoff         = flags.Duration("maxProbeBackoff", 10*time.Minute, "Maximum backoff between connectivity probes while offline")
 		githubUser              = flags.String("user", "", "Github username")
 		email                   = flags.String("email", "", "Github email")
 		sshPassphrase           = flags.String("sshPassphrase", "", "SSH passphrase")
 		sshPath                 = flags.String("sshPath", "", "Path to SSH key")
 		openAiApiKey            = flags.String("openAiApiKey", "", "OpenAI API key")
-		message                 = flags.String("message", "Babel update", "Commit message")
+		llmProvider             = flags.String("llmProvider", "openai", "LLM provider: openai, openai-compatible, ollama or anthropic")
+		llmBaseUrl              = flags.String("llmBaseUrl", "", "Base URL of the LLM API (defaults to the provider's)")
+		llmModel                = flags.String("llmModel", "", "LLM model (defaults to the provider's)")
+		llmApiKey               = flags.String("llmApiKey", "", "LLM API key (defaults to the OpenAI API key for the openai and openai-compatible providers)")
+		llmTimeout              = flags.Duration("llmTimeout", 2*time.Minute, "Timeout of LLM requests")
+		message                 = flags.String("message", "Babel update", "Commit message, a text/template")
+		generateMessage         = flags.Bool("generateMessage", false, "Let the LLM write commit messages describing the changed notes")
 		gitUpdaterEnabled       = flags.Bool("gitUpdaterEnabled", false, "Enable GitUpdater tool")
 		assetsCleanerEnabled    = flags.Bool("assetsCleanerEnabled", false, "Enable AssetsCleaner tool")
 		metadataEnricherEnabled = flags.Bool("metadataEnricherEnabled", false, "Enable MetadataEnricher tool")
+		dbBackend               = flags.String("dbBackend", "weaviate", "Database backend: weaviate or embedded")
+		dbPath                  = flags.String("dbPath", "", "File of the embedded database (defaults to vectors.db in the state directory)")
 		dbPort                  = flags.Int("dbPort", 8585, "Port for the database")
+		dbBatchSize             = flags.Int("dbBatchSize", 100, "Objects written to the database per batch request")
+		dbChunkTokens           = flags.Int("dbChunkTokens", 300, "Maximum tokens of the passages of the notes indexed as chunks, 0 disables chunks")
+		embeddingModel          = flags.String("embeddingModel", "", "Embedding model of the database vectorizer (defaults to the module's)")
+		workers                 = flags.Int("workers", 4, "Number of concurrent enrichment workers")
+		maxRetries              = flags.Int("maxRetries", 3, "Retries of a failed enrichment job")
+		backoff                 = flags.Duration("backoff", time.Second, "Initial backoff between retries")
+		maxBackoff              = flags.Duration("maxBackoff", 30*time.Second, "Maximum backoff between retries")
+		requestsPerMinute       = flags.Int("requestsPerMinute", 60, "LLM requests per minute (0 is unlimited)")
+		tokensPerMinute         = flags.Int("tokensPerMinute", 90000, "LLM tokens per minute (0 is unlimited)")
+		minChangeRatio          = flags.Float64("minChangeRatio", 0, "Share of changed lines (0 to 1) needed to enrich a note again")
+		chunkTokens             = flags.Int("chunkTokens", 6000, "Tokens above which a file is enriched in chunks (0 disables chunking)")
+		maxTokensPerFile        = flags.Int("maxTokensPerFile", 60000, "Tokens of a file sent for enrichment at most (0 is unlimited)")
+		repairAttempts          = flags.Int("repairAttempts", 1, "Times the model is asked to repair metadata that does not follow the schema")
+		apiEnabled              = flags.Bool("apiEnabled", true, "Serve the local HTTP API")
+		apiAddress              = flags.String("apiAddress", "127.0.0.1:8686", "Address of the local HTTP API")
+		pipeline                = flags.String("pipeline", "", "Comma separated list of tools to run, in order")
 	)
 
 	if err := flags.Parse(args[1:]); err != nil {
@@ -84,7 +197,7 @@ func (c *Config) Init(args []string) error {
 
 	if configPath != nil {
 		var config Config
-		_, err := toml.DecodeFile(*configPath, &config)
+		md, err := toml.DecodeFile(*configPath, &config)
 		if err != nil {
 			panic(err)
 		}
@@ -100,25 +213,183 @@ func (c *Config) Init(args []string) error {
 		*gitUpdaterEnabled = config.Tools.GitUpdaterEnabled
 		*assetsCleanerEnabled = config.Tools.AssetsCleanerEnabled
 		*metadataEnricherEnabled = config.Tools.MetadataEnricherEnabled
+
+		if md.IsDefined("tools", "pipeline") {
+			*pipeline = strings.Join(config.Tools.Pipeline, ",")
+		}
+		if md.IsDefined("repository", "generateMessage") {
+			*generateMessage = config.Repository.GenerateMessage
+		}
+		if md.IsDefined("sync", "conflictStrategy") {
+			*conflictStrategy = config.Sync.ConflictStrategy
+		}
+		if md.IsDefined("sync", "notifyCommand") {
+			*notifyCommand = config.Sync.NotifyCommand
+		}
+		if md.IsDefined("sync", "pushRetries") {
+			*pushRetries = config.Sync.PushRetries
+		}
+		if md.IsDefined("sync", "probeBackoff") {
+			*probeBackoff = config.Sync.ProbeBackoff
+		}
+		if md.IsDefined("sync", "maxProbeBackoff") {
+			*maxProbeBackoff = config.Sync.MaxProbeBackoff
+		}
+		if md.IsDefined("llm", "provider") {
+			*llmProvider = config.Llm.Provider
+		}
+		if md.IsDefined("llm", "baseUrl") {
+			*llmBaseUrl = config.Llm.BaseUrl
+		}
+		if md.IsDefined("llm", "model") {
+			*llmModel = config.Llm.Model
+		}
+		if md.IsDefined("llm", "apiKey") {
+			*llmApiKey = config.Llm.ApiKey
+		}
+		if md.IsDefined("llm", "timeout") {
+			*llmTimeout = config.Llm.Timeout
+		}
+		if md.IsDefined("enrichment", "minChangeRatio") {
+			*minChangeRatio = config.Enrichment.MinChangeRatio
+		}
+		if md.IsDefined("enrichment", "chunkTokens") {
+			*chunkTokens = config.Enrichment.ChunkTokens
+		}
+		if md.IsDefined("enrichment", "maxTokensPerFile") {
+			*maxTokensPerFile = config.Enrichment.MaxTokensPerFile
+		}
+		if md.IsDefined("enrichment", "repairAttempts") {
+			*repairAttempts = config.Enrichment.RepairAttempts
+		}
+		if md.IsDefined("queue", "workers") {
+			*workers = config.Queue.Workers
+		}
+		if md.IsDefined("queue", "maxRetries") {
+			*maxRetries = config.Queue.MaxRetries
+		}
+		if md.IsDefined("queue", "backoff") {
+			*backoff = config.Queue.Backoff
+		}
+		if md.IsDefined("queue", "maxBackoff") {
+			*maxBackoff = config.Queue.MaxBackoff
+		}
+		if md.IsDefined("queue", "requestsPerMinute") {
+			*requestsPerMinute = config.Queue.RequestsPerMinute
+		}
+		if md.IsDefined("queue", "tokensPerMinute") {
+			*tokensPerMinute = config.Queue.TokensPerMinute
+		}
+		if md.IsDefined("agent", "watch") {
+			*watch = config.Agent.Watch
+		}
+		if md.IsDefined("agent", "debounce") {
+			*debounce = config.Agent.Debounce
+		}
+		if md.IsDefined("agent", "stateDir") {
+			*stateDir = config.Agent.StateDir
+		}
+		if md.IsDefined("api", "enabled") {
+			*apiEnabled = config.Api.Enabled
+		}
+		if md.IsDefined("api", "address") {
+			*apiAddress = config.Api.Address
+		}
+		if md.IsDefined("db", "backend") {
+			*dbBackend = config.Db.Backend
+		}
+		if md.IsDefined("db", "path") {
+			*dbPath = config.Db.Path
+		}
+		if md.IsDefined("db", "port") {
+			*dbPort = config.Db.Port
+		}
+		if md.IsDefined("db", "batchSize") {
+			*dbBatchSize = config.Db.BatchSize
+		}
+		if md.IsDefined("db", "chunkTokens") {
+			*dbChunkTokens = config.Db.ChunkTokens
+		}
+		if md.IsDefined("db", "embeddingModel") {
+			*embeddingModel = config.Db.EmbeddingModel
+		}
 	}
 
 	c.Agent.Tick = *tick
+	c.Agent.Watch = *watch
+	c.Agent.Debounce = *debounce
+	c.Agent.StateDir = *stateDir
 	c.Repository.Path = *repo
 	c.Repository.Message = *message
+	c.Repository.GenerateMessage = *generateMessage
+	c.Sync.ConflictStrategy = *conflictStrategy
+	c.Sync.NotifyCommand = *notifyCommand
+	c.Sync.PushRetries = *pushRetries
+	c.Sync.ProbeBackoff = *probeBackoff
+	c.Sync.MaxProbeBackoff = *maxProbeBackoff
 	c.User.Username = *githubUser
 	c.User.Email = *email
 	c.Ssh.Passphrase = *sshPassphrase
 	c.Ssh.FilePath = *sshPath
 	c.OpenAi.ApiKey = *openAiApiKey
+	c.Llm.Provider = *llmProvider
+	c.Llm.BaseUrl = *llmBaseUrl
+	c.Llm.Model = *llmModel
+	c.Llm.ApiKey = *llmApiKey
+	// The OpenAI key only authenticates against OpenAI compatible APIs.
+	if c.Llm.ApiKey == "" && (c.Llm.Provider == "openai" || c.Llm.Provider == "openai-compatible") {
+		c.Llm.ApiKey = c.OpenAi.ApiKey
+	}
+	c.Llm.Timeout = *llmTimeout
 	c.Tools.GitUpdaterEnabled = *gitUpdaterEnabled
 	c.Tools.AssetsCleanerEnabled = *assetsCleanerEnabled
 	c.Tools.MetadataEnricherEnabled = *metadataEnricherEnabled
+	c.Tools.Pipeline = nil
+	if *pipeline != "" {
+		c.Tools.Pipeline = strings.Split(*pipeline, ",")
+	}
+	c.Db.Backend = *dbBackend
+	c.Db.Path = *dbPath
 	c.Db.Port = *dbPort
+	c.Db.EmbeddingModel = *embeddingModel
+	c.Db.BatchSize = *dbBatchSize
+	c.Db.ChunkTokens = *dbChunkTokens
+	c.Enrichment.MinChangeRatio = *minChangeRatio
+	c.Enrichment.ChunkTokens = *chunkTokens
+	c.Enrichment.MaxTokensPerFile = *maxTokensPerFile
+	c.Enrichment.RepairAttempts = *repairAttempts
+	c.Api.Enabled = *apiEnabled
+	c.Api.Address = *apiAddress
+	c.Queue.Workers = *workers
+	c.Queue.MaxRetries = *maxRetries
+	c.Queue.Backoff = *backoff
+	c.Queue.MaxBackoff = *maxBackoff
+	c.Queue.RequestsPerMinute = *requestsPerMinute
+	c.Queue.TokensPerMinute = *tokensPerMinute
 
 	if c.Agent.Tick == 0 || c.Repository.Path == "" || c.User.Username == "" ||
 		c.User.Email == "" || c.Repository.Message == "" || c.Ssh.FilePath == "" ||
-		c.Ssh.Passphrase == "" || c.OpenAi.ApiKey == "" {
-		common.Fail("tick, repo, commit message, user, email, OpenAI API key and SSH Path and Passphrase are required")
+		c.Ssh.Passphrase == "" {
+		common.Fail("tick, repo, commit message, user, email and SSH Path and Passphrase are required")
+	}
+
+	if _, err := c.MessageTemplate(); err != nil {
+		common.Fail(fmt.Sprintf("invalid commit message template: %v", err))
+	}
+
+	if c.Sync.ProbeBackoff < minProbeBackoff || c.Sync.MaxProbeBackoff < c.Sync.ProbeBackoff {
+		common.Fail(fmt.Sprintf("probeBackoff must be at least %s and maxProbeBackoff at least probeBackoff", minProbeBackoff))
+	}
+
+	switch c.Sync.ConflictStrategy {
+	case "rebase", "keep-both", "stop":
+	default:
+		common.Fail(fmt.Sprintf("unknown conflict strategy %q, use rebase, keep-both or stop", c.Sync.ConflictStrategy))
+	}
+
+	// Local and self hosted models do not need a key.
+	if c.Llm.ApiKey == "" && (c.Llm.Provider == "openai" || c.Llm.Provider == "anthropic") {
+		common.Fail(fmt.Sprintf("an API key is required by the %s LLM provider", c.Llm.Provider))
 	}
 
 	sshAuth, keyErr := ssh.NewPublicKey(c.Ssh.FilePath, c.Ssh.Passphrase)
@@ -5,16 +5,34 @@ import (
 	"fmt"
 	"log"
 
+	"github.com/margostino/babel-agent/internal/config"
 	"github.com/weaviate/weaviate-go-client/v4/weaviate"
 )
 
-func NewDBClient(openAiApiKey string, port int) *weaviate.Client {
+// moduleHeaders returns the headers that Weaviate modules need to call the
+// configured LLM provider. Local providers need none.
+func moduleHeaders(config *config.Config) map[string]string {
+	headers := map[string]string{}
+	switch config.Llm.Provider {
+	case "openai":
+		headers["X-OpenAI-Api-Key"] = config.Llm.ApiKey
+	case "openai-compatible":
+		headers["X-OpenAI-Api-Key"] = config.Llm.ApiKey
+		headers["X-OpenAI-BaseURL"] = config.Llm.BaseUrl
+	case "anthropic":
+		// Anthropic has no embeddings, the OpenAI key (if any) still feeds the vectorizer.
+		if config.OpenAi.ApiKey != "" {
+			headers["X-OpenAI-Api-Key"] = config.OpenAi.ApiKey
+		}
+	}
+	return headers
+}
+
+func NewDBClient(config *config.Config) *weaviate.Client {
 	cfg := weaviate.Config{
-		Host:   fmt.Sprintf("%s:%d", "localhost", port),
-		Scheme: "http",
-		Headers: map[string]string{
-			"X-OpenAI-Api-Key": openAiApiKey,
-		},
+		Host:    fmt.Sprintf("%s:%d", "localhost", config.Db.Port),
+		Scheme:  "http",
+		Headers: moduleHeaders(config),
 	}
 	client, err := weaviate.NewClient(cfg)
 	if err != nil {
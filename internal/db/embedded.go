@@ -0,0 +1,511 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/margostino/babel-agent/internal/config"
+	"github.com/margostino/babel-agent/internal/llm"
+	"github.com/weaviate/weaviate/entities/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	embeddedModelKey = "embeddingModel"
+	// embedBatchSize is the number of texts embedded per request.
+	embedBatchSize = 64
+	// lockTimeout bounds the wait for another process using the file, e.g. the
+	// search command while the daemon writes.
+	lockTimeout = 10 * time.Second
+	bm25K1      = 1.2
+	bm25B       = 0.75
+)
+
+var embeddedMetaBucket = []byte("meta")
+
+// embeddedRecord is an object with the vector of its text. TextHash tells
+// whether the text, or the embedding model, changed since it was embedded.
+type embeddedRecord struct {
+	Properties map[string]interface{} `json:"properties"`
+	Vector     []float32              `json:"vector"`
+	TextHash   string                 `json:"textHash"`
+}
+
+// embeddedStorage keeps the objects and their vectors in a local bbolt file and
+// searches them by brute force, which is fast enough for a personal knowledge
+// base. The file is opened for every operation, so that the commands reading it
+// work while the daemon runs.
+type embeddedStorage struct {
+	path     string
+	embedder llm.Embedder
+	// vectorized are the properties embedded for every class, the ones Weaviate
+	// would vectorize.
+	vectorized map[string][]string
+}
+
+func newEmbeddedStorage(config *config.Config, path string, embedder llm.Embedder) *embeddedStorage {
+	vectorized := map[string][]string{}
+	for _, class := range []*models.Class{babelClass(config), chunkClass(config)} {
+		vectorized[class.Class] = vectorizedProperties(class)
+	}
+	return &embeddedStorage{
+		path:       path,
+		embedder:   embedder,
+		vectorized: vectorized,
+	}
+}
+
+// vectorizedProperties returns the text properties of the class not skipped by
+// its vectorizer.
+func vectorizedProperties(class *models.Class) []string {
+	var properties []string
+	for _, property := range class.Properties {
+		dataType := strings.Join(property.DataType, ",")
+		if dataType != "text" && dataType != "text[]" {
+			continue
+		}
+		if moduleConfig, ok := property.ModuleConfig.(map[string]interface{}); ok {
+			if settings, ok := moduleConfig[class.Vectorizer].(map[string]interface{}); ok && settings["skip"] == true {
+				continue
+			}
+		}
+		properties = append(properties, property.Name)
+	}
+	return properties
+}
+
+// update runs the function in a write transaction of the file.
+func (s *embeddedStorage) update(fn func(tx *bolt.Tx) error) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: lockTimeout})
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", s.path, err)
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+// view runs the function in a read transaction of the file, a missing file is
+// an empty one.
+func (s *embeddedStorage) view(fn func(tx *bolt.Tx) error) error {
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		return nil
+	}
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: lockTimeout, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", s.path, err)
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+// EnsureSchema creates a bucket per class. When the embedding model changed the
+// vectors are computed again as the objects are written, reindex to refresh all
+// of them.
+func (s *embeddedStorage) EnsureSchema(ctx context.Context) error {
+	return s.update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{embeddedMetaBucket, []byte(ClassName), []byte(ChunkClassName)} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(embeddedMetaBucket)
+		previous := string(meta.Get([]byte(embeddedModelKey)))
+		if previous != "" && previous != s.embedder.Model() {
+			log.Printf("Embedding model changed from %s to %s, run reindex to embed every note again\n", previous, s.embedder.Model())
+		}
+		return meta.Put([]byte(embeddedModelKey), []byte(s.embedder.Model()))
+	})
+}
+
+// text returns the text of the object that is embedded.
+func (s *embeddedStorage) text(class string, properties map[string]interface{}) string {
+	var parts []string
+	for _, name := range s.vectorized[class] {
+		switch value := properties[name].(type) {
+		case string:
+			parts = append(parts, value)
+		case []interface{}:
+			for _, item := range value {
+				if text, ok := item.(string); ok {
+					parts = append(parts, text)
+				}
+			}
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func (s *embeddedStorage) textHash(text string) string {
+	sum := sha256.Sum256([]byte(s.embedder.Model() + "\n" + text))
+	return hex.EncodeToString(sum[:])
+}
+
+// Upsert embeds the objects whose text changed and writes them in a single
+// transaction.
+func (s *embeddedStorage) Upsert(ctx context.Context, objects []*models.Object) (map[string]error, error) {
+	if len(objects) == 0 {
+		return nil, nil
+	}
+	failures := map[string]error{}
+	records := make([]*embeddedRecord, len(objects))
+	var texts []string
+	var pending []int
+
+	err := s.view(func(tx *bolt.Tx) error {
+		for i, object := range objects {
+			if _, known := s.vectorized[object.Class]; !known {
+				failures[object.ID.String()] = fmt.Errorf("unknown class %s", object.Class)
+				continue
+			}
+			// A JSON round trip stores the properties as Weaviate returns them.
+			properties := map[string]interface{}{}
+			encoded, err := json.Marshal(object.Properties)
+			if err == nil {
+				err = json.Unmarshal(encoded, &properties)
+			}
+			if err != nil {
+				failures[object.ID.String()] = err
+				continue
+			}
+			text := s.text(object.Class, properties)
+			record := &embeddedRecord{Properties: properties, TextHash: s.textHash(text)}
+			records[i] = record
+
+			if bucket := tx.Bucket([]byte(object.Class)); bucket != nil {
+				var previous embeddedRecord
+				if value := bucket.Get([]byte(object.ID.String())); value != nil && json.Unmarshal(value, &previous) == nil &&
+					previous.TextHash == record.TextHash {
+					record.Vector = previous.Vector
+					continue
+				}
+			}
+			texts = append(texts, text)
+			pending = append(pending, i)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for start := 0; start < len(texts); start += embedBatchSize {
+		end := start + embedBatchSize
+		if end > len(texts) {
+			end = len(texts)
+		}
+		vectors, err := s.embedder.Embed(ctx, texts[start:end])
+		if err != nil {
+			return nil, fmt.Errorf("failed to embed objects: %w", err)
+		}
+		for j, vector := range vectors {
+			records[pending[start+j]].Vector = vector
+		}
+	}
+
+	err = s.update(func(tx *bolt.Tx) error {
+		for i, object := range objects {
+			if records[i] == nil {
+				continue
+			}
+			bucket, err := tx.CreateBucketIfNotExists([]byte(object.Class))
+			if err != nil {
+				return err
+			}
+			value, err := json.Marshal(records[i])
+			if err != nil {
+				failures[object.ID.String()] = err
+				continue
+			}
+			if err := bucket.Put([]byte(object.ID.String()), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return failures, nil
+}
+
+func (s *embeddedStorage) Delete(ctx context.Context, class string, id string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(class))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+func (s *embeddedStorage) DeleteWhere(ctx context.Context, class string, where []Condition) error {
+	return s.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(class))
+		if bucket == nil {
+			return nil
+		}
+		var matched [][]byte
+		err := bucket.ForEach(func(key []byte, value []byte) error {
+			var record embeddedRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return err
+			}
+			if matchesAll(where, record.Properties) {
+				matched = append(matched, append([]byte(nil), key...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Keys are deleted after the iteration, deleting during ForEach skips keys.
+		for _, key := range matched {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *embeddedStorage) List(ctx context.Context, class string, limit int, after string) ([]*models.Object, error) {
+	var objects []*models.Object
+	err := s.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(class))
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		key, value := cursor.First()
+		if after != "" {
+			key, value = cursor.Seek([]byte(after))
+			if key != nil && bytes.Equal(key, []byte(after)) {
+				key, value = cursor.Next()
+			}
+		}
+		for ; key != nil && len(objects) < limit; key, value = cursor.Next() {
+			var record embeddedRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return err
+			}
+			objects = append(objects, &models.Object{
+				Class:      class,
+				ID:         strfmt.UUID(key),
+				Properties: record.Properties,
+			})
+		}
+		return nil
+	})
+	return objects, err
+}
+
+// scoredRecord is a candidate of a search.
+type scoredRecord struct {
+	id      string
+	record  *embeddedRecord
+	vector  float64
+	keyword float64
+	score   float64
+}
+
+// Search ranks the objects by the cosine similarity of their vectors to the
+// vector of the text, fused for hybrid searches with a BM25 keyword ranking the
+// way Weaviate does: both rankings are scaled to [0, 1] and weighted by alpha.
+func (s *embeddedStorage) Search(ctx context.Context, query *SearchQuery) ([]*Hit, error) {
+	alpha := float64(query.Alpha)
+	if query.NearText {
+		alpha = 1
+	}
+
+	var queryVector []float32
+	if alpha > 0 {
+		vectors, err := s.embedder.Embed(ctx, []string{query.Text})
+		if err != nil {
+			return nil, fmt.Errorf("failed to embed the query: %w", err)
+		}
+		queryVector = vectors[0]
+	}
+
+	var candidates []*scoredRecord
+	err := s.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(query.Class))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key []byte, value []byte) error {
+			record := &embeddedRecord{}
+			if err := json.Unmarshal(value, record); err != nil {
+				return err
+			}
+			if matchesAll(query.Where, record.Properties) {
+				candidates = append(candidates, &scoredRecord{id: string(key), record: record})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if queryVector != nil {
+		for _, candidate := range candidates {
+			candidate.vector = cosine(queryVector, candidate.record.Vector)
+		}
+	}
+	if alpha < 1 {
+		s.scoreKeywords(query, candidates)
+	}
+
+	if query.NearText {
+		for _, candidate := range candidates {
+			candidate.score = candidate.vector
+		}
+	} else {
+		vectorMin, vectorMax := scoreRange(candidates, func(c *scoredRecord) float64 { return c.vector })
+		keywordMin, keywordMax := scoreRange(candidates, func(c *scoredRecord) float64 { return c.keyword })
+		var matching []*scoredRecord
+		for _, candidate := range candidates {
+			// Like Weaviate, an object must match the keywords or be embedded
+			// to be found.
+			if candidate.keyword == 0 && (alpha == 0 || candidate.record.Vector == nil) {
+				continue
+			}
+			candidate.score = alpha*scale(candidate.vector, vectorMin, vectorMax) +
+				(1-alpha)*scale(candidate.keyword, keywordMin, keywordMax)
+			matching = append(matching, candidate)
+		}
+		candidates = matching
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].id < candidates[j].id
+	})
+	if query.Limit > 0 && len(candidates) > query.Limit {
+		candidates = candidates[:query.Limit]
+	}
+
+	hits := make([]*Hit, 0, len(candidates))
+	for _, candidate := range candidates {
+		properties := make(map[string]interface{}, len(query.Properties))
+		for _, name := range query.Properties {
+			if value, found := candidate.record.Properties[name]; found {
+				properties[name] = value
+			}
+		}
+		hits = append(hits, &Hit{ID: candidate.id, Score: candidate.score, Properties: properties})
+	}
+	return hits, nil
+}
+
+// scoreKeywords scores the candidates with BM25 over their embedded text.
+func (s *embeddedStorage) scoreKeywords(query *SearchQuery, candidates []*scoredRecord) {
+	terms := tokenize(query.Text)
+	if len(terms) == 0 || len(candidates) == 0 {
+		return
+	}
+
+	frequencies := make([]map[string]int, len(candidates))
+	lengths := make([]int, len(candidates))
+	documents := map[string]int{}
+	total := 0
+	for i, candidate := range candidates {
+		frequencies[i] = map[string]int{}
+		for _, token := range tokenize(s.text(query.Class, candidate.record.Properties)) {
+			frequencies[i][token]++
+			lengths[i]++
+		}
+		total += lengths[i]
+		for _, term := range terms {
+			if frequencies[i][term] > 0 {
+				documents[term]++
+			}
+		}
+	}
+	averageLength := float64(total) / float64(len(candidates))
+	if averageLength == 0 {
+		return
+	}
+
+	for i, candidate := range candidates {
+		for _, term := range terms {
+			frequency := float64(frequencies[i][term])
+			if frequency == 0 {
+				continue
+			}
+			n := float64(documents[term])
+			idf := math.Log(1 + (float64(len(candidates))-n+0.5)/(n+0.5))
+			norm := bm25K1 * (1 - bm25B + bm25B*float64(lengths[i])/averageLength)
+			candidate.keyword += idf * frequency * (bm25K1 + 1) / (frequency + norm)
+		}
+	}
+}
+
+// tokenize splits the text into lower case words, like the word tokenization
+// of Weaviate.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func cosine(a []float32, b []float32) float64 {
+	if len(a) == 0 || len(a) != len(b) {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+func scoreRange(candidates []*scoredRecord, score func(*scoredRecord) float64) (float64, float64) {
+	if len(candidates) == 0 {
+		return 0, 0
+	}
+	low, high := score(candidates[0]), score(candidates[0])
+	for _, candidate := range candidates[1:] {
+		low = math.Min(low, score(candidate))
+		high = math.Max(high, score(candidate))
+	}
+	return low, high
+}
+
+// scale maps the score to [0, 1] within the range of the candidates.
+func scale(score float64, low float64, high float64) float64 {
+	if high == low {
+		if high == 0 {
+			return 0
+		}
+		return 1
+	}
+	return (score - low) / (high - low)
+}
+
+func (s *embeddedStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,27 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// objectNamespace is the UUIDv5 namespace of the object IDs.
+var objectNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("https://github.com/margostino/babel-agent/"+ClassName))
+
+// chunkNamespace is the UUIDv5 namespace of the chunk IDs.
+var chunkNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("https://github.com/margostino/babel-agent/"+ChunkClassName))
+
+// ObjectID returns the ID (a UUIDv5) of the object of a note, derived from its path
+// relative to the repository root. Every write of a note goes to the same
+// object, so writes are idempotent upserts and concurrent runs cannot create
+// duplicates.
+func ObjectID(relativeFilePath string) string {
+	return uuid.NewSHA1(objectNamespace, []byte(relativeFilePath)).String()
+}
+
+// ChunkID returns the ID of a chunk of a note, derived from the path of the note
+// and the position of the chunk.
+func ChunkID(relativeFilePath string, index int) string {
+	return uuid.NewSHA1(chunkNamespace, []byte(fmt.Sprintf("%s#%d", relativeFilePath, index))).String()
+}
@@ -0,0 +1,384 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/google/uuid"
+	"github.com/margostino/babel-agent/internal/config"
+	"github.com/weaviate/weaviate-go-client/v4/weaviate"
+	"github.com/weaviate/weaviate-go-client/v4/weaviate/fault"
+	"github.com/weaviate/weaviate/entities/models"
+)
+
+// ClassName is the class holding one object per note.
+const ClassName = "Babel"
+
+// ChunkClassName is the class holding the passages of the notes, so that
+// retrieval points to a section of a long note.
+const ChunkClassName = "BabelChunk"
+
+// MetaClassName is the class holding the schema object, which records the
+// schema version in Weaviate itself, so that every agent sharing the database
+// sees the migrations another one applied.
+const MetaClassName = "BabelMeta"
+
+// schemaObjectID is the ID of the schema object.
+var schemaObjectID = uuid.NewSHA1(uuid.NameSpaceURL, []byte("https://github.com/margostino/babel-agent/"+MetaClassName+"/schema")).String()
+
+const (
+	defaultOllamaEndpoint = "http://localhost:11434"
+	defaultOllamaEmbedder = "nomic-embed-text"
+	objectPageSize        = 100
+)
+
+// migration upgrades the class from the previous schema version. Migrations must
+// be idempotent, they run again when the agent stops before recording the new
+// version.
+type migration struct {
+	description string
+	apply       func(ctx context.Context, client *weaviate.Client, config *config.Config, class *models.Class) error
+}
+
+// migrations are applied in order, the schema version is the number of applied
+// migrations. New migrations are appended, never reordered or removed.
+var migrations = []migration{
+	{description: "add the metadata and content hash properties", apply: addMissingProperties},
+	{description: "move the objects to IDs derived from their paths", apply: rekeyObjects},
+	{description: "add the chunk class", apply: addChunkClass},
+}
+
+// SchemaVersion is the version of the class the agent writes.
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+// vectorizer returns the Weaviate module that embeds the notes and its class
+// level configuration, matching the configured LLM provider.
+func vectorizer(config *config.Config) (string, map[string]interface{}) {
+	switch config.Llm.Provider {
+	case "ollama":
+		endpoint := config.Llm.BaseUrl
+		if endpoint == "" {
+			endpoint = defaultOllamaEndpoint
+		}
+		model := config.Db.EmbeddingModel
+		if model == "" {
+			model = defaultOllamaEmbedder
+		}
+		return "text2vec-ollama", map[string]interface{}{"apiEndpoint": endpoint, "model": model}
+	default:
+		// Anthropic has no embeddings, its notes are embedded by OpenAI too.
+		moduleConfig := map[string]interface{}{"vectorizeClassName": false}
+		if config.Db.EmbeddingModel != "" {
+			moduleConfig["model"] = config.Db.EmbeddingModel
+		}
+		if config.Llm.Provider == "openai-compatible" && config.Llm.BaseUrl != "" {
+			moduleConfig["baseURL"] = config.Llm.BaseUrl
+		}
+		return "text2vec-openai", moduleConfig
+	}
+}
+
+func textProperty(name string, description string, module string, skip bool) *models.Property {
+	property := &models.Property{
+		Name:         name,
+		Description:  description,
+		DataType:     []string{"text"},
+		Tokenization: models.PropertyTokenizationWord,
+	}
+	if skip {
+		// Identifiers are matched exactly and say nothing about the note.
+		property.Tokenization = models.PropertyTokenizationField
+		property.ModuleConfig = map[string]interface{}{module: map[string]interface{}{"skip": true}}
+	}
+	return property
+}
+
+func intProperty(name string, description string) *models.Property {
+	return &models.Property{
+		Name:        name,
+		Description: description,
+		DataType:    []string{"int"},
+	}
+}
+
+func textArrayProperty(name string, description string) *models.Property {
+	return &models.Property{
+		Name:         name,
+		Description:  description,
+		DataType:     []string{"text[]"},
+		Tokenization: models.PropertyTokenizationWord,
+	}
+}
+
+// babelClass is the latest definition of the class.
+func babelClass(config *config.Config) *models.Class {
+	module, moduleConfig := vectorizer(config)
+	return &models.Class{
+		Class:        ClassName,
+		Description:  "Metadata of the notes in the Babel repository",
+		Vectorizer:   module,
+		ModuleConfig: map[string]interface{}{module: moduleConfig},
+		Properties: []*models.Property{
+			textProperty("path", "Path of the note relative to the repository root", module, true),
+			textProperty("category", "PARA category of the note", module, false),
+			textArrayProperty("tags", "Tags of the note"),
+			textArrayProperty("keywords", "Keywords of the note"),
+			textProperty("summary", "Summary of the note", module, false),
+			textArrayProperty("highlights", "Highlights of the note"),
+			textArrayProperty("references", "References found in the note"),
+			textArrayProperty("related_links", "Links related to the note"),
+			textProperty("content_hash", "Hash of the normalized content the metadata was generated from", module, true),
+		},
+	}
+}
+
+// chunkClass is the latest definition of the chunk class. Offsets are byte
+// offsets of the passage in the note.
+func chunkClass(config *config.Config) *models.Class {
+	module, moduleConfig := vectorizer(config)
+	return &models.Class{
+		Class:        ChunkClassName,
+		Description:  "Passages of the notes in the Babel repository, split at their headings",
+		Vectorizer:   module,
+		ModuleConfig: map[string]interface{}{module: moduleConfig},
+		Properties: []*models.Property{
+			textProperty("path", "Path of the note relative to the repository root", module, true),
+			textProperty("heading", "Headings the passage is under, outermost first", module, false),
+			textProperty("content", "Text of the passage", module, false),
+			intProperty("chunk_index", "Position of the passage in the note"),
+			intProperty("start_offset", "Byte offset of the start of the passage in the note"),
+			intProperty("end_offset", "Byte offset of the end of the passage in the note"),
+			textProperty("content_hash", "Hash of the normalized content of the note the passage was cut from", module, true),
+			{
+				Name:        "parent",
+				Description: "Object of the note",
+				DataType:    []string{ClassName},
+			},
+		},
+	}
+}
+
+// metaClass holds objects that are never searched, so it is not vectorized.
+func metaClass() *models.Class {
+	return &models.Class{
+		Class:       MetaClassName,
+		Description: "State of the Babel classes shared by the agents, e.g. their schema version",
+		Vectorizer:  "none",
+		Properties: []*models.Property{
+			intProperty("schema_version", "Number of migrations applied to the Babel classes"),
+		},
+	}
+}
+
+// getSchemaVersion returns the version recorded in the schema object, 0 when
+// there is none yet.
+func getSchemaVersion(ctx context.Context, client *weaviate.Client) (int, error) {
+	exists, err := client.Schema().ClassExistenceChecker().WithClassName(MetaClassName).Do(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check class %s: %w", MetaClassName, err)
+	}
+	if !exists {
+		return 0, nil
+	}
+
+	objects, err := client.Data().ObjectsGetter().WithClassName(MetaClassName).WithID(schemaObjectID).Do(ctx)
+	var clientErr *fault.WeaviateClientError
+	if errors.As(err, &clientErr) && clientErr.StatusCode == http.StatusNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the schema object: %w", err)
+	}
+	if len(objects) == 0 {
+		return 0, nil
+	}
+	properties, _ := objects[0].Properties.(map[string]interface{})
+	switch version := properties["schema_version"].(type) {
+	case float64:
+		return int(version), nil
+	case int:
+		return version, nil
+	}
+	return 0, fmt.Errorf("the schema object has no schema version")
+}
+
+// putSchemaVersion records the version in the schema object.
+func putSchemaVersion(ctx context.Context, client *weaviate.Client, version int) error {
+	if err := createClass(ctx, client, metaClass()); err != nil {
+		return err
+	}
+	responses, err := client.Batch().ObjectsBatcher().WithObjects(&models.Object{
+		Class:      MetaClassName,
+		ID:         strfmt.UUID(schemaObjectID),
+		Properties: map[string]interface{}{"schema_version": version},
+	}).Do(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save schema version: %w", err)
+	}
+	for _, response := range responses {
+		if response.Result != nil && response.Result.Errors != nil && len(response.Result.Errors.Error) > 0 {
+			return fmt.Errorf("failed to save schema version: %s", response.Result.Errors.Error[0].Message)
+		}
+	}
+	return nil
+}
+
+// createClass creates the class unless it exists.
+func createClass(ctx context.Context, client *weaviate.Client, class *models.Class) error {
+	exists, err := client.Schema().ClassExistenceChecker().WithClassName(class.Class).Do(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check class %s: %w", class.Class, err)
+	}
+	if exists {
+		return nil
+	}
+	if err := client.Schema().ClassCreator().WithClass(class).Do(ctx); err != nil {
+		return fmt.Errorf("failed to create class %s: %w", class.Class, err)
+	}
+	log.Printf("Created class %s\n", class.Class)
+	return nil
+}
+
+// addChunkClass creates the chunk class next to the note class. Existing notes
+// get their chunks on the next reindex.
+func addChunkClass(ctx context.Context, client *weaviate.Client, config *config.Config, class *models.Class) error {
+	return createClass(ctx, client, chunkClass(config))
+}
+
+// addMissingProperties adds the properties of the latest class definition that
+// the existing class lacks. Weaviate cannot change the type of a property, so
+// mismatches are only reported.
+func addMissingProperties(ctx context.Context, client *weaviate.Client, config *config.Config, class *models.Class) error {
+	existing := make(map[string]*models.Property, len(class.Properties))
+	for _, property := range class.Properties {
+		existing[property.Name] = property
+	}
+
+	for _, property := range babelClass(config).Properties {
+		found, ok := existing[property.Name]
+		if !ok {
+			err := client.Schema().PropertyCreator().
+				WithClassName(ClassName).
+				WithProperty(property).
+				Do(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to add property %s: %w", property.Name, err)
+			}
+			log.Printf("Added property %s to class %s\n", property.Name, ClassName)
+			continue
+		}
+		if strings.Join(found.DataType, ",") != strings.Join(property.DataType, ",") {
+			log.Printf("Property %s of class %s is %v instead of %v, delete the class and reindex to change it\n",
+				property.Name, ClassName, found.DataType, property.DataType)
+		}
+	}
+	return nil
+}
+
+// rekeyObjects moves the objects created with random IDs to the ID derived from
+// their path. Duplicates of a path collapse into a single object.
+func rekeyObjects(ctx context.Context, client *weaviate.Client, config *config.Config, class *models.Class) error {
+	after := ""
+	for {
+		getter := client.Data().ObjectsGetter().WithClassName(ClassName).WithLimit(objectPageSize)
+		if after != "" {
+			getter = getter.WithAfter(after)
+		}
+		page, err := getter.Do(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list objects: %w", err)
+		}
+
+		var rekeyed []*models.Object
+		var previousIDs []string
+		for _, object := range page {
+			properties, _ := object.Properties.(map[string]interface{})
+			path, _ := properties["path"].(string)
+			if path == "" || object.ID.String() == ObjectID(path) {
+				continue
+			}
+			rekeyed = append(rekeyed, &models.Object{
+				Class:      ClassName,
+				ID:         strfmt.UUID(ObjectID(path)),
+				Properties: properties,
+			})
+			previousIDs = append(previousIDs, object.ID.String())
+		}
+
+		if len(rekeyed) > 0 {
+			responses, err := client.Batch().ObjectsBatcher().WithObjects(rekeyed...).Do(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to write objects: %w", err)
+			}
+			for _, response := range responses {
+				if response.Result != nil && response.Result.Errors != nil && len(response.Result.Errors.Error) > 0 {
+					return fmt.Errorf("failed to write object %s: %s", response.ID, response.Result.Errors.Error[0].Message)
+				}
+			}
+			for _, id := range previousIDs {
+				if err := client.Data().Deleter().WithClassName(ClassName).WithID(id).Do(ctx); err != nil {
+					return fmt.Errorf("failed to delete object %s: %w", id, err)
+				}
+			}
+			log.Printf("Moved %d objects to IDs derived from their paths\n", len(rekeyed))
+		}
+
+		if len(page) < objectPageSize {
+			return nil
+		}
+		after = page[len(page)-1].ID.String()
+	}
+}
+
+// EnsureSchema creates the classes when they do not exist, or applies the
+// migrations they are missing. The applied version is kept in Weaviate, in the
+// schema object. Without one, a class created by hand starts at version 0.
+func EnsureSchema(ctx context.Context, client *weaviate.Client, config *config.Config) error {
+	exists, err := client.Schema().ClassExistenceChecker().WithClassName(ClassName).Do(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check class %s: %w", ClassName, err)
+	}
+
+	if !exists {
+		for _, class := range []*models.Class{babelClass(config), chunkClass(config)} {
+			if err := createClass(ctx, client, class); err != nil {
+				return err
+			}
+		}
+		log.Printf("Created the schema (version %d)\n", SchemaVersion())
+		return putSchemaVersion(ctx, client, SchemaVersion())
+	}
+
+	version, err := getSchemaVersion(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	class, err := client.Schema().ClassGetter().WithClassName(ClassName).Do(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get class %s: %w", ClassName, err)
+	}
+	if module, _ := vectorizer(config); class.Vectorizer != module {
+		log.Printf("Class %s is vectorized by %s instead of %s, delete the class and reindex to change it\n",
+			ClassName, class.Vectorizer, module)
+	}
+
+	for ; version < SchemaVersion(); version++ {
+		m := migrations[version]
+		log.Printf("Migrating class %s to schema version %d: %s\n", ClassName, version+1, m.description)
+		if err := m.apply(ctx, client, config, class); err != nil {
+			return fmt.Errorf("failed to migrate class %s to schema version %d: %w", ClassName, version+1, err)
+		}
+		if err := putSchemaVersion(ctx, client, version+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/margostino/babel-agent/internal/config"
+	"github.com/margostino/babel-agent/internal/llm"
+	"github.com/weaviate/weaviate/entities/models"
+)
+
+const (
+	// Weaviate keeps the objects in a Weaviate server, which embeds them.
+	Weaviate = "weaviate"
+	// Embedded keeps the objects and their vectors in a local file, embedded
+	// by the LLM provider.
+	Embedded = "embedded"
+)
+
+// Operator compares a text property to the values of a condition.
+type Operator string
+
+const (
+	Equal    Operator = "Equal"
+	NotEqual Operator = "NotEqual"
+	// Like matches a wildcard pattern, e.g. RESOURCES/*, see MatchLike.
+	Like Operator = "Like"
+	// ContainsAny matches text arrays holding any of the values, or texts equal
+	// to any of them.
+	ContainsAny Operator = "ContainsAny"
+)
+
+// Condition is a filter on a text or text array property. A list of conditions
+// matches the objects matching all of them.
+type Condition struct {
+	Property string
+	Operator Operator
+	Values   []string
+}
+
+// SearchQuery ranks the objects of a class by their relevance to the text.
+type SearchQuery struct {
+	Class string
+	Text  string
+	// NearText ranks by vector similarity only, otherwise keyword and vector
+	// rankings are fused, weighted by Alpha from 0 (keywords only) to 1.
+	NearText bool
+	Alpha    float32
+	Limit    int
+	Where    []Condition
+	// Properties are the properties returned with the hits.
+	Properties []string
+}
+
+// Hit is an object matching a search. Score is higher for better matches: the
+// fused score of hybrid searches and the cosine similarity of nearText ones.
+type Hit struct {
+	ID         string
+	Score      float64
+	Properties map[string]interface{}
+}
+
+// Storage keeps the objects of the notes and of their chunks, and searches
+// them. Objects are written under the IDs they are given, replacing the
+// objects with the same IDs.
+type Storage interface {
+	// EnsureSchema creates or migrates whatever the storage needs before objects
+	// are written.
+	EnsureSchema(ctx context.Context) error
+	// Upsert writes the objects and returns the error of every object that
+	// failed, keyed by its ID.
+	Upsert(ctx context.Context, objects []*models.Object) (map[string]error, error)
+	// Delete deletes the object, an object that does not exist is already
+	// deleted.
+	Delete(ctx context.Context, class string, id string) error
+	// DeleteWhere deletes the objects of the class matching the conditions.
+	DeleteWhere(ctx context.Context, class string, where []Condition) error
+	// List returns up to limit objects of the class in ID order, starting after
+	// the given ID when it is not empty.
+	List(ctx context.Context, class string, limit int, after string) ([]*models.Object, error)
+	Search(ctx context.Context, query *SearchQuery) ([]*Hit, error)
+	Close() error
+}
+
+// NewStorage creates the storage of the configured backend.
+func NewStorage(config *config.Config) (Storage, error) {
+	switch config.Db.Backend {
+	case Weaviate, "":
+		return newWeaviateStorage(config), nil
+	case Embedded:
+		embedder, err := llm.NewEmbedder(config)
+		if err != nil {
+			return nil, err
+		}
+		path := config.Db.Path
+		if path == "" {
+			path = filepath.Join(config.Agent.StateDir, "vectors.db")
+		}
+		return newEmbeddedStorage(config, path, embedder), nil
+	default:
+		return nil, fmt.Errorf("unknown database backend %q, use %s or %s", config.Db.Backend, Weaviate, Embedded)
+	}
+}
+
+// matches reports whether the properties match the condition.
+func (c Condition) matches(properties map[string]interface{}) bool {
+	var texts []string
+	switch value := properties[c.Property].(type) {
+	case string:
+		texts = []string{value}
+	case []interface{}:
+		for _, item := range value {
+			if text, ok := item.(string); ok {
+				texts = append(texts, text)
+			}
+		}
+	case []string:
+		texts = value
+	}
+
+	if c.Operator == NotEqual {
+		for _, text := range texts {
+			for _, value := range c.Values {
+				if text == value {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	for _, text := range texts {
+		for _, value := range c.Values {
+			switch c.Operator {
+			case Like:
+				if MatchLike(value, text) {
+					return true
+				}
+			case Equal, ContainsAny:
+				if text == value {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// MatchLike reports whether the text matches the pattern of a Like condition as
+// Weaviate does: * matches any run of characters, / included, and ? matches a
+// single character.
+func MatchLike(pattern string, text string) bool {
+	p, t := []rune(pattern), []rune(text)
+	// star is the position in the pattern after the last *, and next the
+	// position in the text it is retried from when the rest does not match.
+	star, next := -1, 0
+	i, j := 0, 0
+	for j < len(t) {
+		switch {
+		case i < len(p) && p[i] == '*':
+			star, next = i+1, j
+			i++
+		case i < len(p) && (p[i] == '?' || p[i] == t[j]):
+			i++
+			j++
+		case star >= 0:
+			next++
+			i, j = star, next
+		default:
+			return false
+		}
+	}
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+	return i == len(p)
+}
+
+func matchesAll(where []Condition, properties map[string]interface{}) bool {
+	for _, condition := range where {
+		if !condition.matches(properties) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package db
+
+import "testing"
+
+func TestMatchLike(t *testing.T) {
+	tests := []struct {
+		pattern string
+		text    string
+		want    bool
+	}{
+		{pattern: "RESOURCES/*", text: "RESOURCES/go", want: true},
+		{pattern: "RESOURCES/*", text: "RESOURCES/books/go", want: true},
+		{pattern: "RESOURCES/*", text: "RESOURCES", want: false},
+		{pattern: "RESOURCES/*", text: "PROJECTS/RESOURCES/go", want: false},
+		{pattern: "*/go", text: "RESOURCES/books/go", want: true},
+		{pattern: "*books*", text: "RESOURCES/books/go", want: true},
+		{pattern: "RESOURCES/g?", text: "RESOURCES/go", want: true},
+		{pattern: "RESOURCES/g?", text: "RESOURCES/g", want: false},
+		{pattern: "RESOURCES/?o", text: "RESOURCES/ño", want: true},
+		{pattern: "a*b*c", text: "abxbxc", want: true},
+		{pattern: "a*b*c", text: "abxbxcx", want: false},
+		{pattern: "*", text: "", want: true},
+		{pattern: "", text: "go", want: false},
+		{pattern: "[a]", text: "a", want: false},
+	}
+	for _, test := range tests {
+		if got := MatchLike(test.pattern, test.text); got != test.want {
+			t.Errorf("MatchLike(%q, %q) = %v, want %v", test.pattern, test.text, got, test.want)
+		}
+	}
+}
+
+func TestConditionMatches(t *testing.T) {
+	where := []Condition{
+		{Property: "path", Operator: Like, Values: []string{"RESOURCES/*"}},
+		{Property: "tags", Operator: ContainsAny, Values: []string{"go", "rust"}},
+	}
+	tests := []struct {
+		name       string
+		properties map[string]interface{}
+		want       bool
+	}{
+		{name: "note in the folder", properties: map[string]interface{}{"path": "RESOURCES/go", "tags": []interface{}{"go"}}, want: true},
+		{name: "note in a subfolder", properties: map[string]interface{}{"path": "RESOURCES/books/go", "tags": []interface{}{"go"}}, want: true},
+		{name: "note in another folder", properties: map[string]interface{}{"path": "PROJECTS/go", "tags": []interface{}{"go"}}, want: false},
+		{name: "note without the tags", properties: map[string]interface{}{"path": "RESOURCES/books/go", "tags": []string{"zig"}}, want: false},
+		{name: "note without a path", properties: map[string]interface{}{"tags": []string{"go"}}, want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := matchesAll(where, test.properties); got != test.want {
+				t.Errorf("matchesAll() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
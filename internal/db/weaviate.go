@@ -0,0 +1,175 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/margostino/babel-agent/internal/config"
+	"github.com/weaviate/weaviate-go-client/v4/weaviate"
+	"github.com/weaviate/weaviate-go-client/v4/weaviate/fault"
+	"github.com/weaviate/weaviate-go-client/v4/weaviate/filters"
+	"github.com/weaviate/weaviate-go-client/v4/weaviate/graphql"
+	"github.com/weaviate/weaviate/entities/models"
+)
+
+// weaviateStorage keeps the objects in Weaviate, which embeds them with the
+// vectorizer module of the class.
+type weaviateStorage struct {
+	config *config.Config
+	client *weaviate.Client
+}
+
+func newWeaviateStorage(config *config.Config) *weaviateStorage {
+	return &weaviateStorage{
+		config: config,
+		client: NewDBClient(config),
+	}
+}
+
+func (s *weaviateStorage) EnsureSchema(ctx context.Context) error {
+	return EnsureSchema(ctx, s.client, s.config)
+}
+
+func (s *weaviateStorage) Upsert(ctx context.Context, objects []*models.Object) (map[string]error, error) {
+	if len(objects) == 0 {
+		return nil, nil
+	}
+	responses, err := s.client.Batch().ObjectsBatcher().WithObjects(objects...).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	failures := map[string]error{}
+	for _, response := range responses {
+		if response.Result == nil || response.Result.Errors == nil {
+			continue
+		}
+		var messages []string
+		for _, item := range response.Result.Errors.Error {
+			messages = append(messages, item.Message)
+		}
+		failures[response.ID.String()] = errors.New(strings.Join(messages, "; "))
+	}
+	return failures, nil
+}
+
+func (s *weaviateStorage) Delete(ctx context.Context, class string, id string) error {
+	err := s.client.Data().Deleter().
+		WithClassName(class).
+		WithID(id).
+		Do(ctx)
+
+	var clientErr *fault.WeaviateClientError
+	if errors.As(err, &clientErr) && clientErr.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+func (s *weaviateStorage) DeleteWhere(ctx context.Context, class string, where []Condition) error {
+	response, err := s.client.Batch().ObjectsBatchDeleter().
+		WithClassName(class).
+		WithWhere(whereFilter(where)).
+		WithOutput("minimal").
+		Do(ctx)
+	if err != nil {
+		return err
+	}
+	if response.Results != nil && response.Results.Failed > 0 {
+		return fmt.Errorf("%d objects not deleted", response.Results.Failed)
+	}
+	return nil
+}
+
+func (s *weaviateStorage) List(ctx context.Context, class string, limit int, after string) ([]*models.Object, error) {
+	getter := s.client.Data().ObjectsGetter().WithClassName(class).WithLimit(limit)
+	if after != "" {
+		getter = getter.WithAfter(after)
+	}
+	return getter.Do(ctx)
+}
+
+func (s *weaviateStorage) Search(ctx context.Context, query *SearchQuery) ([]*Hit, error) {
+	fields := make([]graphql.Field, 0, len(query.Properties)+1)
+	for _, property := range query.Properties {
+		fields = append(fields, graphql.Field{Name: property})
+	}
+	fields = append(fields, graphql.Field{Name: "_additional{id score distance}"})
+
+	get := s.client.GraphQL().Get().
+		WithClassName(query.Class).
+		WithLimit(query.Limit).
+		WithFields(fields...)
+	if query.NearText {
+		get = get.WithNearText(s.client.GraphQL().NearTextArgBuilder().WithConcepts([]string{query.Text}))
+	} else {
+		get = get.WithHybrid(s.client.GraphQL().HybridArgumentBuilder().WithQuery(query.Text).WithAlpha(query.Alpha))
+	}
+	if len(query.Where) > 0 {
+		get = get.WithWhere(whereFilter(query.Where))
+	}
+
+	response, err := get.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Errors) > 0 {
+		return nil, errors.New(response.Errors[0].Message)
+	}
+
+	data, _ := response.Data["Get"].(map[string]interface{})
+	items, _ := data[query.Class].([]interface{})
+	hits := make([]*Hit, 0, len(items))
+	for _, item := range items {
+		properties, _ := item.(map[string]interface{})
+		additional, _ := properties["_additional"].(map[string]interface{})
+		delete(properties, "_additional")
+		hit := &Hit{Properties: properties}
+		hit.ID, _ = additional["id"].(string)
+		if query.NearText {
+			if distance, ok := numberValue(additional["distance"]); ok {
+				hit.Score = 1 - distance
+			}
+		} else if score, ok := numberValue(additional["score"]); ok {
+			hit.Score = score
+		}
+		hits = append(hits, hit)
+	}
+	return hits, nil
+}
+
+func (s *weaviateStorage) Close() error {
+	return nil
+}
+
+// whereFilter returns the Weaviate filter matching all the conditions.
+func whereFilter(where []Condition) *filters.WhereBuilder {
+	operands := make([]*filters.WhereBuilder, 0, len(where))
+	for _, condition := range where {
+		operands = append(operands, filters.Where().
+			WithPath([]string{condition.Property}).
+			WithOperator(filters.WhereOperator(condition.Operator)).
+			WithValueText(condition.Values...))
+	}
+	if len(operands) == 1 {
+		return operands[0]
+	}
+	return filters.Where().WithOperator(filters.And).WithOperands(operands)
+}
+
+// numberValue reads a number that Weaviate returns either as a JSON number or,
+// for hybrid scores, as a string.
+func numberValue(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case float64:
+		return number, true
+	case string:
+		parsed, err := strconv.ParseFloat(number, 64)
+		return parsed, err == nil
+	}
+	return 0, false
+}
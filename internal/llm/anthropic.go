@@ -0,0 +1,109 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultAnthropicBaseURL = "https://api.anthropic.com"
+	defaultAnthropicModel   = "claude-3-5-sonnet-latest"
+	anthropicMessagesPath   = "/v1/messages"
+	anthropicVersion        = "2023-06-01"
+	anthropicMaxTokens      = 4096
+)
+
+type anthropicRequestBody struct {
+	Model     string    `json:"model"`
+	MaxTokens int       `json:"max_tokens"`
+	System    string    `json:"system,omitempty"`
+	Messages  []Message `json:"messages"`
+}
+
+type anthropicResponse struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+}
+
+// anthropicProvider talks to the Anthropic Messages API.
+type anthropicProvider struct {
+	client  *http.Client
+	baseURL string
+	apiKey  string
+	model   string
+}
+
+func newAnthropicProvider(client *http.Client, baseURL string, apiKey string, model string) *anthropicProvider {
+	return &anthropicProvider{
+		client:  client,
+		baseURL: baseURL,
+		apiKey:  apiKey,
+		model:   model,
+	}
+}
+
+func (p *anthropicProvider) Name() string {
+	return Anthropic
+}
+
+func (p *anthropicProvider) Model() string {
+	return p.model
+}
+
+func (p *anthropicProvider) ChatCompletion(ctx context.Context, request Request) (string, error) {
+	requestBody := anthropicRequestBody{
+		Model:     p.model,
+		MaxTokens: anthropicMaxTokens,
+	}
+
+	// The system prompt is a separate field and consecutive messages of the same
+	// role are merged, as the API expects alternating turns.
+	var system []string
+	for _, message := range request.Messages {
+		if message.Role == "system" {
+			system = append(system, message.Content)
+			continue
+		}
+		last := len(requestBody.Messages) - 1
+		if last >= 0 && requestBody.Messages[last].Role == message.Role {
+			requestBody.Messages[last].Content += "\n\n" + message.Content
+			continue
+		}
+		requestBody.Messages = append(requestBody.Messages, message)
+	}
+	requestBody.System = strings.Join(system, "\n\n")
+
+	// There is no JSON mode, so the answer is prefilled with the opening brace.
+	if request.JSON {
+		requestBody.Messages = append(requestBody.Messages, Message{Role: "assistant", Content: "{"})
+	}
+
+	headers := map[string]string{
+		"x-api-key":         p.apiKey,
+		"anthropic-version": anthropicVersion,
+	}
+
+	var apiResponse anthropicResponse
+	if err := postJSON(ctx, p.client, Anthropic, p.baseURL+anthropicMessagesPath, headers, requestBody, &apiResponse); err != nil {
+		return "", err
+	}
+
+	var text strings.Builder
+	for _, content := range apiResponse.Content {
+		if content.Type == "text" {
+			text.WriteString(content.Text)
+		}
+	}
+	if text.Len() == 0 {
+		return "", fmt.Errorf("No text found in %s response", Anthropic)
+	}
+
+	if request.JSON {
+		return "{" + text.String(), nil
+	}
+	return text.String(), nil
+}
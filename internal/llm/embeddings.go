@@ -0,0 +1,137 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/margostino/babel-agent/internal/config"
+)
+
+const (
+	defaultOpenAIEmbeddingModel = "text-embedding-3-small"
+	defaultOllamaEmbeddingModel = "nomic-embed-text"
+	openAIEmbeddingsPath        = "/embeddings"
+	ollamaEmbedPath             = "/api/embed"
+)
+
+// Embedder turns texts into vectors, for the embedded vector store.
+type Embedder interface {
+	Model() string
+	// Embed returns the vectors of the texts, in the same order.
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// NewEmbedder creates the embedder of the configured provider, using the
+// embedding model of the database configuration. Anthropic has no embeddings,
+// its notes are embedded by OpenAI, like Weaviate does.
+func NewEmbedder(config *config.Config) (Embedder, error) {
+	client := &http.Client{Timeout: config.Llm.Timeout}
+	baseURL := strings.TrimSuffix(config.Llm.BaseUrl, "/")
+	model := config.Db.EmbeddingModel
+
+	switch config.Llm.Provider {
+	case OpenAI:
+		return &openAIEmbedder{name: OpenAI, client: client, baseURL: withDefault(baseURL, defaultOpenAIBaseURL), apiKey: config.Llm.ApiKey, model: withDefault(model, defaultOpenAIEmbeddingModel)}, nil
+	case OpenAICompatible:
+		if baseURL == "" || model == "" {
+			return nil, fmt.Errorf("base URL and embedding model are required to embed with the %s provider", OpenAICompatible)
+		}
+		return &openAIEmbedder{name: OpenAICompatible, client: client, baseURL: baseURL, apiKey: config.Llm.ApiKey, model: model}, nil
+	case Ollama:
+		return &ollamaEmbedder{client: client, baseURL: withDefault(baseURL, defaultOllamaBaseURL), model: withDefault(model, defaultOllamaEmbeddingModel)}, nil
+	case Anthropic:
+		if config.OpenAi.ApiKey == "" {
+			return nil, fmt.Errorf("an OpenAI API key is required to embed the notes with the %s provider", Anthropic)
+		}
+		return &openAIEmbedder{name: OpenAI, client: client, baseURL: defaultOpenAIBaseURL, apiKey: config.OpenAi.ApiKey, model: withDefault(model, defaultOpenAIEmbeddingModel)}, nil
+	default:
+		return nil, fmt.Errorf("unknown LLM provider %q", config.Llm.Provider)
+	}
+}
+
+type openAIEmbeddingsRequestBody struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type openAIEmbeddingsResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}
+
+// openAIEmbedder talks to the OpenAI embeddings API and to any server
+// implementing the same API under another base URL.
+type openAIEmbedder struct {
+	name    string
+	client  *http.Client
+	baseURL string
+	apiKey  string
+	model   string
+}
+
+func (e *openAIEmbedder) Model() string {
+	return e.model
+}
+
+func (e *openAIEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	headers := map[string]string{}
+	if e.apiKey != "" {
+		headers["Authorization"] = "Bearer " + e.apiKey
+	}
+
+	var apiResponse openAIEmbeddingsResponse
+	requestBody := openAIEmbeddingsRequestBody{Model: e.model, Input: texts}
+	if err := postJSON(ctx, e.client, e.name, e.baseURL+openAIEmbeddingsPath, headers, requestBody, &apiResponse); err != nil {
+		return nil, err
+	}
+
+	vectors := make([][]float32, len(texts))
+	for _, item := range apiResponse.Data {
+		if item.Index < 0 || item.Index >= len(vectors) {
+			return nil, fmt.Errorf("%s embedding index %d out of range", e.name, item.Index)
+		}
+		vectors[item.Index] = item.Embedding
+	}
+	for i, vector := range vectors {
+		if vector == nil {
+			return nil, fmt.Errorf("No embedding found for input %d in %s response", i, e.name)
+		}
+	}
+	return vectors, nil
+}
+
+type ollamaEmbedRequestBody struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type ollamaEmbedResponse struct {
+	Embeddings [][]float32 `json:"embeddings"`
+}
+
+// ollamaEmbedder talks to the native embed API of a local Ollama server.
+type ollamaEmbedder struct {
+	client  *http.Client
+	baseURL string
+	model   string
+}
+
+func (e *ollamaEmbedder) Model() string {
+	return e.model
+}
+
+func (e *ollamaEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	var apiResponse ollamaEmbedResponse
+	requestBody := ollamaEmbedRequestBody{Model: e.model, Input: texts}
+	if err := postJSON(ctx, e.client, Ollama, e.baseURL+ollamaEmbedPath, nil, requestBody, &apiResponse); err != nil {
+		return nil, err
+	}
+	if len(apiResponse.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("%s returned %d embeddings for %d inputs", Ollama, len(apiResponse.Embeddings), len(texts))
+	}
+	return apiResponse.Embeddings, nil
+}
@@ -0,0 +1,45 @@
+package llm
+
+import (
+	"context"
+)
+
+const (
+	// charsPerToken approximates the characters of a token.
+	charsPerToken = 4
+	// responseTokens approximates the tokens of an answer.
+	responseTokens = 500
+)
+
+// Limiter blocks until a request consuming the given tokens is allowed.
+type Limiter interface {
+	Wait(ctx context.Context, tokens int) error
+}
+
+type limitedProvider struct {
+	Provider
+	limiter Limiter
+}
+
+// Limit returns the provider waiting on the limiter before every request, so
+// that the requests of a single job (chunks, reduce, repairs) are all
+// accounted for.
+func Limit(provider Provider, limiter Limiter) Provider {
+	return &limitedProvider{Provider: provider, limiter: limiter}
+}
+
+func (p *limitedProvider) ChatCompletion(ctx context.Context, request Request) (string, error) {
+	if err := p.limiter.Wait(ctx, estimateTokens(request)); err != nil {
+		return "", err
+	}
+	return p.Provider.ChatCompletion(ctx, request)
+}
+
+// estimateTokens roughly estimates the tokens of the request and its answer.
+func estimateTokens(request Request) int {
+	chars := 0
+	for _, message := range request.Messages {
+		chars += len(message.Content)
+	}
+	return (chars+charsPerToken-1)/charsPerToken + responseTokens
+}
@@ -0,0 +1,133 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/margostino/babel-agent/internal/config"
+)
+
+const (
+	OpenAI           = "openai"
+	OpenAICompatible = "openai-compatible"
+	Ollama           = "ollama"
+	Anthropic        = "anthropic"
+)
+
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type Request struct {
+	Messages []Message
+	// JSON asks the model to answer with a single JSON object.
+	JSON bool
+}
+
+// Provider is a chat model backend.
+type Provider interface {
+	Name() string
+	Model() string
+	ChatCompletion(ctx context.Context, request Request) (string, error)
+}
+
+// ApiError is returned when the API answers with a non successful status.
+type ApiError struct {
+	Provider   string
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *ApiError) Error() string {
+	if e.Body != "" {
+		return fmt.Sprintf("%s request failed with status: %s (%s)", e.Provider, e.Status, e.Body)
+	}
+	return fmt.Sprintf("%s request failed with status: %s", e.Provider, e.Status)
+}
+
+// NewProvider creates the provider chosen in the configuration.
+func NewProvider(config *config.Config) (Provider, error) {
+	client := &http.Client{Timeout: config.Llm.Timeout}
+	baseURL := strings.TrimSuffix(config.Llm.BaseUrl, "/")
+	model := config.Llm.Model
+
+	switch config.Llm.Provider {
+	case OpenAI:
+		return newOpenAIProvider(OpenAI, client, withDefault(baseURL, defaultOpenAIBaseURL), config.Llm.ApiKey, withDefault(model, defaultOpenAIModel)), nil
+	case OpenAICompatible:
+		if baseURL == "" || model == "" {
+			return nil, fmt.Errorf("base URL and model are required by the %s provider", OpenAICompatible)
+		}
+		return newOpenAIProvider(OpenAICompatible, client, baseURL, config.Llm.ApiKey, model), nil
+	case Ollama:
+		return newOllamaProvider(client, withDefault(baseURL, defaultOllamaBaseURL), withDefault(model, defaultOllamaModel)), nil
+	case Anthropic:
+		return newAnthropicProvider(client, withDefault(baseURL, defaultAnthropicBaseURL), config.Llm.ApiKey, withDefault(model, defaultAnthropicModel)), nil
+	default:
+		return nil, fmt.Errorf("unknown LLM provider %q", config.Llm.Provider)
+	}
+}
+
+func withDefault(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// postJSON sends the body as JSON and decodes the JSON response into result.
+func postJSON(ctx context.Context, client *http.Client, provider string, url string, headers map[string]string, body interface{}, result interface{}) error {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s request body: %w", provider, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create %s request: %w", provider, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send %s request: %w", provider, err)
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read %s response body: %w", provider, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return &ApiError{
+			Provider:   provider,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       truncate(string(responseBody), 200),
+		}
+	}
+
+	if err := json.Unmarshal(responseBody, result); err != nil {
+		return fmt.Errorf("failed to unmarshal %s response body: %w", provider, err)
+	}
+	return nil
+}
+
+func truncate(value string, length int) string {
+	value = strings.TrimSpace(value)
+	if len(value) <= length {
+		return value
+	}
+	return value[:length] + "..."
+}
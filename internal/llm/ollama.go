@@ -0,0 +1,63 @@
+package llm
+
+import (
+	"context"
+	"net/http"
+)
+
+const (
+	defaultOllamaBaseURL = "http://localhost:11434"
+	defaultOllamaModel   = "llama3.1"
+	ollamaChatPath       = "/api/chat"
+)
+
+type ollamaRequestBody struct {
+	Model    string    `json:"model"`
+	Messages []Message `json:"messages"`
+	Stream   bool      `json:"stream"`
+	Format   string    `json:"format,omitempty"`
+}
+
+type ollamaResponse struct {
+	Message Message `json:"message"`
+}
+
+// ollamaProvider talks to the native API of a local Ollama server.
+type ollamaProvider struct {
+	client  *http.Client
+	baseURL string
+	model   string
+}
+
+func newOllamaProvider(client *http.Client, baseURL string, model string) *ollamaProvider {
+	return &ollamaProvider{
+		client:  client,
+		baseURL: baseURL,
+		model:   model,
+	}
+}
+
+func (p *ollamaProvider) Name() string {
+	return Ollama
+}
+
+func (p *ollamaProvider) Model() string {
+	return p.model
+}
+
+func (p *ollamaProvider) ChatCompletion(ctx context.Context, request Request) (string, error) {
+	requestBody := ollamaRequestBody{
+		Model:    p.model,
+		Messages: request.Messages,
+	}
+	if request.JSON {
+		requestBody.Format = "json"
+	}
+
+	var apiResponse ollamaResponse
+	if err := postJSON(ctx, p.client, Ollama, p.baseURL+ollamaChatPath, nil, requestBody, &apiResponse); err != nil {
+		return "", err
+	}
+
+	return apiResponse.Message.Content, nil
+}
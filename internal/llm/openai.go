@@ -0,0 +1,94 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+const (
+	defaultOpenAIBaseURL = "https://api.openai.com/v1"
+	defaultOpenAIModel   = "gpt-4o"
+	chatCompletionPath   = "/chat/completions"
+)
+
+type responseFormatType string
+
+const (
+	jsonObject responseFormatType = "json_object"
+)
+
+type responseFormat struct {
+	Type responseFormatType `json:"type"`
+}
+
+type openAIRequestBody struct {
+	Model          string          `json:"model"`
+	Messages       []Message       `json:"messages"`
+	ResponseFormat *responseFormat `json:"response_format,omitempty"`
+}
+
+type openAIChoice struct {
+	Message struct {
+		Role    string `json:"role"`
+		Content string `json:"content"`
+	} `json:"message"`
+}
+
+type openAIResponse struct {
+	Choices []openAIChoice `json:"choices"`
+}
+
+// openAIProvider talks to the OpenAI chat completions API and to any server
+// implementing the same API under another base URL.
+type openAIProvider struct {
+	name    string
+	client  *http.Client
+	baseURL string
+	apiKey  string
+	model   string
+}
+
+func newOpenAIProvider(name string, client *http.Client, baseURL string, apiKey string, model string) *openAIProvider {
+	return &openAIProvider{
+		name:    name,
+		client:  client,
+		baseURL: baseURL,
+		apiKey:  apiKey,
+		model:   model,
+	}
+}
+
+func (p *openAIProvider) Name() string {
+	return p.name
+}
+
+func (p *openAIProvider) Model() string {
+	return p.model
+}
+
+func (p *openAIProvider) ChatCompletion(ctx context.Context, request Request) (string, error) {
+	requestBody := openAIRequestBody{
+		Model:    p.model,
+		Messages: request.Messages,
+	}
+	if request.JSON {
+		requestBody.ResponseFormat = &responseFormat{Type: jsonObject}
+	}
+
+	headers := map[string]string{}
+	if p.apiKey != "" {
+		headers["Authorization"] = "Bearer " + p.apiKey
+	}
+
+	var apiResponse openAIResponse
+	if err := postJSON(ctx, p.client, p.name, p.baseURL+chatCompletionPath, headers, requestBody, &apiResponse); err != nil {
+		return "", err
+	}
+
+	if len(apiResponse.Choices) == 0 {
+		return "", fmt.Errorf("No choices found in %s response", p.name)
+	}
+
+	return apiResponse.Choices[0].Message.Content, nil
+}
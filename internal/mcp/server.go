@@ -0,0 +1,246 @@
+// Package mcp serves the notes to AI assistants over the Model Context
+// Protocol, on stdio or on a local HTTP endpoint.
+package mcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/margostino/babel-agent/internal/config"
+	"github.com/margostino/babel-agent/internal/db"
+	"github.com/margostino/babel-agent/internal/utils"
+	"github.com/margostino/babel-agent/internal/version"
+)
+
+const (
+	serverName      = "babel-agent"
+	instructions    = "Tools over a personal knowledge base of notes organised in PARA folders (0-INBOX, PROJECTS, AREAS, RESOURCES, A-ARCHIVES). Search first, then read the notes found."
+	maxMessageSize  = 4 << 20
+	shutdownTimeout = 5 * time.Second
+)
+
+type Server struct {
+	config  *config.Config
+	storage db.Storage
+	tools   []*tool
+}
+
+func NewServer(config *config.Config, storage db.Storage) *Server {
+	s := &Server{
+		config:  config,
+		storage: storage,
+	}
+	s.tools = s.newTools()
+	return s
+}
+
+// Handle answers a JSON-RPC message. It returns nil for notifications.
+func (s *Server) Handle(ctx context.Context, message []byte) []byte {
+	var req request
+	if err := json.Unmarshal(message, &req); err != nil {
+		return encode(&response{JSONRPC: jsonrpcVersion, ID: json.RawMessage("null"), Error: &rpcError{Code: parseError, Message: err.Error()}})
+	}
+	if req.JSONRPC != jsonrpcVersion || req.Method == "" {
+		if req.isNotification() {
+			return nil
+		}
+		return encode(&response{JSONRPC: jsonrpcVersion, ID: req.ID, Error: &rpcError{Code: invalidRequest, Message: "invalid JSON-RPC 2.0 request"}})
+	}
+
+	result, err := s.dispatch(ctx, &req)
+	if req.isNotification() {
+		return nil
+	}
+	resp := &response{JSONRPC: jsonrpcVersion, ID: req.ID, Result: result}
+	if err != nil {
+		var rpcErr *rpcError
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &rpcError{Code: internalError, Message: err.Error()}
+		}
+		resp.Result, resp.Error = nil, rpcErr
+	}
+	return encode(resp)
+}
+
+func encode(resp *response) []byte {
+	message, err := json.Marshal(resp)
+	if err != nil {
+		message, _ = json.Marshal(&response{JSONRPC: jsonrpcVersion, ID: resp.ID, Error: &rpcError{Code: internalError, Message: err.Error()}})
+	}
+	return message
+}
+
+func (s *Server) dispatch(ctx context.Context, req *request) (interface{}, error) {
+	switch req.Method {
+	case "initialize":
+		var params initializeParams
+		if err := unmarshalParams(req.Params, &params); err != nil {
+			return nil, err
+		}
+		protocolVersion := params.ProtocolVersion
+		if _, found := protocolVersions[protocolVersion]; !found {
+			protocolVersion = latestProtocolVersion
+		}
+		log.Printf("MCP client %s %s connected (protocol %s)\n", params.ClientInfo.Name, params.ClientInfo.Version, protocolVersion)
+		return &initializeResult{
+			ProtocolVersion: protocolVersion,
+			Capabilities:    map[string]interface{}{"tools": map[string]interface{}{}},
+			ServerInfo:      serverInfo{Name: serverName, Version: version.Version},
+			Instructions:    instructions,
+		}, nil
+	case "ping":
+		return struct{}{}, nil
+	case "tools/list":
+		tools := make([]Tool, 0, len(s.tools))
+		for _, tool := range s.tools {
+			tools = append(tools, tool.Tool)
+		}
+		return &listToolsResult{Tools: tools}, nil
+	case "tools/call":
+		var params callToolParams
+		if err := unmarshalParams(req.Params, &params); err != nil {
+			return nil, err
+		}
+		tool := s.tool(params.Name)
+		if tool == nil {
+			return nil, &rpcError{Code: invalidParams, Message: fmt.Sprintf("unknown tool %q", params.Name)}
+		}
+		arguments := params.Arguments
+		if len(arguments) == 0 || string(arguments) == "null" {
+			arguments = json.RawMessage("{}")
+		}
+		result, err := tool.call(ctx, arguments)
+		if err != nil {
+			log.Printf("MCP tool %s failed: %v\n", params.Name, err)
+			return errorResult(err), nil
+		}
+		return result, nil
+	}
+	if strings.HasPrefix(req.Method, "notifications/") {
+		return nil, nil
+	}
+	return nil, &rpcError{Code: methodNotFound, Message: fmt.Sprintf("method %q not found", req.Method)}
+}
+
+func (s *Server) tool(name string) *tool {
+	for _, tool := range s.tools {
+		if tool.Name == name {
+			return tool
+		}
+	}
+	return nil
+}
+
+func unmarshalParams(params json.RawMessage, value interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(params, value); err != nil {
+		return &rpcError{Code: invalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+// ServeStdio reads newline delimited messages from in and writes the answers to
+// out, until in is closed or the context is done.
+func (s *Server) ServeStdio(ctx context.Context, in io.Reader, out io.Writer) error {
+	lines := make(chan []byte)
+	scanErr := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(in)
+		scanner.Buffer(make([]byte, 64*1024), maxMessageSize)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			select {
+			case lines <- append([]byte(nil), line...):
+			case <-ctx.Done():
+				return
+			}
+		}
+		scanErr <- scanner.Err()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-scanErr:
+			return err
+		case line := <-lines:
+			if answer := s.Handle(ctx, line); answer != nil {
+				if _, err := out.Write(append(answer, '\n')); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// Handler serves the streamable HTTP transport on a single endpoint. Every
+// answer is a plain JSON response, the server never streams.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mcp", s.handleHTTP)
+	return mux
+}
+
+func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	// Browsers send an Origin, refusing foreign ones protects against DNS
+	// rebinding attacks on the local server.
+	if origin := r.Header.Get("Origin"); origin != "" && !utils.IsLocalOrigin(origin) {
+		http.Error(w, "forbidden origin", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	message, err := io.ReadAll(io.LimitReader(r.Body, maxMessageSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	answer := s.Handle(r.Context(), message)
+	if answer == nil {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(answer)
+}
+
+// ServeHTTP serves the HTTP transport on the address until the context is done.
+func (s *Server) ServeHTTP(ctx context.Context, address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+	server := &http.Server{Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Serving MCP on http://%s/mcp\n", listener.Addr())
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/margostino/babel-agent/internal/search"
+	"github.com/margostino/babel-agent/internal/tools"
+)
+
+const (
+	defaultRecentChanges = 10
+	maxRecentChanges     = 100
+)
+
+// tool is a tool with the function running it. Arguments are the JSON object
+// sent by the client.
+type tool struct {
+	Tool
+	call func(ctx context.Context, arguments json.RawMessage) (*callToolResult, error)
+}
+
+func objectSchema(required []string, properties map[string]interface{}) map[string]interface{} {
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func property(kind string, description string) map[string]interface{} {
+	return map[string]interface{}{"type": kind, "description": description}
+}
+
+var pathProperty = property("string", "Path of the note relative to the repository root, e.g. RESOURCES/go/concurrency")
+
+func decodeArguments(arguments json.RawMessage, value interface{}) error {
+	if err := json.Unmarshal(arguments, value); err != nil {
+		return fmt.Errorf("invalid arguments: %w", err)
+	}
+	return nil
+}
+
+func jsonResult(value interface{}) (*callToolResult, error) {
+	text, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return textResult(string(text)), nil
+}
+
+func (s *Server) newTools() []*tool {
+	return []*tool{
+		{
+			Tool: Tool{
+				Name:        "search_notes",
+				Description: "Search the notes by meaning and keywords. Returns the best matching notes with their path, score, category, summary, tags and highlights, or with chunks the best matching passages with their path, heading, content and byte offsets.",
+				InputSchema: objectSchema([]string{"query"}, map[string]interface{}{
+					"query":    property("string", "What to look for"),
+					"mode":     map[string]interface{}{"type": "string", "enum": []string{string(search.Hybrid), string(search.NearText)}, "description": "hybrid (keywords and meaning, default) or neartext (meaning only)"},
+					"limit":    property("integer", "Maximum number of notes, 10 by default"),
+					"category": property("string", "Only notes of this category, e.g. Resources"),
+					"tags":     map[string]interface{}{"type": "array", "items": map[string]string{"type": "string"}, "description": "Only notes with any of these tags"},
+					"folder":   property("string", "Only notes under this folder, e.g. PROJECTS/babel"),
+					"chunks":   property("boolean", "Return the matching passages of the notes instead of whole notes"),
+				}),
+			},
+			call: s.searchNotes,
+		},
+		{
+			Tool: Tool{
+				Name:        "get_note",
+				Description: "Read the full content of a note.",
+				InputSchema: objectSchema([]string{"path"}, map[string]interface{}{"path": pathProperty}),
+			},
+			call: s.getNote,
+		},
+		{
+			Tool: Tool{
+				Name:        "get_metadata",
+				Description: "Get the generated metadata of a note: category, tags, keywords, summary, highlights, references and related links.",
+				InputSchema: objectSchema([]string{"path"}, map[string]interface{}{"path": pathProperty}),
+			},
+			call: s.getMetadata,
+		},
+		{
+			Tool: Tool{
+				Name:        "list_recent_changes",
+				Description: "List the last commits of the notes repository, newest first, with the notes each one changed.",
+				InputSchema: objectSchema(nil, map[string]interface{}{
+					"limit": property("integer", fmt.Sprintf("Number of commits, %d by default", defaultRecentChanges)),
+				}),
+			},
+			call: s.listRecentChanges,
+		},
+		{
+			Tool: Tool{
+				Name:        "add_inbox_note",
+				Description: "Capture a new note in the inbox (0-INBOX). The agent commits and enriches it on its next sync. Returns the path of the note.",
+				InputSchema: objectSchema([]string{"title", "content"}, map[string]interface{}{
+					"title":   property("string", "Title of the note, also used for its file name"),
+					"content": property("string", "Body of the note in Markdown"),
+				}),
+			},
+			call: s.addInboxNote,
+		},
+	}
+}
+
+func (s *Server) searchNotes(ctx context.Context, arguments json.RawMessage) (*callToolResult, error) {
+	var args struct {
+		Query    string   `json:"query"`
+		Mode     string   `json:"mode"`
+		Limit    int      `json:"limit"`
+		Category string   `json:"category"`
+		Tags     []string `json:"tags"`
+		Folder   string   `json:"folder"`
+		Chunks   bool     `json:"chunks"`
+	}
+	if err := decodeArguments(arguments, &args); err != nil {
+		return nil, err
+	}
+	if args.Query == "" {
+		return nil, errors.New("query is required")
+	}
+	mode := search.Hybrid
+	if args.Mode != "" {
+		var err error
+		if mode, err = search.ParseMode(args.Mode); err != nil {
+			return nil, err
+		}
+	}
+
+	query := &search.Query{
+		Text:     args.Query,
+		Mode:     mode,
+		Alpha:    0.5,
+		Limit:    args.Limit,
+		Category: args.Category,
+		Tags:     args.Tags,
+		Folder:   args.Folder,
+	}
+	if args.Chunks {
+		chunks, err := search.SearchChunks(ctx, s.storage, query)
+		if err != nil {
+			return nil, err
+		}
+		return jsonResult(chunks)
+	}
+	results, err := search.Search(ctx, s.storage, query)
+	if err != nil {
+		return nil, err
+	}
+	return jsonResult(results)
+}
+
+func (s *Server) getNote(ctx context.Context, arguments json.RawMessage) (*callToolResult, error) {
+	var args struct {
+		Path string `json:"path"`
+	}
+	if err := decodeArguments(arguments, &args); err != nil {
+		return nil, err
+	}
+	content, err := tools.ReadNote(s.config, args.Path)
+	if err != nil {
+		return nil, err
+	}
+	return textResult(string(content)), nil
+}
+
+func (s *Server) getMetadata(ctx context.Context, arguments json.RawMessage) (*callToolResult, error) {
+	var args struct {
+		Path string `json:"path"`
+	}
+	if err := decodeArguments(arguments, &args); err != nil {
+		return nil, err
+	}
+	if args.Path == "" || !filepath.IsLocal(args.Path) {
+		return nil, errors.New("path must be relative to the repository root")
+	}
+	data, err := tools.ReadMetadata(s.config, filepath.ToSlash(filepath.Clean(args.Path)))
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("no metadata for %s", args.Path)
+	}
+	return jsonResult(data)
+}
+
+func (s *Server) listRecentChanges(ctx context.Context, arguments json.RawMessage) (*callToolResult, error) {
+	var args struct {
+		Limit int `json:"limit"`
+	}
+	if err := decodeArguments(arguments, &args); err != nil {
+		return nil, err
+	}
+	if args.Limit <= 0 {
+		args.Limit = defaultRecentChanges
+	}
+	if args.Limit > maxRecentChanges {
+		args.Limit = maxRecentChanges
+	}
+	commits, err := tools.RecentChanges(s.config, args.Limit)
+	if err != nil {
+		return nil, err
+	}
+	return jsonResult(commits)
+}
+
+func (s *Server) addInboxNote(ctx context.Context, arguments json.RawMessage) (*callToolResult, error) {
+	var args struct {
+		Title   string `json:"title"`
+		Content string `json:"content"`
+	}
+	if err := decodeArguments(arguments, &args); err != nil {
+		return nil, err
+	}
+	path, err := tools.AddInboxNote(s.config, args.Title, args.Content)
+	if err != nil {
+		return nil, err
+	}
+	return textResult(fmt.Sprintf("Added %s, it is committed on the next sync", path)), nil
+}
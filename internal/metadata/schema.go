@@ -0,0 +1,272 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/margostino/babel-agent/prompts"
+)
+
+const schemaFile = "metadata_schema.json"
+
+// Schema is the JSON Schema that the metadata generated for a note must follow.
+// Only the keywords used by the schema are enforced: type, required,
+// properties, additionalProperties (false), enum, items and minLength.
+type Schema struct {
+	Version int
+	raw     []byte
+	root    map[string]interface{}
+}
+
+func LoadSchema() (*Schema, error) {
+	file, err := prompts.GetEmbeddedPrompt().Open(schemaFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open embedded schema file: %w", err)
+	}
+	defer file.Close()
+
+	raw, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read embedded schema file: %w", err)
+	}
+
+	var root map[string]interface{}
+	if err := json.Unmarshal(raw, &root); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal schema file: %w", err)
+	}
+
+	version, ok := root["version"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("Version not found in %s", schemaFile)
+	}
+
+	return &Schema{Version: int(version), raw: raw, root: root}, nil
+}
+
+// String returns the schema as JSON.
+func (s *Schema) String() string {
+	return string(s.raw)
+}
+
+// Categories returns the allowed categories.
+func (s *Schema) Categories() []string {
+	properties, _ := s.root["properties"].(map[string]interface{})
+	category, _ := properties["category"].(map[string]interface{})
+	enum, _ := category["enum"].([]interface{})
+	categories := make([]string, 0, len(enum))
+	for _, value := range enum {
+		categories = append(categories, fmt.Sprint(value))
+	}
+	return categories
+}
+
+// Validate returns the violations of the schema, or none when the value is valid.
+func (s *Schema) Validate(value interface{}) []string {
+	return validate(s.root, value, "$")
+}
+
+func validate(schema map[string]interface{}, value interface{}, path string) []string {
+	var violations []string
+
+	if expected, ok := schema["type"].(string); ok && !hasType(value, expected) {
+		return []string{fmt.Sprintf("%s must be of type %s, got %s", path, expected, typeOf(value))}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if allowed == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			violations = append(violations, fmt.Sprintf("%s must be one of %v, got %v", path, enum, value))
+		}
+	}
+
+	if minLength, ok := schema["minLength"].(float64); ok {
+		if text, ok := value.(string); ok && len(strings.TrimSpace(text)) < int(minLength) {
+			violations = append(violations, fmt.Sprintf("%s must have at least %d characters", path, int(minLength)))
+		}
+	}
+
+	if object, ok := value.(map[string]interface{}); ok {
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, key := range required {
+				if _, found := object[fmt.Sprint(key)]; !found {
+					violations = append(violations, fmt.Sprintf("%s.%v is required", path, key))
+				}
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+			keys := make([]string, 0, len(object))
+			for key := range object {
+				if _, found := properties[key]; !found {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				violations = append(violations, fmt.Sprintf("%s.%s is not allowed", path, key))
+			}
+		}
+		if properties != nil {
+			keys := make([]string, 0, len(properties))
+			for key := range properties {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				property, _ := properties[key].(map[string]interface{})
+				if propertyValue, found := object[key]; found && property != nil {
+					violations = append(violations, validate(property, propertyValue, path+"."+key)...)
+				}
+			}
+		}
+	}
+
+	if array, ok := value.([]interface{}); ok {
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range array {
+				violations = append(violations, validate(items, item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	}
+
+	return violations
+}
+
+func hasType(value interface{}, expected string) bool {
+	switch expected {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		number, ok := value.(float64)
+		return ok && number == float64(int64(number))
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return true
+}
+
+func typeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// folderCategories maps the PARA folders to their category.
+var folderCategories = map[string]string{
+	"0-INBOX":    "Inbox",
+	"AREAS":      "Areas",
+	"PROJECTS":   "Projects",
+	"RESOURCES":  "Resources",
+	"A-ARCHIVES": "Archive",
+}
+
+// CategoryFolder returns the PARA folder of the notes of the category.
+func CategoryFolder(category string) string {
+	for folder, folderCategory := range folderCategories {
+		if folderCategory == category {
+			return folder
+		}
+	}
+	return ""
+}
+
+// Locate sets the path of the metadata to the note it describes and its
+// category to the one of the PARA folder of the note. Metadata generated for
+// the same content under another path, reused from the cache, or describing a
+// note moved since, keeps neither from the note it was generated for.
+func Locate(data map[string]interface{}, relativeFilePath string) {
+	data["path"] = relativeFilePath
+	folder := strings.SplitN(relativeFilePath, "/", 2)[0]
+	if category, found := folderCategories[folder]; found {
+		data["category"] = category
+	}
+}
+
+var listSeparator = regexp.MustCompile(`\s*[,;\n]\s*`)
+
+// Repair fixes the violations that have an obvious fix without asking the model
+// again: a missing path, a category in another case or derived from the PARA
+// folder of the path, lists given as a single string or missing lists.
+// Properties the schema does not allow are left for the model to repair, they
+// may hold what it failed to put in the right property.
+func (s *Schema) Repair(data map[string]interface{}, relativeFilePath string) {
+	properties, _ := s.root["properties"].(map[string]interface{})
+	if path, ok := data["path"].(string); !ok || strings.TrimSpace(path) == "" {
+		data["path"] = relativeFilePath
+	}
+
+	category, _ := data["category"].(string)
+	repairedCategory := ""
+	for _, allowed := range s.Categories() {
+		if strings.EqualFold(strings.TrimSpace(category), allowed) {
+			repairedCategory = allowed
+		}
+	}
+	if repairedCategory == "" {
+		folder := strings.SplitN(relativeFilePath, "/", 2)[0]
+		repairedCategory = folderCategories[folder]
+	}
+	if repairedCategory != "" {
+		data["category"] = repairedCategory
+	}
+
+	for key, property := range properties {
+		property, _ := property.(map[string]interface{})
+		if property["type"] != "array" {
+			continue
+		}
+		switch value := data[key].(type) {
+		case nil:
+			data[key] = []interface{}{}
+		case string:
+			var items []interface{}
+			for _, item := range listSeparator.Split(value, -1) {
+				if item != "" {
+					items = append(items, item)
+				}
+			}
+			data[key] = append([]interface{}{}, items...)
+		case []interface{}:
+			for i, item := range value {
+				if _, ok := item.(string); !ok && item != nil {
+					value[i] = fmt.Sprint(item)
+				}
+			}
+		}
+	}
+}
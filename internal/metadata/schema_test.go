@@ -0,0 +1,175 @@
+package metadata
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// validMetadata returns metadata following the schema.
+func validMetadata() map[string]interface{} {
+	return map[string]interface{}{
+		"category":      "Resources",
+		"path":          "RESOURCES/go",
+		"tags":          []interface{}{"go"},
+		"keywords":      []interface{}{"channels"},
+		"summary":       "Notes about Go",
+		"highlights":    []interface{}{},
+		"references":    []interface{}{},
+		"related_links": []interface{}{},
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	schema, err := LoadSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		change func(data map[string]interface{})
+		want   []string
+	}{
+		{name: "valid", change: func(data map[string]interface{}) {}},
+		{
+			name:   "missing property",
+			change: func(data map[string]interface{}) { delete(data, "summary") },
+			want:   []string{"$.summary is required"},
+		},
+		{
+			name:   "wrong type",
+			change: func(data map[string]interface{}) { data["tags"] = "go" },
+			want:   []string{"$.tags must be of type array, got string"},
+		},
+		{
+			name:   "wrong item type",
+			change: func(data map[string]interface{}) { data["tags"] = []interface{}{"go", 1.0} },
+			want:   []string{"$.tags[1] must be of type string, got number"},
+		},
+		{
+			name:   "unknown category",
+			change: func(data map[string]interface{}) { data["category"] = "Books" },
+			want:   []string{"$.category must be one of [Inbox Areas Projects Resources Archive], got Books"},
+		},
+		{
+			name:   "blank summary",
+			change: func(data map[string]interface{}) { data["summary"] = "  " },
+			want:   []string{"$.summary must have at least 1 characters"},
+		},
+		{
+			name: "additional properties",
+			change: func(data map[string]interface{}) {
+				data["mood"] = "happy"
+				data["author"] = "me"
+			},
+			want: []string{"$.author is not allowed", "$.mood is not allowed"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := validMetadata()
+			test.change(data)
+			if got := schema.Validate(data); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Validate() = %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	if got := schema.Validate([]interface{}{}); len(got) != 1 {
+		t.Errorf("Validate(array) = %q, want a type violation", got)
+	}
+}
+
+func TestSchemaRepair(t *testing.T) {
+	schema, err := LoadSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		path   string
+		change func(data map[string]interface{})
+		want   func(data map[string]interface{})
+	}{
+		{
+			name:   "missing path",
+			path:   "RESOURCES/go",
+			change: func(data map[string]interface{}) { delete(data, "path") },
+		},
+		{
+			name:   "category in another case",
+			path:   "RESOURCES/go",
+			change: func(data map[string]interface{}) { data["category"] = " resources " },
+		},
+		{
+			name:   "unknown category from the folder",
+			path:   "PROJECTS/babel",
+			change: func(data map[string]interface{}) { data["category"] = "Books" },
+			want: func(data map[string]interface{}) {
+				data["category"] = "Projects"
+				data["path"] = "RESOURCES/go"
+			},
+		},
+		{
+			name:   "list as a string",
+			path:   "RESOURCES/go",
+			change: func(data map[string]interface{}) { data["tags"] = "go, cli; tools" },
+			want:   func(data map[string]interface{}) { data["tags"] = []interface{}{"go", "cli", "tools"} },
+		},
+		{
+			name:   "missing list",
+			path:   "RESOURCES/go",
+			change: func(data map[string]interface{}) { delete(data, "references") },
+		},
+		{
+			name:   "items of another type",
+			path:   "RESOURCES/go",
+			change: func(data map[string]interface{}) { data["keywords"] = []interface{}{"channels", 42.0} },
+			want:   func(data map[string]interface{}) { data["keywords"] = []interface{}{"channels", "42"} },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := validMetadata()
+			test.change(data)
+			schema.Repair(data, test.path)
+
+			want := validMetadata()
+			if test.want != nil {
+				test.want(want)
+			}
+			if !reflect.DeepEqual(data, want) {
+				got, _ := json.Marshal(data)
+				expected, _ := json.Marshal(want)
+				t.Errorf("Repair() = %s, want %s", got, expected)
+			}
+			if violations := schema.Validate(data); len(violations) > 0 {
+				t.Errorf("repaired metadata is invalid: %q", violations)
+			}
+		})
+	}
+}
+
+func TestLocate(t *testing.T) {
+	data := validMetadata()
+	Locate(data, "A-ARCHIVES/old/go")
+	if data["path"] != "A-ARCHIVES/old/go" || data["category"] != "Archive" {
+		t.Errorf("Locate() = path %v category %v, want the archived note", data["path"], data["category"])
+	}
+}
+
+func TestSchemaRepairKeepsAdditionalProperties(t *testing.T) {
+	schema, err := LoadSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := validMetadata()
+	data["mood"] = "happy"
+	schema.Repair(data, "RESOURCES/go")
+	if data["mood"] != "happy" {
+		t.Errorf("Repair() removed the additional property: %v", data)
+	}
+	if violations := schema.Validate(data); !reflect.DeepEqual(violations, []string{"$.mood is not allowed"}) {
+		t.Errorf("Validate() = %q, want the additional property refused", violations)
+	}
+}
@@ -1,96 +1,85 @@
 package openai
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
-	"net/http"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 
-	"github.com/margostino/babel-agent/internal/common"
+	"github.com/margostino/babel-agent/internal/llm"
 	"github.com/margostino/babel-agent/prompts"
 )
 
-var BASE_URL = "https://api.openai.com/v1"
-var CHAT_COMPLETION_PATH = "/chat/completions"
-var MODEL = "gpt-4o"
-var PROMPT_FILE_PATH = "../../prompt/metadata_enricher.yml"
-
-type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
-}
-
-type ResponseFormatType string
-
 const (
-	JSON_OBJECT ResponseFormatType = "json_object"
+	metadataEnricherPrompt  = "metadata_enricher.yml"
+	metadataReducerPrompt   = "metadata_reducer.yml"
+	metadataRepairPrompt    = "metadata_repair.yml"
+	questionAnsweringPrompt = "question_answering.yml"
+	commitMessagePrompt     = "commit_message.yml"
 )
 
-type ResponseFormat struct {
-	Type ResponseFormatType `json:"type"`
-}
-
-type RequestBody struct {
-	Model          string         `json:"model"`
-	Messages       []Message      `json:"messages"`
-	ResponseFormat ResponseFormat `json:"response_format"`
-}
-
-type Choice struct {
-	Message struct {
-		Role    string `json:"role"`
-		Content string `json:"content"`
-	} `json:"message"`
-}
-
-type ApiResponse struct {
-	Choices []Choice `json:"choices"`
-}
-
-func getPrompt() (string, error) {
-	file, err := prompts.GetEmbeddedPrompt().Open("metadata_enricher.yml")
+func readPromptFile(name string) (map[string]interface{}, error) {
+	file, err := prompts.GetEmbeddedPrompt().Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open embedded prompt file: %w", err)
+	}
 	defer file.Close()
 
 	content, err := io.ReadAll(file)
-	common.Check(err, "Failed to read embedded prompt file")
-
-	// var promptPath string
-	// if config.IsExecutable() {
-	// 	log.Printf("Running in executable mode")
-	// 	filePath, err := filepath.Abs("../../prompts/metadata_enricher.yml")
-	// 	common.Check(err, "Failed to get absolute path")
-	// 	promptPath = filePath
-	// } else {
-	// 	log.Printf("Running in development mode")
-	// 	filePath, err := filepath.Abs("metadata_enricher.yml")
-	// 	common.Check(err, "Failed to get absolute path")
-	// 	promptPath = filePath
-	// }
-	// content, err := os.ReadFile(promptPath)
-	// common.Check(err, "Failed to read prompt file")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read embedded prompt file: %w", err)
+	}
 
 	var data map[string]interface{}
 	err = yaml.Unmarshal(content, &data)
-	common.Check(err, "Failed to unmarshal metadata file")
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal prompt file: %w", err)
+	}
+
+	return data, nil
+}
+
+func getPrompt(name string) (string, error) {
+	data, err := readPromptFile(name)
+	if err != nil {
+		return "", err
+	}
 
 	prompt, ok := data["prompt"].(string)
 
 	if !ok {
-		return "", fmt.Errorf("Prompt not found in metadata file")
+		return "", fmt.Errorf("Prompt not found in %s", name)
 	}
 
 	return prompt, nil
 }
 
-func GetChatCompletionForMetadata(apiKey string, path string, input string) (string, error) {
-	apiURL := BASE_URL + CHAT_COMPLETION_PATH
-	systemPrompt, err := getPrompt()
-	common.Check(err, "Failed to get system prompt")
+// GetPromptVersion returns the version of the metadata prompt. Metadata
+// generated with another version is considered outdated.
+func GetPromptVersion() (string, error) {
+	data, err := readPromptFile(metadataEnricherPrompt)
+	if err != nil {
+		return "", err
+	}
+
+	version, ok := data["version"].(string)
+
+	if !ok {
+		return "", fmt.Errorf("Version not found in %s", metadataEnricherPrompt)
+	}
+
+	return version, nil
+}
+
+func GetChatCompletionForMetadata(ctx context.Context, provider llm.Provider, path string, input string) (string, error) {
+	systemPrompt, err := getPrompt(metadataEnricherPrompt)
+	if err != nil {
+		return "", err
+	}
 
-	messages := []Message{
+	messages := []llm.Message{
 		{
 			Role:    "system",
 			Content: systemPrompt,
@@ -105,42 +94,122 @@ func GetChatCompletionForMetadata(apiKey string, path string, input string) (str
 		},
 	}
 
-	requestBody := RequestBody{
-		Model:    MODEL,
+	return provider.ChatCompletion(ctx, llm.Request{
 		Messages: messages,
-		ResponseFormat: ResponseFormat{
-			Type: JSON_OBJECT,
+		JSON:     true,
+	})
+}
+
+// GetChatCompletionForMetadataReduce merges the metadata extracted from the parts
+// of a file into the metadata of the whole file.
+func GetChatCompletionForMetadataReduce(ctx context.Context, provider llm.Provider, path string, partials []string) (string, error) {
+	systemPrompt, err := getPrompt(metadataReducerPrompt)
+	if err != nil {
+		return "", err
+	}
+
+	messages := []llm.Message{
+		{
+			Role:    "system",
+			Content: systemPrompt,
+		},
+		{
+			Role:    "user",
+			Content: fmt.Sprintf("File Path: %s", path),
+		},
+		{
+			Role:    "user",
+			Content: fmt.Sprintf("Metadata of the parts: [%s]", strings.Join(partials, ",")),
 		},
 	}
 
-	jsonData, err := json.Marshal(requestBody)
-	common.Check(err, "Failed to marshal OpenAI request body")
+	return provider.ChatCompletion(ctx, llm.Request{
+		Messages: messages,
+		JSON:     true,
+	})
+}
 
-	req, err := http.NewRequest(http.MethodPost, apiURL, bytes.NewBuffer(jsonData))
-	common.Check(err, "Failed to create OpenAI request")
+// GetChatCompletionForMetadataRepair asks the model to fix metadata that does
+// not follow the schema.
+func GetChatCompletionForMetadataRepair(ctx context.Context, provider llm.Provider, schema string, metadata string, violations []string) (string, error) {
+	systemPrompt, err := getPrompt(metadataRepairPrompt)
+	if err != nil {
+		return "", err
+	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
+	messages := []llm.Message{
+		{
+			Role:    "system",
+			Content: systemPrompt,
+		},
+		{
+			Role:    "user",
+			Content: fmt.Sprintf("JSON Schema: %s", schema),
+		},
+		{
+			Role:    "user",
+			Content: fmt.Sprintf("Invalid metadata: %s", metadata),
+		},
+		{
+			Role:    "user",
+			Content: fmt.Sprintf("Validation errors:\n- %s", strings.Join(violations, "\n- ")),
+		},
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	common.Check(err, "Failed to send OpenAI request")
-	defer resp.Body.Close()
+	return provider.ChatCompletion(ctx, llm.Request{
+		Messages: messages,
+		JSON:     true,
+	})
+}
+
+// GetChatCompletionForAnswer answers the question grounded on the numbered
+// sources, citing them by number.
+func GetChatCompletionForAnswer(ctx context.Context, provider llm.Provider, question string, sources string) (string, error) {
+	systemPrompt, err := getPrompt(questionAnsweringPrompt)
+	if err != nil {
+		return "", err
+	}
 
-	if resp.Status != "200 OK" {
-		return "", fmt.Errorf("OpenAI request failed with status: %s", resp.Status)
+	messages := []llm.Message{
+		{
+			Role:    "system",
+			Content: systemPrompt,
+		},
+		{
+			Role:    "user",
+			Content: fmt.Sprintf("Sources:\n%s", sources),
+		},
+		{
+			Role:    "user",
+			Content: fmt.Sprintf("Question: %s", question),
+		},
 	}
 
-	body, err := io.ReadAll(resp.Body)
-	common.Check(err, "Failed to read OpenAI response body")
+	return provider.ChatCompletion(ctx, llm.Request{
+		Messages: messages,
+	})
+}
 
-	var apiResponse ApiResponse
-	err = json.Unmarshal(body, &apiResponse)
-	common.Check(err, "Failed to unmarshal OpenAI response body")
+// GetChatCompletionForCommitMessage writes the subject of a commit from the
+// list of the notes it changes.
+func GetChatCompletionForCommitMessage(ctx context.Context, provider llm.Provider, changes string) (string, error) {
+	systemPrompt, err := getPrompt(commitMessagePrompt)
+	if err != nil {
+		return "", err
+	}
 
-	if len(apiResponse.Choices) == 0 {
-		return "", fmt.Errorf("No choices found in OpenAI response")
+	messages := []llm.Message{
+		{
+			Role:    "system",
+			Content: systemPrompt,
+		},
+		{
+			Role:    "user",
+			Content: fmt.Sprintf("Changed notes:\n%s", changes),
+		},
 	}
 
-	return apiResponse.Choices[0].Message.Content, nil
+	return provider.ChatCompletion(ctx, llm.Request{
+		Messages: messages,
+	})
 }
@@ -0,0 +1,115 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	capacity  float64
+	available float64
+	perSecond float64
+}
+
+func newBucket(perMinute int) *bucket {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &bucket{
+		capacity:  float64(perMinute),
+		available: float64(perMinute),
+		perSecond: float64(perMinute) / 60,
+	}
+}
+
+func (b *bucket) refill(elapsed time.Duration) {
+	b.available += elapsed.Seconds() * b.perSecond
+	if b.available > b.capacity {
+		b.available = b.capacity
+	}
+}
+
+// wait returns how long to wait until amount is available.
+func (b *bucket) wait(amount float64) time.Duration {
+	if amount > b.capacity {
+		amount = b.capacity
+	}
+	if b.available >= amount {
+		return 0
+	}
+	return time.Duration((amount - b.available) / b.perSecond * float64(time.Second))
+}
+
+func (b *bucket) take(amount float64) {
+	if amount > b.capacity {
+		amount = b.capacity
+	}
+	b.available -= amount
+}
+
+// RateLimiter limits both the number of requests and the number of tokens
+// consumed per minute. A zero limit means unlimited.
+type RateLimiter struct {
+	mu       sync.Mutex
+	requests *bucket
+	tokens   *bucket
+	last     time.Time
+}
+
+func NewRateLimiter(requestsPerMinute int, tokensPerMinute int) *RateLimiter {
+	return &RateLimiter{
+		requests: newBucket(requestsPerMinute),
+		tokens:   newBucket(tokensPerMinute),
+		last:     time.Now(),
+	}
+}
+
+// Wait blocks until one request consuming the given tokens is allowed or the
+// context is cancelled.
+func (l *RateLimiter) Wait(ctx context.Context, tokens int) error {
+	for {
+		delay := l.reserve(float64(tokens))
+		if delay == 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (l *RateLimiter) reserve(tokens float64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(l.last)
+	l.last = now
+
+	var delay time.Duration
+	if l.requests != nil {
+		l.requests.refill(elapsed)
+		delay = max(delay, l.requests.wait(1))
+	}
+	if l.tokens != nil {
+		l.tokens.refill(elapsed)
+		delay = max(delay, l.tokens.wait(tokens))
+	}
+	if delay > 0 {
+		return delay
+	}
+
+	if l.requests != nil {
+		l.requests.take(1)
+	}
+	if l.tokens != nil {
+		l.tokens.take(tokens)
+	}
+	return 0
+}
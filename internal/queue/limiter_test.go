@@ -0,0 +1,72 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	tests := []struct {
+		name              string
+		requestsPerMinute int
+		tokensPerMinute   int
+		// reserved are the tokens of the requests made before the checked one.
+		reserved []float64
+		tokens   float64
+		want     time.Duration
+	}{
+		{name: "unlimited", reserved: []float64{1000, 1000}, tokens: 1000, want: 0},
+		{name: "requests left", requestsPerMinute: 2, reserved: []float64{0}, tokens: 0, want: 0},
+		{name: "requests exhausted", requestsPerMinute: 60, reserved: make([]float64, 60), tokens: 0, want: time.Second},
+		{name: "tokens left", tokensPerMinute: 600, reserved: []float64{300}, tokens: 300, want: 0},
+		{name: "tokens exhausted", tokensPerMinute: 600, reserved: []float64{600}, tokens: 60, want: 6 * time.Second},
+		{name: "request over the capacity waits for a full bucket", tokensPerMinute: 600, reserved: []float64{300}, tokens: 6000, want: 30 * time.Second},
+		{name: "longest wait wins", requestsPerMinute: 60, tokensPerMinute: 600, reserved: make([]float64, 60), tokens: 600, want: time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := NewRateLimiter(test.requestsPerMinute, test.tokensPerMinute)
+			for _, tokens := range test.reserved {
+				if delay := limiter.reserve(tokens); delay != 0 {
+					t.Fatalf("reserve(%v) = %v before the limit", tokens, delay)
+				}
+			}
+			got := limiter.reserve(test.tokens)
+			// Time passes between the reservations, the bucket refills a bit.
+			if got > test.want || got < test.want-100*time.Millisecond {
+				t.Errorf("reserve(%v) = %v, want %v", test.tokens, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	limiter := NewRateLimiter(60, 0)
+	for i := 0; i < 60; i++ {
+		limiter.reserve(0)
+	}
+	limiter.last = limiter.last.Add(-2 * time.Second)
+	if delay := limiter.reserve(0); delay != 0 {
+		t.Fatalf("reserve after two seconds = %v, want 0", delay)
+	}
+	if delay := limiter.reserve(0); delay != 0 {
+		t.Fatalf("second reserve after two seconds = %v, want 0", delay)
+	}
+	if delay := limiter.reserve(0); delay == 0 {
+		t.Fatal("third reserve after two seconds was allowed")
+	}
+}
+
+func TestRateLimiterWaitCancelled(t *testing.T) {
+	limiter := NewRateLimiter(1, 0)
+	if err := limiter.Wait(context.Background(), 0); err != nil {
+		t.Fatalf("first Wait = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := limiter.Wait(ctx, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait over the limit = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
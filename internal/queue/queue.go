@@ -0,0 +1,121 @@
+package queue
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Job is a unit of work run by the queue workers.
+type Job struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+type Options struct {
+	// IsRetryable decides whether a failed job is retried. When nil every error
+	// is retried.
+	IsRetryable       func(err error) bool
+	Workers           int
+	MaxRetries        int
+	Backoff           time.Duration
+	MaxBackoff        time.Duration
+	RequestsPerMinute int
+	TokensPerMinute   int
+}
+
+type task struct {
+	job    Job
+	result chan error
+}
+
+type Queue struct {
+	options Options
+	limiter *RateLimiter
+	tasks   chan *task
+	start   sync.Once
+}
+
+func NewQueue(options Options) *Queue {
+	if options.Workers <= 0 {
+		options.Workers = 1
+	}
+	return &Queue{
+		options: options,
+		limiter: NewRateLimiter(options.RequestsPerMinute, options.TokensPerMinute),
+		tasks:   make(chan *task),
+	}
+}
+
+// Limiter returns the rate limiter shared by the jobs, which waits on it before
+// every LLM request they make, see llm.Limit.
+func (q *Queue) Limiter() *RateLimiter {
+	return q.limiter
+}
+
+// Start launches the workers. They stop, and pending jobs are cancelled, once
+// the context is done.
+func (q *Queue) Start(ctx context.Context) {
+	q.start.Do(func() {
+		for i := 0; i < q.options.Workers; i++ {
+			go q.work(ctx)
+		}
+	})
+}
+
+// Submit enqueues a job and returns a channel receiving its final result.
+func (q *Queue) Submit(ctx context.Context, job Job) <-chan error {
+	t := &task{
+		job:    job,
+		result: make(chan error, 1),
+	}
+	go func() {
+		select {
+		case q.tasks <- t:
+		case <-ctx.Done():
+			t.result <- ctx.Err()
+		}
+	}()
+	return t.result
+}
+
+func (q *Queue) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-q.tasks:
+			t.result <- q.run(ctx, t.job)
+		}
+	}
+}
+
+func (q *Queue) run(ctx context.Context, job Job) error {
+	backoff := q.options.Backoff
+	var err error
+
+	for attempt := 0; ; attempt++ {
+		err = job.Run(ctx)
+		if err == nil || attempt >= q.options.MaxRetries || ctx.Err() != nil {
+			return err
+		}
+		if q.options.IsRetryable != nil && !q.options.IsRetryable(err) {
+			return err
+		}
+
+		log.Printf("Job %s failed (attempt %d/%d), retrying in %s: %v\n", job.Name, attempt+1, q.options.MaxRetries+1, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if q.options.MaxBackoff > 0 && backoff > q.options.MaxBackoff {
+			backoff = q.options.MaxBackoff
+		}
+	}
+}
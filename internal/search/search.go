@@ -0,0 +1,250 @@
+// Package search queries the notes indexed in the Babel class and their
+// passages indexed in the BabelChunk class.
+package search
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/margostino/babel-agent/internal/db"
+	"github.com/margostino/babel-agent/internal/metadata"
+)
+
+// Mode is the kind of query run against the index.
+type Mode string
+
+const (
+	// Hybrid combines BM25 keyword ranking with vector similarity.
+	Hybrid Mode = "hybrid"
+	// NearText ranks by vector similarity only.
+	NearText Mode = "neartext"
+)
+
+const defaultLimit = 10
+
+// maxTaggedNotes bounds the notes a tag filter narrows a passage search to.
+const maxTaggedNotes = 100
+
+// Query is a search over the notes. Filters left empty match every note.
+type Query struct {
+	Text string
+	Mode Mode
+	// Alpha weights vector against keyword ranking in hybrid queries, from 0
+	// (keywords only) to 1 (vectors only).
+	Alpha    float32
+	Limit    int
+	Category string
+	Tags     []string
+	Folder   string
+}
+
+// Result is a note matching a query. Score is higher for better matches: the
+// fused score for hybrid queries and 1 - distance for nearText ones.
+type Result struct {
+	ID         string   `json:"id"`
+	Path       string   `json:"path"`
+	Score      float64  `json:"score"`
+	Category   string   `json:"category"`
+	Summary    string   `json:"summary"`
+	Tags       []string `json:"tags"`
+	Highlights []string `json:"highlights"`
+}
+
+// ChunkResult is a passage of a note matching a query, with the headings it is
+// under and its byte offsets in the note.
+type ChunkResult struct {
+	ID      string  `json:"id"`
+	Path    string  `json:"path"`
+	Score   float64 `json:"score"`
+	Heading string  `json:"heading"`
+	Content string  `json:"content"`
+	Index   int     `json:"index"`
+	Start   int     `json:"start"`
+	End     int     `json:"end"`
+}
+
+// ParseMode returns the mode with the name, case insensitive.
+func ParseMode(name string) (Mode, error) {
+	switch Mode(strings.ToLower(name)) {
+	case Hybrid:
+		return Hybrid, nil
+	case NearText:
+		return NearText, nil
+	}
+	return "", fmt.Errorf("unknown search mode %q, use %s or %s", name, Hybrid, NearText)
+}
+
+// normalizeCategory returns the category of the metadata schema matching the
+// name case insensitively.
+func normalizeCategory(name string) (string, error) {
+	schema, err := metadata.LoadSchema()
+	if err != nil {
+		return "", err
+	}
+	categories := schema.Categories()
+	for _, category := range categories {
+		if strings.EqualFold(category, name) {
+			return category, nil
+		}
+	}
+	return "", fmt.Errorf("unknown category %q, use one of %s", name, strings.Join(categories, ", "))
+}
+
+// where returns the conditions of the query.
+func (q *Query) where() ([]db.Condition, error) {
+	var where []db.Condition
+	if q.Category != "" {
+		category, err := normalizeCategory(q.Category)
+		if err != nil {
+			return nil, err
+		}
+		where = append(where, db.Condition{Property: "category", Operator: db.Equal, Values: []string{category}})
+	}
+	if len(q.Tags) > 0 {
+		where = append(where, db.Condition{Property: "tags", Operator: db.ContainsAny, Values: q.Tags})
+	}
+	if folder := strings.Trim(q.Folder, "/"); folder != "" {
+		where = append(where, db.Condition{Property: "path", Operator: db.Like, Values: []string{folder + "/*"}})
+	}
+	return where, nil
+}
+
+// chunkWhere returns the conditions of the query on passages, which only have
+// the path of their note: a category is matched by its PARA folder and tags by
+// the paths of the notes having them. It returns nil conditions and false when
+// no note has the tags.
+func (q *Query) chunkWhere(ctx context.Context, storage db.Storage) ([]db.Condition, bool, error) {
+	var where []db.Condition
+	if q.Category != "" {
+		category, err := normalizeCategory(q.Category)
+		if err != nil {
+			return nil, false, err
+		}
+		where = append(where, db.Condition{Property: "path", Operator: db.Like, Values: []string{metadata.CategoryFolder(category) + "/*"}})
+	}
+	if folder := strings.Trim(q.Folder, "/"); folder != "" {
+		where = append(where, db.Condition{Property: "path", Operator: db.Like, Values: []string{folder + "/*"}})
+	}
+	if len(q.Tags) > 0 {
+		notes, err := Search(ctx, storage, &Query{Text: q.Text, Mode: q.Mode, Alpha: q.Alpha, Limit: maxTaggedNotes, Category: q.Category, Tags: q.Tags, Folder: q.Folder})
+		if err != nil {
+			return nil, false, err
+		}
+		if len(notes) == 0 {
+			return nil, false, nil
+		}
+		paths := make([]string, 0, len(notes))
+		for _, note := range notes {
+			paths = append(paths, note.Path)
+		}
+		where = append(where, db.Condition{Property: "path", Operator: db.ContainsAny, Values: paths})
+	}
+	return where, true, nil
+}
+
+func (q *Query) search(ctx context.Context, storage db.Storage, class string, where []db.Condition, properties []string) ([]*db.Hit, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if q.Mode != Hybrid && q.Mode != NearText && q.Mode != "" {
+		return nil, fmt.Errorf("unknown search mode %q", q.Mode)
+	}
+	hits, err := storage.Search(ctx, &db.SearchQuery{
+		Class:      class,
+		Text:       q.Text,
+		NearText:   q.Mode == NearText,
+		Alpha:      q.Alpha,
+		Limit:      limit,
+		Where:      where,
+		Properties: properties,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("search failed: %w", err)
+	}
+	return hits, nil
+}
+
+// Search runs the query and returns the matching notes, best first.
+func Search(ctx context.Context, storage db.Storage, query *Query) ([]*Result, error) {
+	where, err := query.where()
+	if err != nil {
+		return nil, err
+	}
+	hits, err := query.search(ctx, storage, db.ClassName, where, []string{"path", "category", "summary", "tags", "highlights"})
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*Result, 0, len(hits))
+	for _, hit := range hits {
+		results = append(results, &Result{
+			ID:         hit.ID,
+			Path:       stringValue(hit.Properties["path"]),
+			Score:      hit.Score,
+			Category:   stringValue(hit.Properties["category"]),
+			Summary:    stringValue(hit.Properties["summary"]),
+			Tags:       stringValues(hit.Properties["tags"]),
+			Highlights: stringValues(hit.Properties["highlights"]),
+		})
+	}
+	return results, nil
+}
+
+// SearchChunks runs the query over the passages of the notes and returns the
+// matching passages, best first.
+func SearchChunks(ctx context.Context, storage db.Storage, query *Query) ([]*ChunkResult, error) {
+	where, found, err := query.chunkWhere(ctx, storage)
+	if err != nil || !found {
+		return nil, err
+	}
+	hits, err := query.search(ctx, storage, db.ChunkClassName, where, []string{"path", "heading", "content", "chunk_index", "start_offset", "end_offset"})
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*ChunkResult, 0, len(hits))
+	for _, hit := range hits {
+		results = append(results, &ChunkResult{
+			ID:      hit.ID,
+			Path:    stringValue(hit.Properties["path"]),
+			Score:   hit.Score,
+			Heading: stringValue(hit.Properties["heading"]),
+			Content: stringValue(hit.Properties["content"]),
+			Index:   intValue(hit.Properties["chunk_index"]),
+			Start:   intValue(hit.Properties["start_offset"]),
+			End:     intValue(hit.Properties["end_offset"]),
+		})
+	}
+	return results, nil
+}
+
+// intValue returns the number, decoded from JSON as a float or stored as an int.
+func intValue(value interface{}) int {
+	switch number := value.(type) {
+	case float64:
+		return int(number)
+	case int:
+		return number
+	case int64:
+		return int(number)
+	}
+	return 0
+}
+
+func stringValue(value interface{}) string {
+	text, _ := value.(string)
+	return text
+}
+
+func stringValues(value interface{}) []string {
+	items, _ := value.([]interface{})
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		if text, ok := item.(string); ok {
+			values = append(values, text)
+		}
+	}
+	return values
+}
@@ -0,0 +1,89 @@
+package search_test
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/margostino/babel-agent/internal/db"
+	"github.com/margostino/babel-agent/internal/search"
+	"github.com/margostino/babel-agent/internal/testharness"
+	"github.com/weaviate/weaviate/entities/models"
+)
+
+func TestSearchFolder(t *testing.T) {
+	notes := map[string]string{
+		"RESOURCES/go":             "Resources",
+		"RESOURCES/books/go":       "Resources",
+		"RESOURCES/books/2024/zig": "Resources",
+		"PROJECTS/go":              "Projects",
+	}
+	tests := []struct {
+		name     string
+		query    search.Query
+		wantPath []string
+	}{
+		{name: "folder", query: search.Query{Folder: "RESOURCES"}, wantPath: []string{"RESOURCES/books/2024/zig", "RESOURCES/books/go", "RESOURCES/go"}},
+		{name: "subfolder", query: search.Query{Folder: "RESOURCES/books/"}, wantPath: []string{"RESOURCES/books/2024/zig", "RESOURCES/books/go"}},
+		{name: "category", query: search.Query{Category: "projects"}, wantPath: []string{"PROJECTS/go"}},
+	}
+
+	for _, backend := range []string{db.Weaviate, db.Embedded} {
+		t.Run(backend, func(t *testing.T) {
+			h := testharness.New(t, nil)
+			storage := h.Storage
+			if backend == db.Embedded {
+				h.Config.Db.Backend = db.Embedded
+				h.Config.Db.Path = filepath.Join(t.TempDir(), "vectors.db")
+				h.Config.Db.EmbeddingModel = "fake-embeddings"
+				var err error
+				if storage, err = db.NewStorage(h.Config); err != nil {
+					t.Fatalf("NewStorage() = %v", err)
+				}
+				t.Cleanup(func() { storage.Close() })
+				if err := storage.EnsureSchema(context.Background()); err != nil {
+					t.Fatalf("EnsureSchema() = %v", err)
+				}
+			}
+
+			var objects []*models.Object
+			for path, category := range notes {
+				objects = append(objects, &models.Object{
+					Class: db.ClassName,
+					ID:    strfmt.UUID(db.ObjectID(path)),
+					Properties: map[string]interface{}{
+						"path":     path,
+						"category": category,
+						"summary":  "Notes on " + path,
+						"tags":     []string{"notes"},
+					},
+				})
+			}
+			if failed, err := storage.Upsert(context.Background(), objects); err != nil || len(failed) > 0 {
+				t.Fatalf("Upsert() = %v, %v", failed, err)
+			}
+
+			for _, test := range tests {
+				t.Run(test.name, func(t *testing.T) {
+					query := test.query
+					query.Text = "notes"
+					results, err := search.Search(context.Background(), storage, &query)
+					if err != nil {
+						t.Fatalf("Search() = %v", err)
+					}
+					var paths []string
+					for _, result := range results {
+						paths = append(paths, result.Path)
+					}
+					sort.Strings(paths)
+					if strings.Join(paths, ",") != strings.Join(test.wantPath, ",") {
+						t.Errorf("paths = %q, want %q", paths, test.wantPath)
+					}
+				})
+			}
+		})
+	}
+}
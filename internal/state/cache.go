@@ -0,0 +1,47 @@
+package state
+
+import (
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	cacheBucket    = []byte("cache")
+	contentsBucket = []byte("contents")
+)
+
+func (s *Store) get(bucket []byte, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if found := tx.Bucket(bucket).Get([]byte(key)); found != nil {
+			value = append([]byte{}, found...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (s *Store) put(bucket []byte, key string, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), value)
+	})
+}
+
+// GetCachedMetadata returns the metadata generated before for the cache key, or
+// nil when there is none.
+func (s *Store) GetCachedMetadata(key string) ([]byte, error) {
+	return s.get(cacheBucket, key)
+}
+
+func (s *Store) PutCachedMetadata(key string, metadata []byte) error {
+	return s.put(cacheBucket, key, metadata)
+}
+
+// GetEnrichedContent returns the normalized content of the file the last time it
+// was enriched, or nil when it never was.
+func (s *Store) GetEnrichedContent(path string) ([]byte, error) {
+	return s.get(contentsBucket, path)
+}
+
+func (s *Store) PutEnrichedContent(path string, content []byte) error {
+	return s.put(contentsBucket, path, content)
+}
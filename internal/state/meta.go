@@ -0,0 +1,13 @@
+package state
+
+var metaBucket = []byte("meta")
+
+// GetMeta returns an agent wide value, or "" when it was never set.
+func (s *Store) GetMeta(key string) (string, error) {
+	value, err := s.get(metaBucket, key)
+	return string(value), err
+}
+
+func (s *Store) PutMeta(key string, value string) error {
+	return s.put(metaBucket, key, []byte(value))
+}
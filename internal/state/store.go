@@ -0,0 +1,151 @@
+package state
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var filesBucket = []byte("files")
+
+// Operation is the pending operation of a file, the one that must be completed
+// before the file is considered processed.
+type Operation string
+
+const (
+	NoOperation     Operation = ""
+	EnrichOperation Operation = "enrich"
+	DeleteOperation Operation = "delete"
+)
+
+// FileState is what the agent remembers about a file between runs.
+type FileState struct {
+	Path          string    `json:"path"`
+	ContentHash   string    `json:"contentHash,omitempty"`
+	EnrichedAt    time.Time `json:"enrichedAt,omitempty"`
+	ObjectID      string    `json:"objectId,omitempty"`
+	PromptVersion string    `json:"promptVersion,omitempty"`
+	SchemaVersion int       `json:"schemaVersion,omitempty"`
+	Pending       Operation `json:"pending,omitempty"`
+	LastError     string    `json:"lastError,omitempty"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+// Store is an embedded key/value store holding the state of every processed
+// file, keyed by its path relative to the repository root.
+type Store struct {
+	db *bolt.DB
+}
+
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{filesBucket, cacheBucket, contentsBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Get returns the state of the file, or nil when the file is unknown.
+func (s *Store) Get(path string) (*FileState, error) {
+	var fileState *FileState
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(filesBucket).Get([]byte(path))
+		if value == nil {
+			return nil
+		}
+		fileState = &FileState{}
+		return json.Unmarshal(value, fileState)
+	})
+	return fileState, err
+}
+
+func (s *Store) Put(fileState *FileState) error {
+	fileState.UpdatedAt = time.Now()
+	value, err := json.Marshal(fileState)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).Put([]byte(fileState.Path), value)
+	})
+}
+
+// Update applies fn to the current state of the file (a new one when unknown)
+// and stores the result atomically.
+func (s *Store) Update(path string, fn func(fileState *FileState)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(filesBucket)
+		fileState := &FileState{Path: path}
+		if value := bucket.Get([]byte(path)); value != nil {
+			if err := json.Unmarshal(value, fileState); err != nil {
+				return err
+			}
+		}
+		fn(fileState)
+		fileState.UpdatedAt = time.Now()
+		value, err := json.Marshal(fileState)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(path), value)
+	})
+}
+
+// Delete forgets the file, including its last enriched content.
+func (s *Store) Delete(path string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(contentsBucket).Delete([]byte(path)); err != nil {
+			return err
+		}
+		return tx.Bucket(filesBucket).Delete([]byte(path))
+	})
+}
+
+// List returns the states accepted by the filter, or all of them when the
+// filter is nil.
+func (s *Store) List(filter func(fileState *FileState) bool) ([]*FileState, error) {
+	var fileStates []*FileState
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).ForEach(func(key, value []byte) error {
+			fileState := &FileState{}
+			if err := json.Unmarshal(value, fileState); err != nil {
+				return err
+			}
+			if filter == nil || filter(fileState) {
+				fileStates = append(fileStates, fileState)
+			}
+			return nil
+		})
+	})
+	return fileStates, err
+}
+
+// Pending returns the files with an operation that was not completed, either
+// because it failed or because the agent stopped in the middle of it.
+func (s *Store) Pending() ([]*FileState, error) {
+	return s.List(func(fileState *FileState) bool {
+		return fileState.Pending != NoOperation
+	})
+}
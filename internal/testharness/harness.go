@@ -0,0 +1,130 @@
+// Package testharness runs the agent hermetically: a fake chat completions
+// server, a fake Weaviate and a temporary repository with a local bare remote
+// replace every external dependency, so end-to-end tests run offline.
+package testharness
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/margostino/babel-agent/internal/config"
+	"github.com/margostino/babel-agent/internal/db"
+	"github.com/margostino/babel-agent/internal/llm"
+	"github.com/margostino/babel-agent/internal/queue"
+	"github.com/margostino/babel-agent/internal/state"
+	"github.com/margostino/babel-agent/internal/tools"
+)
+
+type Harness struct {
+	Config   *config.Config
+	Repo     *TempRepo
+	LLM      *FakeLLM
+	Weaviate *FakeWeaviate
+	Storage  db.Storage
+	Provider llm.Provider
+	Store    *state.Store
+	Queue    *queue.Queue
+	Registry *tools.Registry
+}
+
+// New starts the fake servers, creates the repository seeded with the given
+// files and wires the default tools. Everything is released when the test ends.
+func New(tb testing.TB, files map[string]string) *Harness {
+	tb.Helper()
+
+	fakeLLM := NewFakeLLM()
+	tb.Cleanup(fakeLLM.Close)
+	fakeWeaviate := NewFakeWeaviate()
+	tb.Cleanup(fakeWeaviate.Close)
+	repo := NewTempRepo(tb, files)
+
+	c := NewConfig(tb, repo.Path, fakeLLM.URL(), fakeWeaviate.Port())
+
+	store, err := state.Open(filepath.Join(c.Agent.StateDir, "state.db"))
+	if err != nil {
+		tb.Fatalf("failed to open state store: %v", err)
+	}
+	tb.Cleanup(func() { store.Close() })
+
+	provider, err := llm.NewProvider(c)
+	if err != nil {
+		tb.Fatalf("failed to create LLM provider: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tb.Cleanup(cancel)
+	jobs := queue.NewQueue(queue.Options{
+		IsRetryable: func(err error) bool {
+			return tools.KindOf(err) == tools.Transient
+		},
+		Workers:    c.Queue.Workers,
+		MaxRetries: c.Queue.MaxRetries,
+		Backoff:    c.Queue.Backoff,
+		MaxBackoff: c.Queue.MaxBackoff,
+	})
+	jobs.Start(ctx)
+	provider = llm.Limit(provider, jobs.Limiter())
+
+	storage, err := db.NewStorage(c)
+	if err != nil {
+		tb.Fatalf("failed to create storage: %v", err)
+	}
+	if err := storage.EnsureSchema(ctx); err != nil {
+		tb.Fatalf("failed to ensure schema: %v", err)
+	}
+	registry := tools.NewRegistry(c)
+	for _, tool := range []tools.Tool{tools.NewAssetsCleaner(c), tools.NewMetadataEnricher(storage, provider, c, jobs, store)} {
+		if err := registry.Register(tool); err != nil {
+			tb.Fatalf("failed to register tool: %v", err)
+		}
+	}
+
+	return &Harness{
+		Config:   c,
+		Repo:     repo,
+		LLM:      fakeLLM,
+		Weaviate: fakeWeaviate,
+		Storage:  storage,
+		Provider: provider,
+		Store:    store,
+		Queue:    jobs,
+		Registry: registry,
+	}
+}
+
+// NewConfig returns a configuration with every tool enabled, pointing to the
+// given repository, OpenAI-compatible endpoint and Weaviate port.
+func NewConfig(tb testing.TB, repoPath string, llmURL string, dbPort int) *config.Config {
+	c := &config.Config{}
+	c.Repository.Path = repoPath
+	c.Repository.Message = "Babel update"
+	c.Sync.ConflictStrategy = tools.RebaseStrategy
+	c.Sync.PushRetries = 3
+	c.Sync.ProbeBackoff = time.Second
+	c.Sync.MaxProbeBackoff = time.Minute
+	c.User.Username = "babel"
+	c.User.Email = "babel@babel.local"
+	c.Agent.Tick = time.Second
+	c.Agent.Debounce = 50 * time.Millisecond
+	c.Agent.StateDir = tb.TempDir()
+	c.Llm.Provider = llm.OpenAICompatible
+	c.Llm.BaseUrl = llmURL
+	c.Llm.Model = "fake-model"
+	c.Llm.Timeout = 10 * time.Second
+	c.Enrichment.RepairAttempts = 1
+	c.Tools.GitUpdaterEnabled = true
+	c.Tools.AssetsCleanerEnabled = true
+	c.Tools.MetadataEnricherEnabled = true
+	c.Db.Port = dbPort
+	c.Queue.Workers = 2
+	c.Queue.Backoff = 10 * time.Millisecond
+	c.Queue.MaxBackoff = 50 * time.Millisecond
+	return c
+}
+
+// UpdateGit runs a sync cycle over the harness repository.
+func (h *Harness) UpdateGit(ctx context.Context, changedPaths []string) (*tools.ChangeSet, error) {
+	return tools.UpdateGit(ctx, h.Registry, h.Config, h.Store, h.Provider, tools.SyncOptions{ChangedPaths: changedPaths})
+}
@@ -0,0 +1,124 @@
+package testharness
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/margostino/babel-agent/internal/db"
+	"github.com/margostino/babel-agent/internal/state"
+	"github.com/margostino/babel-agent/internal/tools"
+)
+
+func TestHarnessEnrichesCommitsAndPushes(t *testing.T) {
+	h := New(t, nil)
+	h.Repo.WriteFile("RESOURCES/go.md", "# Go\n\nChannels and goroutines.\n")
+
+	if _, err := h.UpdateGit(context.Background(), nil); err != nil {
+		t.Fatalf("UpdateGit() = %v", err)
+	}
+
+	// The assets cleaner drops the extension before the note is enriched.
+	if _, err := os.Stat(filepath.Join(h.Repo.Path, "RESOURCES/go.md")); !os.IsNotExist(err) {
+		t.Errorf("RESOURCES/go.md was not renamed: %v", err)
+	}
+	var paths []string
+	for _, request := range h.LLM.Requests() {
+		paths = append(paths, request.FilePath())
+	}
+	if !reflect.DeepEqual(paths, []string{"RESOURCES/go"}) {
+		t.Errorf("paths of the LLM requests = %q", paths)
+	}
+	data, err := tools.ReadMetadata(h.Config, "RESOURCES/go")
+	if err != nil || data == nil {
+		t.Fatalf("ReadMetadata() = %v, %v", data, err)
+	}
+	if data["summary"] != "Summary of RESOURCES/go" || data["path"] != "RESOURCES/go" {
+		t.Errorf("metadata = %v", data)
+	}
+	object := h.Weaviate.ObjectByPath(db.ClassName, "RESOURCES/go")
+	if object == nil || object.ID != db.ObjectID("RESOURCES/go") || object.Properties["summary"] != "Summary of RESOURCES/go" {
+		t.Errorf("object of RESOURCES/go = %+v", object)
+	}
+	fileState, err := h.Store.Get("RESOURCES/go")
+	if err != nil || fileState == nil || fileState.ContentHash == "" || fileState.Pending != state.NoOperation {
+		t.Errorf("state of RESOURCES/go = %+v, %v", fileState, err)
+	}
+
+	if !h.Repo.Status().IsClean() {
+		t.Errorf("work tree not clean after the sync: %v", h.Repo.Status())
+	}
+	if log := h.Repo.RemoteLog(); !reflect.DeepEqual(log, []string{"Babel update", "Initial commit"}) {
+		t.Errorf("remote log = %q", log)
+	}
+
+	// A second cycle without changes neither asks the LLM nor commits.
+	if _, err := h.UpdateGit(context.Background(), nil); err != nil {
+		t.Fatalf("second UpdateGit() = %v", err)
+	}
+	if requests := len(h.LLM.Requests()); requests != 1 {
+		t.Errorf("the second cycle made %d LLM requests", requests-1)
+	}
+	if log := h.Repo.RemoteLog(); len(log) != 2 {
+		t.Errorf("the second cycle committed: %q", log)
+	}
+}
+
+func TestHarnessDeletesNote(t *testing.T) {
+	h := New(t, map[string]string{"RESOURCES/go": "# Go\n\nChannels.\n"})
+	h.Repo.WriteFile("RESOURCES/go", "# Go\n\nChannels and goroutines.\n")
+	if _, err := h.UpdateGit(context.Background(), nil); err != nil {
+		t.Fatalf("UpdateGit() = %v", err)
+	}
+	if h.Weaviate.ObjectByPath(db.ClassName, "RESOURCES/go") == nil {
+		t.Fatal("RESOURCES/go was not indexed")
+	}
+
+	h.Repo.RemoveFile("RESOURCES/go")
+	if _, err := h.UpdateGit(context.Background(), nil); err != nil {
+		t.Fatalf("UpdateGit() after deleting = %v", err)
+	}
+	if object := h.Weaviate.ObjectByPath(db.ClassName, "RESOURCES/go"); object != nil {
+		t.Errorf("object of the deleted note = %+v", object)
+	}
+	if _, err := os.Stat(filepath.Join(h.Repo.Path, "z-metadata/RESOURCES/go.json")); !os.IsNotExist(err) {
+		t.Errorf("metadata of the deleted note: %v", err)
+	}
+	if !h.Repo.Status().IsClean() {
+		t.Errorf("work tree not clean after the sync: %v", h.Repo.Status())
+	}
+	if log := h.Repo.RemoteLog(); len(log) != 3 {
+		t.Errorf("remote log = %q, want the deletion pushed", log)
+	}
+}
+
+func TestHarnessRespond(t *testing.T) {
+	h := New(t, nil)
+	h.LLM.Respond(func(request ChatRequest) (string, int) {
+		if request.FilePath() == "RESOURCES/rust" {
+			return "invalid request", http.StatusBadRequest
+		}
+		content, status := DefaultResponse(request)
+		return strings.Replace(content, "Summary of", "Notes on", 1), status
+	})
+	h.Repo.WriteFile("RESOURCES/go", "# Go\n\nChannels.\n")
+	h.Repo.WriteFile("RESOURCES/rust", "# Rust\n\nOwnership.\n")
+
+	changes, err := h.UpdateGit(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("UpdateGit() = %v", err)
+	}
+	if object := h.Weaviate.ObjectByPath(db.ClassName, "RESOURCES/go"); object == nil || object.Properties["summary"] != "Notes on RESOURCES/go" {
+		t.Errorf("object of RESOURCES/go = %+v", object)
+	}
+	if object := h.Weaviate.ObjectByPath(db.ClassName, "RESOURCES/rust"); object != nil {
+		t.Errorf("the refused note was indexed: %+v", object)
+	}
+	if failures := changes.Failures(); len(failures) != 1 || failures[0].Change.Path != "RESOURCES/rust" {
+		t.Errorf("failures = %+v, want RESOURCES/rust", failures)
+	}
+}
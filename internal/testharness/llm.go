@@ -0,0 +1,159 @@
+package testharness
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// FakeLLM is an in-process server implementing the chat completions and
+// embeddings APIs. By default it answers with metadata derived from the "File
+// Path" message of the request; Respond overrides the answer. Embeddings are
+// hashed bags of words, so texts sharing words are similar.
+type FakeLLM struct {
+	Server *httptest.Server
+
+	mu       sync.Mutex
+	requests []ChatRequest
+	respond  func(request ChatRequest) (string, int)
+}
+
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type ChatRequest struct {
+	Model    string        `json:"model"`
+	Messages []ChatMessage `json:"messages"`
+}
+
+func NewFakeLLM() *FakeLLM {
+	f := &FakeLLM{respond: DefaultResponse}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *FakeLLM) URL() string {
+	return f.Server.URL
+}
+
+func (f *FakeLLM) Close() {
+	f.Server.Close()
+}
+
+// Respond replaces the handler deciding the content and status of the answers.
+func (f *FakeLLM) Respond(respond func(request ChatRequest) (content string, status int)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.respond = respond
+}
+
+// Requests returns the chat requests received so far.
+func (f *FakeLLM) Requests() []ChatRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]ChatRequest{}, f.requests...)
+}
+
+func (f *FakeLLM) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/embeddings") {
+		f.handleEmbeddings(w, r)
+		return
+	}
+	if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/chat/completions") {
+		http.NotFound(w, r)
+		return
+	}
+
+	var request ChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	f.requests = append(f.requests, request)
+	respond := f.respond
+	f.mu.Unlock()
+
+	content, status := respond(request)
+	if status != http.StatusOK {
+		http.Error(w, content, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"choices": []map[string]interface{}{
+			{
+				"message": map[string]string{
+					"role":    "assistant",
+					"content": content,
+				},
+			},
+		},
+	})
+}
+
+func (f *FakeLLM) handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Input []string `json:"input"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data := make([]map[string]interface{}, len(request.Input))
+	for i, input := range request.Input {
+		data[i] = map[string]interface{}{"index": i, "embedding": embedding(input)}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+// embeddingDimensions is the size of the fake embeddings.
+const embeddingDimensions = 64
+
+func embedding(text string) []float32 {
+	vector := make([]float32, embeddingDimensions)
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		h := fnv.New32a()
+		h.Write([]byte(word))
+		vector[h.Sum32()%embeddingDimensions]++
+	}
+	return vector
+}
+
+// FilePath returns the file path sent in a metadata request.
+func (r ChatRequest) FilePath() string {
+	for _, message := range r.Messages {
+		if path, found := strings.CutPrefix(message.Content, "File Path: "); found {
+			return path
+		}
+	}
+	return ""
+}
+
+// DefaultResponse answers metadata requests with metadata derived from the file
+// path, for Respond handlers that only change some answers.
+func DefaultResponse(request ChatRequest) (string, int) {
+	path := request.FilePath()
+	metadata := map[string]interface{}{
+		"category":      "Resources",
+		"path":          path,
+		"tags":          []string{"test"},
+		"keywords":      []string{"babel"},
+		"summary":       fmt.Sprintf("Summary of %s", path),
+		"highlights":    []string{"highlight"},
+		"references":    []string{},
+		"related_links": []string{},
+	}
+	content, _ := json.Marshal(metadata)
+	return string(content), http.StatusOK
+}
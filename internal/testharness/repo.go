@@ -0,0 +1,206 @@
+package testharness
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+)
+
+var installServer sync.Once
+
+// fileServer is the in-process server of the file transport. Like git, it
+// ignores the commits a fetching client has that the remote lacks, which the
+// go-git server fails on.
+type fileServer struct {
+	transport.Transport
+}
+
+func (s fileServer) NewUploadPackSession(endpoint *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	session, err := s.Transport.NewUploadPackSession(endpoint, auth)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := server.DefaultLoader.Load(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &uploadPackSession{UploadPackSession: session, objects: objects}, nil
+}
+
+type uploadPackSession struct {
+	transport.UploadPackSession
+	objects storer.Storer
+}
+
+func (s *uploadPackSession) UploadPack(ctx context.Context, request *packp.UploadPackRequest) (*packp.UploadPackResponse, error) {
+	haves := request.Haves[:0]
+	for _, have := range request.Haves {
+		if s.objects.HasEncodedObject(have) == nil {
+			haves = append(haves, have)
+		}
+	}
+	request.Haves = haves
+	return s.UploadPackSession.UploadPack(ctx, request)
+}
+
+// TempRepo is a working repository cloned from a local bare remote, both in
+// temporary directories.
+type TempRepo struct {
+	tb         testing.TB
+	Path       string
+	RemotePath string
+	Repo       *git.Repository
+}
+
+// NewTempRepo creates a bare remote with an initial commit holding the given
+// files and clones it. The file transport is served in process, so no git
+// binary is needed.
+func NewTempRepo(tb testing.TB, files map[string]string) *TempRepo {
+	tb.Helper()
+	installServer.Do(func() {
+		client.InstallProtocol("file", fileServer{server.DefaultServer})
+	})
+
+	remotePath := filepath.Join(tb.TempDir(), "remote.git")
+	if _, err := git.PlainInit(remotePath, true); err != nil {
+		tb.Fatalf("failed to init remote: %v", err)
+	}
+
+	seed := &TempRepo{tb: tb, Path: filepath.Join(tb.TempDir(), "seed")}
+	seedRepo, err := git.PlainInit(seed.Path, false)
+	if err != nil {
+		tb.Fatalf("failed to init seed repo: %v", err)
+	}
+	seed.Repo = seedRepo
+	_, err = seedRepo.CreateRemote(&gitconfig.RemoteConfig{Name: "origin", URLs: []string{remotePath}})
+	if err != nil {
+		tb.Fatalf("failed to add remote: %v", err)
+	}
+	if files == nil {
+		files = map[string]string{}
+	}
+	if _, found := files["README.md"]; !found {
+		files["README.md"] = "# Babel\n"
+	}
+	for path, content := range files {
+		seed.WriteFile(path, content)
+	}
+	seed.Commit("Initial commit")
+	seed.Push()
+
+	path := filepath.Join(tb.TempDir(), "repo")
+	repo, err := git.PlainClone(path, false, &git.CloneOptions{URL: remotePath})
+	if err != nil {
+		tb.Fatalf("failed to clone remote: %v", err)
+	}
+
+	return &TempRepo{tb: tb, Path: path, RemotePath: remotePath, Repo: repo}
+}
+
+// Clone clones the remote again, e.g. to act as another machine.
+func (r *TempRepo) Clone() *TempRepo {
+	r.tb.Helper()
+	path := filepath.Join(r.tb.TempDir(), "clone")
+	repo, err := git.PlainClone(path, false, &git.CloneOptions{URL: r.RemotePath})
+	if err != nil {
+		r.tb.Fatalf("failed to clone remote: %v", err)
+	}
+	return &TempRepo{tb: r.tb, Path: path, RemotePath: r.RemotePath, Repo: repo}
+}
+
+func (r *TempRepo) WriteFile(relativePath string, content string) {
+	r.tb.Helper()
+	absolutePath := filepath.Join(r.Path, relativePath)
+	if err := os.MkdirAll(filepath.Dir(absolutePath), 0755); err != nil {
+		r.tb.Fatalf("failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(absolutePath, []byte(content), 0644); err != nil {
+		r.tb.Fatalf("failed to write file: %v", err)
+	}
+}
+
+func (r *TempRepo) ReadFile(relativePath string) string {
+	r.tb.Helper()
+	content, err := os.ReadFile(filepath.Join(r.Path, relativePath))
+	if err != nil {
+		r.tb.Fatalf("failed to read file: %v", err)
+	}
+	return string(content)
+}
+
+func (r *TempRepo) RemoveFile(relativePath string) {
+	r.tb.Helper()
+	if err := os.Remove(filepath.Join(r.Path, relativePath)); err != nil {
+		r.tb.Fatalf("failed to remove file: %v", err)
+	}
+}
+
+// Commit stages every change and commits it.
+func (r *TempRepo) Commit(message string) {
+	r.tb.Helper()
+	workTree, err := r.Repo.Worktree()
+	if err != nil {
+		r.tb.Fatalf("failed to get work tree: %v", err)
+	}
+	if err := workTree.AddWithOptions(&git.AddOptions{All: true}); err != nil {
+		r.tb.Fatalf("failed to add files: %v", err)
+	}
+	_, err = workTree.Commit(message, &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@babel.local", When: time.Now()},
+	})
+	if err != nil {
+		r.tb.Fatalf("failed to commit: %v", err)
+	}
+}
+
+func (r *TempRepo) Push() {
+	r.tb.Helper()
+	if err := r.Repo.Push(&git.PushOptions{}); err != nil && err != git.NoErrAlreadyUpToDate {
+		r.tb.Fatalf("failed to push: %v", err)
+	}
+}
+
+// Status returns the status of the working tree.
+func (r *TempRepo) Status() git.Status {
+	r.tb.Helper()
+	workTree, err := r.Repo.Worktree()
+	if err != nil {
+		r.tb.Fatalf("failed to get work tree: %v", err)
+	}
+	status, err := workTree.Status()
+	if err != nil {
+		r.tb.Fatalf("failed to get status: %v", err)
+	}
+	return status
+}
+
+// RemoteLog returns the messages of the commits in the remote, newest first.
+func (r *TempRepo) RemoteLog() []string {
+	r.tb.Helper()
+	remote, err := git.PlainOpen(r.RemotePath)
+	if err != nil {
+		r.tb.Fatalf("failed to open remote: %v", err)
+	}
+	commits, err := remote.Log(&git.LogOptions{})
+	if err != nil {
+		r.tb.Fatalf("failed to get remote log: %v", err)
+	}
+	var messages []string
+	commits.ForEach(func(commit *object.Commit) error {
+		messages = append(messages, commit.Message)
+		return nil
+	})
+	return messages
+}
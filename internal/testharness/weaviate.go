@@ -0,0 +1,541 @@
+package testharness
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/margostino/babel-agent/internal/db"
+)
+
+// Object is an object stored in the fake Weaviate.
+type Object struct {
+	ID         string                 `json:"id"`
+	Class      string                 `json:"class"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// FakeWeaviate is an in-process server implementing the subset of the Weaviate
+// REST and GraphQL APIs used by the agent, backed by memory.
+type FakeWeaviate struct {
+	Server *httptest.Server
+
+	mu      sync.Mutex
+	objects map[string]*Object
+	classes map[string]map[string]interface{}
+}
+
+func NewFakeWeaviate() *FakeWeaviate {
+	f := &FakeWeaviate{
+		objects: make(map[string]*Object),
+		classes: make(map[string]map[string]interface{}),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *FakeWeaviate) Close() {
+	f.Server.Close()
+}
+
+// Port returns the local port the server listens on.
+func (f *FakeWeaviate) Port() int {
+	serverURL, _ := url.Parse(f.Server.URL)
+	port, _ := strconv.Atoi(serverURL.Port())
+	return port
+}
+
+// Objects returns the objects of the class.
+func (f *FakeWeaviate) Objects(class string) []*Object {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var objects []*Object
+	for _, object := range f.objects {
+		if object.Class == class {
+			objects = append(objects, object)
+		}
+	}
+	return objects
+}
+
+// ObjectByPath returns the first object of the class with the path property.
+func (f *FakeWeaviate) ObjectByPath(class string, path string) *Object {
+	for _, object := range f.Objects(class) {
+		if object.Properties["path"] == path {
+			return object
+		}
+	}
+	return nil
+}
+
+func (f *FakeWeaviate) handle(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	switch {
+	case path == "/.well-known/ready" || path == "/.well-known/live":
+		w.WriteHeader(http.StatusOK)
+	case path == "/meta":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"version": "1.26.0", "modules": map[string]interface{}{}})
+	case path == "/graphql":
+		f.handleGraphQL(w, r)
+	case path == "/batch/objects" && r.Method == http.MethodPost:
+		f.handleBatch(w, r)
+	case path == "/batch/objects" && r.Method == http.MethodDelete:
+		f.handleBatchDelete(w, r)
+	case parts[0] == "schema":
+		f.handleSchema(w, r, parts[1:])
+	case parts[0] == "objects":
+		f.handleObjects(w, r, parts[1:])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *FakeWeaviate) handleObjects(w http.ResponseWriter, r *http.Request, parts []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(parts) == 0 && r.Method == http.MethodPost {
+		var object Object
+		if err := json.NewDecoder(r.Body).Decode(&object); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if object.ID == "" {
+			object.ID = uuid.NewString()
+		}
+		if _, found := f.objects[object.ID]; found {
+			writeError(w, http.StatusUnprocessableEntity, "id already exists")
+			return
+		}
+		f.objects[object.ID] = &object
+		writeJSON(w, http.StatusOK, object)
+		return
+	}
+
+	if len(parts) == 0 && r.Method == http.MethodGet {
+		f.listObjects(w, r)
+		return
+	}
+
+	// Both /objects/{id} and /objects/{class}/{id} are accepted.
+	if len(parts) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	id := parts[len(parts)-1]
+	object, found := f.objects[id]
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if !found {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, object)
+	case http.MethodDelete:
+		if !found {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		delete(f.objects, id)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch, http.MethodPut:
+		if !found {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		var update Object
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if r.Method == http.MethodPut {
+			object.Properties = map[string]interface{}{}
+		}
+		for key, value := range update.Properties {
+			object.Properties[key] = value
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// listObjects lists the objects of a class ordered by ID, paged with the limit
+// and after parameters like Weaviate's cursor API. The caller holds the lock.
+func (f *FakeWeaviate) listObjects(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := 25
+	if value := query.Get("limit"); value != "" {
+		limit, _ = strconv.Atoi(value)
+	}
+
+	var ids []string
+	for id, object := range f.objects {
+		if class := query.Get("class"); class != "" && object.Class != class {
+			continue
+		}
+		if after := query.Get("after"); after != "" && id <= after {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	objects := make([]*Object, 0, len(ids))
+	for _, id := range ids {
+		objects = append(objects, f.objects[id])
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"objects": objects, "totalResults": len(objects)})
+}
+
+func (f *FakeWeaviate) handleBatch(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Objects []*Object `json:"objects"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var response []map[string]interface{}
+	for _, object := range body.Objects {
+		if object.ID == "" {
+			object.ID = uuid.NewString()
+		}
+		f.objects[object.ID] = object
+		response = append(response, map[string]interface{}{
+			"id":         object.ID,
+			"class":      object.Class,
+			"properties": object.Properties,
+			"result":     map[string]interface{}{},
+		})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// where is a REST where filter on text properties.
+type where struct {
+	Operator  string   `json:"operator"`
+	Operands  []*where `json:"operands"`
+	Path      []string `json:"path"`
+	ValueText *string  `json:"valueText"`
+}
+
+func (c *where) matches(properties map[string]interface{}) bool {
+	switch c.Operator {
+	case "And":
+		for _, operand := range c.Operands {
+			if !operand.matches(properties) {
+				return false
+			}
+		}
+		return true
+	case "Or":
+		for _, operand := range c.Operands {
+			if operand.matches(properties) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(c.Path) != 1 || c.ValueText == nil {
+		return false
+	}
+	value, _ := properties[c.Path[0]].(string)
+	switch c.Operator {
+	case "Equal":
+		return value == *c.ValueText
+	case "NotEqual":
+		return value != *c.ValueText
+	case "Like":
+		return db.MatchLike(*c.ValueText, value)
+	}
+	return false
+}
+
+func (f *FakeWeaviate) handleBatchDelete(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Match struct {
+			Class string `json:"class"`
+			Where *where `json:"where"`
+		} `json:"match"`
+		DryRun bool `json:"dryRun"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Match.Where == nil {
+		writeError(w, http.StatusBadRequest, "invalid batch delete")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	matches := 0
+	for id, object := range f.objects {
+		if object.Class == body.Match.Class && body.Match.Where.matches(object.Properties) {
+			matches++
+			if !body.DryRun {
+				delete(f.objects, id)
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"match":   body.Match,
+		"dryRun":  body.DryRun,
+		"results": map[string]interface{}{"matches": matches, "successful": matches, "failed": 0, "limit": 10000},
+	})
+}
+
+func (f *FakeWeaviate) handleSchema(w http.ResponseWriter, r *http.Request, parts []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		classes := make([]map[string]interface{}, 0, len(f.classes))
+		for _, class := range f.classes {
+			classes = append(classes, class)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"classes": classes})
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		var class map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&class); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		name, _ := class["class"].(string)
+		if _, found := f.classes[name]; found {
+			writeError(w, http.StatusUnprocessableEntity, "class already exists")
+			return
+		}
+		f.classes[name] = class
+		writeJSON(w, http.StatusOK, class)
+	case len(parts) == 1:
+		class, found := f.classes[parts[0]]
+		switch {
+		case !found:
+			writeError(w, http.StatusNotFound, "class not found")
+		case r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, class)
+		case r.Method == http.MethodPut:
+			var update map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			f.classes[parts[0]] = update
+			writeJSON(w, http.StatusOK, update)
+		case r.Method == http.MethodDelete:
+			delete(f.classes, parts[0])
+			for id, object := range f.objects {
+				if object.Class == parts[0] {
+					delete(f.objects, id)
+				}
+			}
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	case len(parts) == 2 && parts[1] == "properties" && r.Method == http.MethodPost:
+		class, found := f.classes[parts[0]]
+		if !found {
+			writeError(w, http.StatusNotFound, "class not found")
+			return
+		}
+		var property map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&property); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		properties, _ := class["properties"].([]interface{})
+		class["properties"] = append(properties, property)
+		writeJSON(w, http.StatusOK, property)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+var (
+	getClassPattern  = regexp.MustCompile(`Get\s*\{\s*(\w+)`)
+	conditionPattern = regexp.MustCompile(`operator:\s*(\w+)\s+path:\s*\["(\w+)"\]\s+valueText:\s*("(?:[^"\\]|\\.)*"|\[[^\]]*\])`)
+	searchPattern    = regexp.MustCompile(`(?:hybrid:\s*\{\s*query|concepts):\s*\[?\s*"((?:[^"\\]|\\.)*)"`)
+	limitPattern     = regexp.MustCompile(`limit:\s*(\d+)`)
+)
+
+// condition is a where operand on a text property.
+type condition struct {
+	operator string
+	property string
+	values   []string
+}
+
+// parseConditions returns the where operands of the query, all of which must
+// match.
+func parseConditions(query string) []condition {
+	var conditions []condition
+	for _, match := range conditionPattern.FindAllStringSubmatch(query, -1) {
+		var values []string
+		if strings.HasPrefix(match[3], "[") {
+			json.Unmarshal([]byte(match[3]), &values)
+		} else if value, err := strconv.Unquote(match[3]); err == nil {
+			values = []string{value}
+		}
+		conditions = append(conditions, condition{operator: match[1], property: match[2], values: values})
+	}
+	return conditions
+}
+
+func (c condition) matches(properties map[string]interface{}) bool {
+	var texts []string
+	switch value := properties[c.property].(type) {
+	case string:
+		texts = []string{value}
+	case []interface{}:
+		for _, item := range value {
+			if text, ok := item.(string); ok {
+				texts = append(texts, text)
+			}
+		}
+	}
+	for _, text := range texts {
+		for _, value := range c.values {
+			switch c.operator {
+			case "Like":
+				if db.MatchLike(value, text) {
+					return true
+				}
+			default:
+				if text == value {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// relevance counts the words of the search found in the object, a crude
+// stand-in for both BM25 and vector similarity.
+func relevance(search string, properties map[string]interface{}) int {
+	content, _ := json.Marshal(properties)
+	text := strings.ToLower(string(content))
+	score := 0
+	for _, word := range strings.Fields(strings.ToLower(search)) {
+		if strings.Contains(text, word) {
+			score++
+		}
+	}
+	return score
+}
+
+// handleGraphQL answers Get queries with where operands on text properties, an
+// optional hybrid or nearText search and a limit.
+func (f *FakeWeaviate) handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Query string `json:"query"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	match := getClassPattern.FindStringSubmatch(body.Query)
+	if match == nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"errors": []map[string]interface{}{{"message": "unsupported query"}},
+		})
+		return
+	}
+	class := match[1]
+
+	conditions := parseConditions(body.Query)
+	var search *string
+	if match := searchPattern.FindStringSubmatch(body.Query); match != nil {
+		if value, err := strconv.Unquote(`"` + match[1] + `"`); err == nil {
+			search = &value
+		}
+	}
+	limit := -1
+	if match := limitPattern.FindStringSubmatch(body.Query); match != nil {
+		limit, _ = strconv.Atoi(match[1])
+	}
+
+	type scored struct {
+		object *Object
+		score  int
+	}
+	var matches []scored
+	for _, object := range f.Objects(class) {
+		matched := true
+		for _, condition := range conditions {
+			matched = matched && condition.matches(object.Properties)
+		}
+		if !matched {
+			continue
+		}
+		score := 0
+		if search != nil {
+			if score = relevance(*search, object.Properties); score == 0 {
+				continue
+			}
+		}
+		matches = append(matches, scored{object: object, score: score})
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].object.ID < matches[j].object.ID
+	})
+	if limit >= 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	results := []interface{}{}
+	for _, match := range matches {
+		result := map[string]interface{}{
+			"_additional": map[string]interface{}{
+				"id":       match.object.ID,
+				"score":    strconv.Itoa(match.score),
+				"distance": 1 / float64(1+match.score),
+			},
+		}
+		for key, value := range match.object.Properties {
+			result[key] = value
+		}
+		results = append(results, result)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{
+			"Get": map[string]interface{}{class: results},
+		},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": []map[string]string{{"message": message}},
+	})
+}
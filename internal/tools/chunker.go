@@ -0,0 +1,122 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/margostino/babel-agent/internal/config"
+	"github.com/margostino/babel-agent/internal/llm"
+	"github.com/margostino/babel-agent/internal/openai"
+)
+
+// charsPerToken is the usual approximation of the characters of a token, close
+// enough for budgeting without a model specific tokenizer.
+const charsPerToken = 4
+
+func countTokens(text string) int {
+	return (len(text) + charsPerToken - 1) / charsPerToken
+}
+
+// truncateToTokens cuts the text to the given tokens, at a line boundary when
+// there is one.
+func truncateToTokens(text string, maxTokens int) string {
+	maxChars := maxTokens * charsPerToken
+	if len(text) <= maxChars {
+		return text
+	}
+	truncated := text[:runeBoundary(text, maxChars)]
+	if index := strings.LastIndex(truncated, "\n"); index > 0 {
+		truncated = truncated[:index]
+	}
+	return truncated
+}
+
+// runeBoundary moves the index back to the start of a rune, so that cutting the
+// text there keeps it valid UTF-8.
+func runeBoundary(text string, index int) int {
+	for index > 0 && !utf8.RuneStart(text[index]) {
+		index--
+	}
+	return index
+}
+
+// splitIntoChunks splits the text into chunks of at most maxTokens, preferably
+// between paragraphs, then between lines and only as a last resort in the middle
+// of a line.
+func splitIntoChunks(text string, maxTokens int) []string {
+	maxChars := maxTokens * charsPerToken
+
+	var pieces []string
+	for _, paragraph := range strings.SplitAfter(text, "\n\n") {
+		if len(paragraph) <= maxChars {
+			pieces = append(pieces, paragraph)
+			continue
+		}
+		for _, line := range strings.SplitAfter(paragraph, "\n") {
+			for len(line) > maxChars {
+				cut := runeBoundary(line, maxChars)
+				pieces = append(pieces, line[:cut])
+				line = line[cut:]
+			}
+			pieces = append(pieces, line)
+		}
+	}
+
+	var chunks []string
+	var chunk strings.Builder
+	for _, piece := range pieces {
+		if chunk.Len()+len(piece) > maxChars && chunk.Len() > 0 {
+			chunks = append(chunks, chunk.String())
+			chunk.Reset()
+		}
+		chunk.WriteString(piece)
+	}
+	if strings.TrimSpace(chunk.String()) != "" {
+		chunks = append(chunks, chunk.String())
+	}
+	return chunks
+}
+
+// GenerateMetadata asks the LLM for the metadata of the file content. Content
+// over the per file cap is truncated, and content larger than a chunk is
+// summarized chunk by chunk (map) before the partial metadata is merged into
+// the metadata of the whole file (reduce).
+func GenerateMetadata(ctx context.Context, provider llm.Provider, config *config.Config, relativeFilePath string, content []byte) (string, error) {
+	text := string(content)
+
+	if maxTokens := config.Enrichment.MaxTokensPerFile; maxTokens > 0 && countTokens(text) > maxTokens {
+		log.Printf("File %s exceeds %d tokens, only its beginning is enriched\n", relativeFilePath, maxTokens)
+		text = truncateToTokens(text, maxTokens)
+	}
+
+	chunkTokens := config.Enrichment.ChunkTokens
+	if chunkTokens <= 0 || countTokens(text) <= chunkTokens {
+		metadataContent, err := openai.GetChatCompletionForMetadata(ctx, provider, relativeFilePath, text)
+		if err != nil {
+			return "", llmError("get metadata", relativeFilePath, err)
+		}
+		return metadataContent, nil
+	}
+
+	chunks := splitIntoChunks(text, chunkTokens)
+	log.Printf("File %s is enriched in %d chunks\n", relativeFilePath, len(chunks))
+
+	partials := make([]string, 0, len(chunks))
+	for i, chunk := range chunks {
+		chunkPath := fmt.Sprintf("%s (part %d of %d)", relativeFilePath, i+1, len(chunks))
+		partial, err := openai.GetChatCompletionForMetadata(ctx, provider, chunkPath, chunk)
+		if err != nil {
+			return "", llmError("get chunk metadata", relativeFilePath, err)
+		}
+		partials = append(partials, partial)
+	}
+
+	metadataContent, err := openai.GetChatCompletionForMetadataReduce(ctx, provider, relativeFilePath, partials)
+	if err != nil {
+		return "", llmError("reduce metadata", relativeFilePath, err)
+	}
+	return metadataContent, nil
+}
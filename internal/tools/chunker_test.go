@@ -0,0 +1,74 @@
+package tools
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitIntoChunks(t *testing.T) {
+	paragraph := strings.Repeat("word ", 15) + "\n\n"
+	tests := []struct {
+		name      string
+		text      string
+		maxTokens int
+		want      []string
+	}{
+		{name: "fits in one chunk", text: "short\n\ntext", maxTokens: 10, want: []string{"short\n\ntext"}},
+		{name: "empty", text: "", maxTokens: 10, want: nil},
+		{name: "blank", text: "\n\n  \n", maxTokens: 10, want: nil},
+		{
+			name:      "between paragraphs",
+			text:      paragraph + paragraph + paragraph,
+			maxTokens: 40,
+			want:      []string{paragraph + paragraph, paragraph},
+		},
+		{
+			name:      "between lines of a long paragraph",
+			text:      "aaaaaaa\nbbbbbbb\nccccccc\n",
+			maxTokens: 3,
+			want:      []string{"aaaaaaa\n", "bbbbbbb\n", "ccccccc\n"},
+		},
+		{
+			name:      "in the middle of a long line",
+			text:      strings.Repeat("x", 20),
+			maxTokens: 2,
+			want:      []string{"xxxxxxxx", "xxxxxxxx", "xxxx"},
+		},
+		{
+			name:      "at a rune boundary",
+			text:      "ééééé",
+			maxTokens: 1,
+			want:      []string{"éé", "éé", "é"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := splitIntoChunks(test.text, test.maxTokens)
+			if strings.Join(got, "|") != strings.Join(test.want, "|") || len(got) != len(test.want) {
+				t.Fatalf("splitIntoChunks(%q, %d) = %q, want %q", test.text, test.maxTokens, got, test.want)
+			}
+			for _, chunk := range got {
+				if len(chunk) > test.maxTokens*charsPerToken {
+					t.Errorf("chunk %q is over %d tokens", chunk, test.maxTokens)
+				}
+			}
+		})
+	}
+}
+
+func TestTruncateToTokens(t *testing.T) {
+	tests := []struct {
+		text      string
+		maxTokens int
+		want      string
+	}{
+		{text: "short", maxTokens: 10, want: "short"},
+		{text: "line one\nline two\nline three", maxTokens: 5, want: "line one\nline two"},
+		{text: strings.Repeat("x", 20), maxTokens: 2, want: "xxxxxxxx"},
+	}
+	for _, test := range tests {
+		if got := truncateToTokens(test.text, test.maxTokens); got != test.want {
+			t.Errorf("truncateToTokens(%q, %d) = %q, want %q", test.text, test.maxTokens, got, test.want)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package tools
 
 import (
+	"context"
 	"log"
 	"os"
 	"path/filepath"
@@ -27,7 +28,7 @@ func walkAndNormalizeFiles(root string, skipNamesMap map[string]struct{}) error
 				if normalizedFileName != info.Name() {
 					newPath := filepath.Join(filepath.Dir(path), normalizedFileName)
 					if err := os.Rename(path, newPath); err != nil {
-						log.Fatalf("Error renaming file: %v\n", err)
+						return permanentError("rename", path, err)
 					} else {
 						log.Printf("Renamed file: %s to %s\n", path, newPath)
 					}
@@ -50,7 +51,7 @@ func normalizeFileName(name string) string {
 	return normalized
 }
 
-func CleanAssets(config *config.Config, relativeFilePath string) string {
+func CleanAssets(config *config.Config, relativeFilePath string) (string, error) {
 	// log.Println(fmt.Sprintf("Running AssetsCleaner tool for file: %s", relativeFilePath))
 
 	skipNames := []string{".git", "0-description", "0-babel", "metadata_index", "z-metadata"}
@@ -60,13 +61,11 @@ func CleanAssets(config *config.Config, relativeFilePath string) string {
 	oldPath := filepath.Join(root, relativeFilePath)
 
 	info, err := os.Stat(oldPath)
-	if os.IsNotExist(err) {
-		log.Fatalf("path does not exist: %v", err)
-	} else if err != nil {
-		log.Fatalf("failed to get file info: %v", err)
+	if err != nil {
+		return relativeFilePath, permanentError("clean assets", relativeFilePath, err)
 	}
 	if info.IsDir() {
-		return relativeFilePath
+		return relativeFilePath, nil
 	}
 
 	if _, found := skipNamesMap[info.Name()]; !found {
@@ -78,13 +77,44 @@ func CleanAssets(config *config.Config, relativeFilePath string) string {
 			newPath := common.NewString(oldPath).ReplaceAll(filename, normalizedFileName).Value()
 			//newPath := filepath.Join(root, normalizedFileName)
 			if err := os.Rename(oldPath, newPath); err != nil {
-				common.Check(err, "Failed to rename file")
-			} else {
-				log.Printf("Renamed file: %s to %s\n", oldPath, newPath)
+				return relativeFilePath, permanentError("rename", relativeFilePath, err)
 			}
-			return normalizedFilePath
+			log.Printf("Renamed file: %s to %s\n", oldPath, newPath)
+			return normalizedFilePath, nil
 		}
 	}
 
-	return relativeFilePath
+	return relativeFilePath, nil
+}
+
+type AssetsCleaner struct {
+	config *config.Config
+}
+
+func NewAssetsCleaner(config *config.Config) *AssetsCleaner {
+	return &AssetsCleaner{config: config}
+}
+
+func (t *AssetsCleaner) Name() string {
+	return "assets_cleaner"
+}
+
+func (t *AssetsCleaner) Enabled() bool {
+	return t.config.Tools.AssetsCleanerEnabled
+}
+
+func (t *AssetsCleaner) DependsOn() []string {
+	return nil
+}
+
+func (t *AssetsCleaner) HandleFile(ctx context.Context, change *FileChange) error {
+	if change.IsDeleted() {
+		return nil
+	}
+	normalizedFilePath, err := CleanAssets(t.config, change.Path)
+	if err != nil {
+		return err
+	}
+	change.Path = normalizedFilePath
+	return nil
 }
@@ -0,0 +1,348 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/margostino/babel-agent/internal/config"
+	"github.com/margostino/babel-agent/internal/llm"
+	"github.com/margostino/babel-agent/internal/openai"
+	"github.com/margostino/babel-agent/internal/version"
+)
+
+// NoteChangeKind is how a commit changes a note.
+type NoteChangeKind string
+
+const (
+	NoteAdded    NoteChangeKind = "added"
+	NoteModified NoteChangeKind = "modified"
+	NoteRenamed  NoteChangeKind = "renamed"
+	NoteDeleted  NoteChangeKind = "deleted"
+)
+
+// noteChangeKinds are the kinds in the order the changes are listed.
+var noteChangeKinds = []NoteChangeKind{NoteAdded, NoteModified, NoteRenamed, NoteDeleted}
+
+const (
+	// subjectWidth is the length commit subjects are cut to.
+	subjectWidth = 72
+	// commitSummaryWidth is the length the summaries of the notes are cut to in
+	// commit messages.
+	commitSummaryWidth = 100
+)
+
+// NoteChange is a note changed by a commit. From is the previous path of a
+// renamed note, Summary the summary of its metadata when it has one.
+type NoteChange struct {
+	Kind    NoteChangeKind
+	Path    string
+	From    string
+	Summary string
+}
+
+func (c *NoteChange) String() string {
+	text := fmt.Sprintf("%s %s", c.Kind, c.Path)
+	if c.Kind == NoteRenamed {
+		text = fmt.Sprintf("%s %s -> %s", c.Kind, c.From, c.Path)
+	}
+	if c.Summary != "" {
+		text = fmt.Sprintf("%s: %s", text, c.Summary)
+	}
+	return text
+}
+
+// stagedNoteChanges returns the changes of the notes staged for the next commit,
+// ordered by kind and path. A note deleted while another one is added with the
+// same content is renamed.
+func stagedNoteChanges(config *config.Config, repo *git.Repository, status git.Status) ([]*NoteChange, error) {
+	var added, deleted []string
+	var changes []*NoteChange
+	for file, fileStatus := range status {
+		if !isValidForMetadata(file) {
+			continue
+		}
+		switch fileStatus.Staging {
+		case git.Added:
+			added = append(added, file)
+		case git.Deleted:
+			deleted = append(deleted, file)
+		case git.Modified:
+			changes = append(changes, &NoteChange{Kind: NoteModified, Path: file})
+		}
+	}
+
+	renamedFrom, err := detectRenames(repo, added, deleted)
+	if err != nil {
+		return nil, err
+	}
+	renamed := map[string]struct{}{}
+	for file, from := range renamedFrom {
+		changes = append(changes, &NoteChange{Kind: NoteRenamed, Path: file, From: from})
+		renamed[from] = struct{}{}
+	}
+	for _, file := range added {
+		if _, found := renamedFrom[file]; !found {
+			changes = append(changes, &NoteChange{Kind: NoteAdded, Path: file})
+		}
+	}
+	for _, file := range deleted {
+		if _, found := renamed[file]; !found {
+			changes = append(changes, &NoteChange{Kind: NoteDeleted, Path: file})
+		}
+	}
+
+	for _, change := range changes {
+		if change.Kind == NoteDeleted {
+			continue
+		}
+		// The summary only makes the message more descriptive, a note without
+		// readable metadata is listed without it.
+		if data, err := ReadMetadata(config, change.Path); err == nil && data != nil {
+			summary, _ := data["summary"].(string)
+			change.Summary = truncate(strings.Join(strings.Fields(summary), " "), commitSummaryWidth)
+		}
+	}
+
+	order := map[NoteChangeKind]int{}
+	for i, kind := range noteChangeKinds {
+		order[kind] = i
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Kind != changes[j].Kind {
+			return order[changes[i].Kind] < order[changes[j].Kind]
+		}
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+// detectRenames pairs the added notes with deleted ones of the same content, by
+// comparing their blobs in the index and in HEAD. It returns the previous path
+// of every renamed note.
+func detectRenames(repo *git.Repository, added []string, deleted []string) (map[string]string, error) {
+	renamedFrom := map[string]string{}
+	if len(added) == 0 || len(deleted) == 0 {
+		return renamedFrom, nil
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return nil, transientError("get current HEAD", "", err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, transientError("get local commit", "", err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, transientError("get local tree", "", err)
+	}
+	deletedByHash := map[plumbing.Hash][]string{}
+	for _, file := range deleted {
+		entry, err := tree.FindEntry(file)
+		if err != nil {
+			continue
+		}
+		deletedByHash[entry.Hash] = append(deletedByHash[entry.Hash], file)
+	}
+
+	index, err := repo.Storer.Index()
+	if err != nil {
+		return nil, transientError("read git index", "", err)
+	}
+	sort.Strings(added)
+	for _, file := range added {
+		entry, err := index.Entry(file)
+		if err != nil {
+			continue
+		}
+		if candidates := deletedByHash[entry.Hash]; len(candidates) > 0 {
+			renamedFrom[file] = candidates[0]
+			deletedByHash[entry.Hash] = candidates[1:]
+		}
+	}
+	return renamedFrom, nil
+}
+
+// CommitInfo is the data the commit message template is executed with.
+type CommitInfo struct {
+	// Added, Modified and Deleted count the staged files, notes or not.
+	Added    int
+	Modified int
+	Deleted  int
+	// Folders are the changed notes grouped by PARA folder, in PARA order.
+	Folders   []*FolderChanges
+	Hostname  string
+	Timestamp time.Time
+	Version   string
+}
+
+// FolderChanges are the paths of the changed notes of a PARA folder.
+type FolderChanges struct {
+	Folder string
+	Paths  []string
+}
+
+// newCommitInfo describes the changes staged in the status for a commit made at
+// the given time.
+func newCommitInfo(status git.Status, now time.Time) *CommitInfo {
+	info := &CommitInfo{Hostname: hostname(), Timestamp: now, Version: version.Version}
+	paths := map[string][]string{}
+	for file, fileStatus := range status {
+		switch fileStatus.Staging {
+		case git.Added:
+			info.Added++
+		case git.Deleted:
+			info.Deleted++
+		case git.Modified:
+			info.Modified++
+		default:
+			continue
+		}
+		if isValidForMetadata(file) {
+			folder, _, _ := strings.Cut(file, "/")
+			paths[folder] = append(paths[folder], file)
+		}
+	}
+	for _, folder := range paraFolders {
+		if len(paths[folder]) > 0 {
+			sort.Strings(paths[folder])
+			info.Folders = append(info.Folders, &FolderChanges{Folder: folder, Paths: paths[folder]})
+		}
+	}
+	return info
+}
+
+// renderMessage executes the message of the configuration, a text/template, with
+// the commit info. The template is parsed when the configuration is loaded, but
+// it can still fail to render, e.g. with an unknown field: that is a fatal
+// error, every commit would fail until the configuration is fixed.
+func renderMessage(config *config.Config, info *CommitInfo) (string, error) {
+	tmpl, err := config.MessageTemplate()
+	if err != nil {
+		return "", fatalError("parse commit message template", err)
+	}
+	var message strings.Builder
+	if err := tmpl.Execute(&message, info); err != nil {
+		return "", fatalError("render commit message template", err)
+	}
+	if strings.TrimSpace(message.String()) == "" {
+		return "", fatalError("render commit message template", errors.New("the message is empty"))
+	}
+	return message.String(), nil
+}
+
+// commitMessage returns the message of a commit of the note changes. Unless
+// generateMessage is set, it is the configured message template rendered with
+// the commit info. Otherwise the LLM writes the subject from the changes and
+// the body lists them; when the LLM is unavailable the subject is made from
+// the changes themselves.
+func commitMessage(ctx context.Context, config *config.Config, provider llm.Provider, changes []*NoteChange, info *CommitInfo) (string, error) {
+	if !config.Repository.GenerateMessage || len(changes) == 0 {
+		return renderMessage(config, info)
+	}
+
+	subject := ""
+	if provider != nil {
+		lines := make([]string, 0, len(changes))
+		for _, change := range changes {
+			lines = append(lines, change.String())
+		}
+		answer, err := openai.GetChatCompletionForCommitMessage(ctx, provider, strings.Join(lines, "\n"))
+		if err != nil {
+			log.Printf("Failed to generate the commit message, using the template: %v\n", err)
+		}
+		subject = cleanSubject(answer)
+	}
+	if subject == "" {
+		subject = templateSubject(changes)
+	}
+	return fmt.Sprintf("%s\n\n%s", subject, changesBody(changes)), nil
+}
+
+// templateSubject describes a single change, or counts the changes by kind.
+func templateSubject(changes []*NoteChange) string {
+	if len(changes) == 1 {
+		change := changes[0]
+		switch change.Kind {
+		case NoteAdded:
+			return truncate(fmt.Sprintf("Add %s", change.Path), subjectWidth)
+		case NoteModified:
+			return truncate(fmt.Sprintf("Update %s", change.Path), subjectWidth)
+		case NoteRenamed:
+			return truncate(fmt.Sprintf("Rename %s to %s", change.From, change.Path), subjectWidth)
+		case NoteDeleted:
+			return truncate(fmt.Sprintf("Delete %s", change.Path), subjectWidth)
+		}
+	}
+
+	counts := map[NoteChangeKind]int{}
+	for _, change := range changes {
+		counts[change.Kind]++
+	}
+	var parts []string
+	for _, kind := range noteChangeKinds {
+		if counts[kind] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[kind], kind))
+		}
+	}
+	return fmt.Sprintf("Update %d notes: %s", len(changes), strings.Join(parts, ", "))
+}
+
+// changesBody lists the changes grouped by kind.
+func changesBody(changes []*NoteChange) string {
+	var body strings.Builder
+	var kind NoteChangeKind
+	for _, change := range changes {
+		if change.Kind != kind {
+			if kind != "" {
+				body.WriteString("\n")
+			}
+			kind = change.Kind
+			fmt.Fprintf(&body, "%s%s:\n", strings.ToUpper(string(kind[:1])), kind[1:])
+		}
+		line := change.Path
+		if change.Kind == NoteRenamed {
+			line = fmt.Sprintf("%s -> %s", change.From, change.Path)
+		}
+		if change.Summary != "" {
+			line = fmt.Sprintf("%s: %s", line, change.Summary)
+		}
+		fmt.Fprintf(&body, "- %s\n", line)
+	}
+	return body.String()
+}
+
+// cleanSubject keeps the first line of the answer, without the quotes, markdown
+// and trailing period models tend to add.
+func cleanSubject(answer string) string {
+	for _, line := range strings.Split(answer, "\n") {
+		line = strings.Trim(line, " \t\"'`*#")
+		line = strings.TrimSpace(strings.TrimSuffix(line, "."))
+		if line != "" {
+			return truncate(line, subjectWidth)
+		}
+	}
+	return ""
+}
+
+// truncate cuts the text to the given number of characters, at a word boundary
+// when there is one.
+func truncate(text string, width int) string {
+	runes := []rune(text)
+	if len(runes) <= width {
+		return text
+	}
+	cut := string(runes[:width-3])
+	if space := strings.LastIndex(cut, " "); space > width/2 {
+		cut = cut[:space]
+	}
+	return cut + "..."
+}
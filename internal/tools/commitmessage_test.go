@@ -0,0 +1,190 @@
+package tools
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/margostino/babel-agent/internal/config"
+)
+
+func TestTemplateSubject(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes []*NoteChange
+		want    string
+	}{
+		{name: "added", changes: []*NoteChange{{Kind: NoteAdded, Path: "RESOURCES/go"}}, want: "Add RESOURCES/go"},
+		{name: "modified", changes: []*NoteChange{{Kind: NoteModified, Path: "RESOURCES/go"}}, want: "Update RESOURCES/go"},
+		{name: "renamed", changes: []*NoteChange{{Kind: NoteRenamed, From: "0-INBOX/go", Path: "RESOURCES/go"}}, want: "Rename 0-INBOX/go to RESOURCES/go"},
+		{name: "deleted", changes: []*NoteChange{{Kind: NoteDeleted, Path: "RESOURCES/go"}}, want: "Delete RESOURCES/go"},
+		{
+			name: "several",
+			changes: []*NoteChange{
+				{Kind: NoteAdded, Path: "RESOURCES/go"},
+				{Kind: NoteAdded, Path: "RESOURCES/rust"},
+				{Kind: NoteDeleted, Path: "A-ARCHIVES/old"},
+			},
+			want: "Update 3 notes: 2 added, 1 deleted",
+		},
+		{
+			name:    "long path",
+			changes: []*NoteChange{{Kind: NoteAdded, Path: "RESOURCES/" + strings.Repeat("x", 80)}},
+			want:    "Add RESOURCES/" + strings.Repeat("x", subjectWidth-3-len("Add RESOURCES/")) + "...",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := templateSubject(test.changes); got != test.want {
+				t.Errorf("templateSubject() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCleanSubject(t *testing.T) {
+	tests := []struct {
+		answer string
+		want   string
+	}{
+		{answer: "Add notes on Go channels", want: "Add notes on Go channels"},
+		{answer: "\"Add notes on Go channels.\"", want: "Add notes on Go channels"},
+		{answer: "\n**Add notes on Go channels**\n\nThe notes cover...", want: "Add notes on Go channels"},
+		{answer: "# `Rename the inbox note`", want: "Rename the inbox note"},
+		{answer: "  \n\"\"\n", want: ""},
+		{answer: strings.Repeat("word ", 20), want: strings.TrimSpace(strings.Repeat("word ", 13)) + "..."},
+	}
+	for _, test := range tests {
+		if got := cleanSubject(test.answer); got != test.want {
+			t.Errorf("cleanSubject(%q) = %q, want %q", test.answer, got, test.want)
+		}
+	}
+}
+
+func TestChangesBody(t *testing.T) {
+	changes := []*NoteChange{
+		{Kind: NoteAdded, Path: "RESOURCES/go", Summary: "Channels and goroutines"},
+		{Kind: NoteAdded, Path: "RESOURCES/rust"},
+		{Kind: NoteRenamed, From: "0-INBOX/idea", Path: "PROJECTS/idea"},
+		{Kind: NoteDeleted, Path: "A-ARCHIVES/old"},
+	}
+	want := "Added:\n" +
+		"- RESOURCES/go: Channels and goroutines\n" +
+		"- RESOURCES/rust\n" +
+		"\nRenamed:\n" +
+		"- 0-INBOX/idea -> PROJECTS/idea\n" +
+		"\nDeleted:\n" +
+		"- A-ARCHIVES/old\n"
+	if got := changesBody(changes); got != want {
+		t.Errorf("changesBody() = %q, want %q", got, want)
+	}
+}
+
+func TestCommitMessageWithoutProvider(t *testing.T) {
+	c := &config.Config{}
+	c.Repository.Message = "Babel update"
+	c.Repository.GenerateMessage = true
+	changes := []*NoteChange{{Kind: NoteModified, Path: "RESOURCES/go", Summary: "Channels"}}
+
+	got, err := commitMessage(context.Background(), c, nil, changes, &CommitInfo{Modified: 1})
+	if err != nil {
+		t.Fatalf("commitMessage() error = %v", err)
+	}
+	if want := "Update RESOURCES/go\n\nModified:\n- RESOURCES/go: Channels\n"; got != want {
+		t.Errorf("commitMessage() = %q, want %q", got, want)
+	}
+
+	// Without note changes, e.g. when only z-metadata changed, the template is
+	// used.
+	got, err = commitMessage(context.Background(), c, nil, nil, &CommitInfo{})
+	if err != nil || got != "Babel update" {
+		t.Errorf("commitMessage() without changes = %q, %v, want the template", got, err)
+	}
+}
+
+func TestNewCommitInfo(t *testing.T) {
+	status := git.Status{
+		"RESOURCES/go":        {Staging: git.Modified},
+		"RESOURCES/cli":       {Staging: git.Added},
+		"0-INBOX/idea":        {Staging: git.Added},
+		"A-ARCHIVES/old":      {Staging: git.Deleted},
+		"z-metadata/index":    {Staging: git.Modified},
+		"README.md":           {Staging: git.Added},
+		"PROJECTS/unstaged":   {Staging: git.Unmodified, Worktree: git.Modified},
+		"PROJECTS/untracked":  {Staging: git.Untracked, Worktree: git.Untracked},
+		"AREAS/health/sleep":  {Staging: git.Modified},
+		"RESOURCES/go/guides": {Staging: git.Deleted},
+	}
+	now := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+
+	info := newCommitInfo(status, now)
+	if info.Added != 3 || info.Modified != 3 || info.Deleted != 2 {
+		t.Errorf("counts = %d added %d modified %d deleted, want 3, 3 and 2", info.Added, info.Modified, info.Deleted)
+	}
+	want := []*FolderChanges{
+		{Folder: "0-INBOX", Paths: []string{"0-INBOX/idea"}},
+		{Folder: "AREAS", Paths: []string{"AREAS/health/sleep"}},
+		{Folder: "RESOURCES", Paths: []string{"RESOURCES/cli", "RESOURCES/go", "RESOURCES/go/guides"}},
+		{Folder: "A-ARCHIVES", Paths: []string{"A-ARCHIVES/old"}},
+	}
+	if !reflect.DeepEqual(info.Folders, want) {
+		t.Errorf("folders = %v, want %v", info.Folders, want)
+	}
+	if !info.Timestamp.Equal(now) || info.Hostname == "" || info.Version == "" {
+		t.Errorf("info = %+v, want the timestamp, hostname and version", info)
+	}
+}
+
+func TestRenderMessage(t *testing.T) {
+	info := &CommitInfo{
+		Added:     1,
+		Modified:  2,
+		Folders:   []*FolderChanges{{Folder: "RESOURCES", Paths: []string{"RESOURCES/cli", "RESOURCES/go"}}},
+		Hostname:  "laptop",
+		Timestamp: time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC),
+		Version:   "1.2.3",
+	}
+	tests := []struct {
+		name    string
+		message string
+		want    string
+		fatal   bool
+	}{
+		{name: "plain text", message: "Babel update", want: "Babel update"},
+		{
+			name:    "counts and host",
+			message: "Babel update from {{.Hostname}} ({{.Added}} added, {{.Modified}} modified, {{.Deleted}} deleted)",
+			want:    "Babel update from laptop (1 added, 2 modified, 0 deleted)",
+		},
+		{
+			name:    "folders, join and time",
+			message: `{{range .Folders}}{{.Folder}}: {{join .Paths ", "}}{{end}} at {{.Timestamp.Format "2006-01-02"}} by {{.Version}}`,
+			want:    "RESOURCES: RESOURCES/cli, RESOURCES/go at 2024-05-01 by 1.2.3",
+		},
+		{name: "parse error", message: "Babel update {{.Hostname", fatal: true},
+		{name: "unknown field", message: "Babel update {{.Author}}", fatal: true},
+		{name: "empty message", message: "{{if .Deleted}}deleted{{end}}  ", fatal: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &config.Config{}
+			c.Repository.Message = test.message
+			got, err := renderMessage(c, info)
+			if test.fatal {
+				if KindOf(err) != Fatal {
+					t.Fatalf("renderMessage() error = %v, want a fatal error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("renderMessage() error = %v", err)
+			}
+			if strings.TrimSpace(got) != test.want {
+				t.Errorf("renderMessage() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
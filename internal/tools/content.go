@@ -0,0 +1,112 @@
+package tools
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/margostino/babel-agent/internal/metadata"
+	"github.com/margostino/babel-agent/internal/openai"
+	"github.com/margostino/babel-agent/internal/state"
+)
+
+// normalizeContent removes the differences that do not change the meaning of a
+// note: line endings, trailing whitespace, repeated blank lines and the front
+// matter block, which holds metadata rather than content.
+func normalizeContent(content []byte) []byte {
+	text := strings.ReplaceAll(string(content), "\r\n", "\n")
+	text = stripFrontMatter(text)
+
+	var normalized bytes.Buffer
+	blank := false
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, " \t")
+		if line == "" {
+			if blank {
+				continue
+			}
+			blank = true
+		} else {
+			blank = false
+		}
+		normalized.WriteString(line)
+		normalized.WriteByte('\n')
+	}
+
+	return bytes.TrimSpace(normalized.Bytes())
+}
+
+func stripFrontMatter(text string) string {
+	if !strings.HasPrefix(text, "---\n") {
+		return text
+	}
+	end := strings.Index(text[4:], "\n---")
+	if end == -1 {
+		return text
+	}
+	rest := text[4+end+len("\n---"):]
+	return strings.TrimPrefix(rest, "\n")
+}
+
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// metadataVersion is the version of the prompt and of the schema metadata is
+// generated with. Metadata generated with another version is outdated.
+type metadataVersion struct {
+	prompt string
+	schema int
+}
+
+func currentMetadataVersion() (metadataVersion, error) {
+	promptVersion, err := openai.GetPromptVersion()
+	if err != nil {
+		return metadataVersion{}, fatalError("get prompt version", err)
+	}
+	schema, err := metadata.LoadSchema()
+	if err != nil {
+		return metadataVersion{}, fatalError("load metadata schema", err)
+	}
+	return metadataVersion{prompt: promptVersion, schema: schema.Version}, nil
+}
+
+// enriched reports whether the file has metadata of this version.
+func (v metadataVersion) enriched(fileState *state.FileState) bool {
+	if fileState == nil || fileState.EnrichedAt.IsZero() {
+		return false
+	}
+	return fileState.PromptVersion == v.prompt && fileState.SchemaVersion == v.schema
+}
+
+// metadataCacheKey identifies the metadata generated for a content with a given
+// prompt, schema and model.
+func metadataCacheKey(hash string, version metadataVersion, model string) string {
+	return contentHash([]byte(strings.Join([]string{hash, version.prompt, strconv.Itoa(version.schema), model}, "|")))
+}
+
+// changeRatio returns the share of lines that differ between both contents,
+// from 0 (same lines) to 1 (nothing in common). Line order is ignored, which is
+// enough to tell small edits from rewrites.
+func changeRatio(before []byte, after []byte) float64 {
+	beforeLines := strings.Split(string(before), "\n")
+	afterLines := strings.Split(string(after), "\n")
+
+	counts := make(map[string]int, len(beforeLines))
+	for _, line := range beforeLines {
+		counts[line]++
+	}
+	common := 0
+	for _, line := range afterLines {
+		if counts[line] > 0 {
+			counts[line]--
+			common++
+		}
+	}
+
+	total := max(len(beforeLines), len(afterLines))
+	return float64(total-common) / float64(total)
+}
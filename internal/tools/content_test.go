@@ -0,0 +1,66 @@
+package tools
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNormalizeContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{name: "unchanged", content: "# Title\n\nBody", want: "# Title\n\nBody"},
+		{name: "windows line endings", content: "# Title\r\n\r\nBody\r\n", want: "# Title\n\nBody"},
+		{name: "trailing whitespace", content: "# Title  \n\nBody\t\n", want: "# Title\n\nBody"},
+		{name: "repeated blank lines", content: "# Title\n\n\n\nBody\n\n\n", want: "# Title\n\nBody"},
+		{name: "front matter", content: "---\ntags: [go]\n---\n# Title\n\nBody\n", want: "# Title\n\nBody"},
+		{name: "unterminated front matter is content", content: "---\ntags: [go]\n# Title\n", want: "---\ntags: [go]\n# Title"},
+		{name: "leading blank lines", content: "\n\n# Title\n", want: "# Title"},
+		{name: "empty", content: "", want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := string(normalizeContent([]byte(test.content))); got != test.want {
+				t.Errorf("normalizeContent(%q) = %q, want %q", test.content, got, test.want)
+			}
+		})
+	}
+}
+
+func TestNormalizedContentHash(t *testing.T) {
+	a := contentHash(normalizeContent([]byte("# Title\n\nBody\n")))
+	b := contentHash(normalizeContent([]byte("# Title  \r\n\r\n\r\nBody")))
+	if a != b {
+		t.Errorf("whitespace changes changed the hash: %s != %s", a, b)
+	}
+	if c := contentHash(normalizeContent([]byte("# Title\n\nOther body\n"))); a == c {
+		t.Error("a content change kept the hash")
+	}
+}
+
+func TestChangeRatio(t *testing.T) {
+	tests := []struct {
+		name   string
+		before string
+		after  string
+		want   float64
+	}{
+		{name: "same", before: "a\nb\nc\nd", after: "a\nb\nc\nd", want: 0},
+		{name: "reordered", before: "a\nb\nc\nd", after: "d\nc\nb\na", want: 0},
+		{name: "one line of four changed", before: "a\nb\nc\nd", after: "a\nb\nc\nx", want: 0.25},
+		{name: "one line added", before: "a\nb\nc", after: "a\nb\nc\nd", want: 0.25},
+		{name: "half removed", before: "a\nb\nc\nd", after: "a\nb", want: 0.5},
+		{name: "rewritten", before: "a\nb", after: "x\ny", want: 1},
+		{name: "duplicate lines count once each", before: "a\na\nb", after: "a\nb\nb", want: 1.0 / 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := changeRatio([]byte(test.before), []byte(test.after))
+			if math.Abs(got-test.want) > 1e-9 {
+				t.Errorf("changeRatio(%q, %q) = %v, want %v", test.before, test.after, got, test.want)
+			}
+		})
+	}
+}
@@ -2,85 +2,95 @@ package tools
 
 import (
 	"context"
-	"errors"
-	"log"
+	"fmt"
 
-	"github.com/margostino/babel-agent/internal/config"
-	"github.com/weaviate/weaviate-go-client/v4/weaviate"
-	"github.com/weaviate/weaviate-go-client/v4/weaviate/filters"
-	"github.com/weaviate/weaviate-go-client/v4/weaviate/graphql"
+	"github.com/go-openapi/strfmt"
+	"github.com/margostino/babel-agent/internal/db"
+	"github.com/weaviate/weaviate/entities/models"
 )
 
-func GetObject(dbClient *weaviate.Client, config *config.Config, relativeFilePath string) (*string, error) {
-	where := filters.Where().
-		WithPath([]string{"path"}).
-		WithOperator(filters.Equal).
-		WithValueText(relativeFilePath)
+// defaultBatchSize is the number of objects written per request when the
+// configuration sets none.
+const defaultBatchSize = 100
 
-	query := dbClient.GraphQL().Get().WithClassName("Babel").
-		WithLimit(1).
-		WithWhere(where).
-		WithFields(
-			graphql.Field{Name: "path"},
-			graphql.Field{Name: "_additional{id}"},
-		)
-
-	// Execute the query
-	response, err := query.Do(context.Background())
-	if err != nil {
-		log.Fatalf("failed to execute query: %v", err)
+// metadataObject returns the object of the note, under the ID derived from its
+// path. It also records the hash of the content the metadata was generated from.
+func metadataObject(relativeFilePath string, data map[string]interface{}, hash string) *models.Object {
+	properties := make(map[string]interface{}, len(data)+1)
+	for key, value := range data {
+		properties[key] = value
 	}
-
-	// Process the response
-	if len(response.Errors) > 0 {
-		log.Fatalf("query returned errors: %v", response.Errors)
+	properties["content_hash"] = hash
+	return &models.Object{
+		Class:      db.ClassName,
+		ID:         strfmt.UUID(db.ObjectID(relativeFilePath)),
+		Properties: properties,
 	}
+}
 
-	results := response.Data["Get"].(map[string]interface{})["Babel"].([]interface{})
-	if len(results) > 0 {
-		result := results[0].(map[string]interface{})
-		additional := result["_additional"].(map[string]interface{})
-		id := additional["id"].(string)
-		return &id, nil
+// chunkObjects returns the objects of the passages of the note, under IDs
+// derived from its path and their position. Hash is the hash of the normalized
+// content of the note, which tells the chunks of this content from stale ones.
+func chunkObjects(relativeFilePath string, content []byte, hash string, maxTokens int) []*models.Object {
+	parent := []interface{}{
+		map[string]interface{}{"beacon": fmt.Sprintf("weaviate://localhost/%s/%s", db.ClassName, db.ObjectID(relativeFilePath))},
 	}
-
-	return nil, errors.New("No results found")
+	passages := splitMarkdown(string(content), maxTokens)
+	objects := make([]*models.Object, 0, len(passages))
+	for i, passage := range passages {
+		objects = append(objects, &models.Object{
+			Class: db.ChunkClassName,
+			ID:    strfmt.UUID(db.ChunkID(relativeFilePath, i)),
+			Properties: map[string]interface{}{
+				"path":         relativeFilePath,
+				"heading":      passage.Heading,
+				"content":      passage.Content,
+				"chunk_index":  i,
+				"start_offset": passage.Start,
+				"end_offset":   passage.End,
+				"content_hash": hash,
+				"parent":       parent,
+			},
+		})
+	}
+	return objects
 }
 
-func DeleteObject(dbClient *weaviate.Client, id string) {
-	err := dbClient.Data().Deleter().
-		WithClassName("Babel").
-		WithID(id).
-		Do(context.Background())
-
-	if err != nil {
-		log.Printf("failed to delete object: %v", err)
+// DeleteChunks deletes the chunks of the note, except the ones cut from the
+// content with the given hash when it is not empty.
+func DeleteChunks(ctx context.Context, storage db.Storage, relativeFilePath string, keepHash string) error {
+	where := []db.Condition{{Property: "path", Operator: db.Equal, Values: []string{relativeFilePath}}}
+	if keepHash != "" {
+		where = append(where, db.Condition{Property: "content_hash", Operator: db.NotEqual, Values: []string{keepHash}})
 	}
+	if err := storage.DeleteWhere(ctx, db.ChunkClassName, where); err != nil {
+		return transientError("delete chunks", relativeFilePath, err)
+	}
+	return nil
 }
 
-func UpdateObject(dbClient *weaviate.Client, id string, metadata map[string]interface{}) {
-	err := dbClient.Data().Updater().
-		WithMerge().
-		WithID(id).
-		WithClassName("Babel").
-		WithProperties(metadata).
-		Do(context.Background())
-
-	if err != nil {
-		log.Printf("failed to update object: %v", err)
+// DeleteObject deletes the object, an object that does not exist is already
+// deleted.
+func DeleteObject(ctx context.Context, storage db.Storage, id string) error {
+	if err := storage.Delete(ctx, db.ClassName, id); err != nil {
+		return transientError("delete object", id, err)
 	}
+	return nil
 }
 
-func CreateObject(dbClient *weaviate.Client, metadata map[string]interface{}) {
-
-	w, err := dbClient.Data().Creator().
-		WithClassName("Babel").
-		WithProperties(metadata).
-		Do(context.Background())
-
+// UpsertObjects writes the objects in a single batch request, replacing the
+// objects with the same IDs. It returns the error of every object that failed,
+// keyed by its ID.
+func UpsertObjects(ctx context.Context, storage db.Storage, objects []*models.Object) (map[string]error, error) {
+	if len(objects) == 0 {
+		return nil, nil
+	}
+	failures, err := storage.Upsert(ctx, objects)
 	if err != nil {
-		log.Printf("failed to create object: %v", err)
-	} else {
-		log.Printf("created object: %v", w.Object.ID)
+		return nil, transientError("batch upsert objects", "", err)
+	}
+	for id, err := range failures {
+		failures[id] = transientError("upsert object", id, err)
 	}
+	return failures, nil
 }
@@ -0,0 +1,308 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/margostino/babel-agent/internal/config"
+	"github.com/margostino/babel-agent/internal/db"
+	"github.com/margostino/babel-agent/internal/state"
+	"github.com/weaviate/weaviate/entities/models"
+)
+
+// IssueKind is a kind of drift between the notes, z-metadata and the database.
+type IssueKind string
+
+const (
+	// OrphanedMetadata is a metadata file whose note no longer exists.
+	OrphanedMetadata IssueKind = "orphaned_metadata"
+	// MissingMetadata is a note without a metadata file.
+	MissingMetadata IssueKind = "missing_metadata"
+	// StaleIndexEntry is an index.json entry without a metadata file.
+	StaleIndexEntry IssueKind = "stale_index_entry"
+	// MissingIndexEntry is a metadata file without an index.json entry.
+	MissingIndexEntry IssueKind = "missing_index_entry"
+	// DuplicateObjects are database objects of a note besides the one under the
+	// ID derived from its path.
+	DuplicateObjects IssueKind = "duplicate_objects"
+	// OrphanedObject is a database object whose note no longer exists.
+	OrphanedObject IssueKind = "orphaned_object"
+	// OrphanedChunks are the passages in the database of a note that no longer
+	// exists, e.g. deleted or renamed while the agent was not running.
+	OrphanedChunks IssueKind = "orphaned_chunks"
+	// DanglingObjectID is the object ID of a note with metadata missing in the
+	// database.
+	DanglingObjectID IssueKind = "dangling_object_id"
+)
+
+// Issue is an inconsistency found for a path. Err is set when fixing it failed.
+type Issue struct {
+	Kind      IssueKind `json:"kind"`
+	Path      string    `json:"path"`
+	ObjectIDs []string  `json:"objectIds,omitempty"`
+	Fixed     bool      `json:"fixed"`
+	Err       error     `json:"-"`
+}
+
+func (i *Issue) String() string {
+	if len(i.ObjectIDs) > 0 {
+		return fmt.Sprintf("%s %s %v", i.Kind, i.Path, i.ObjectIDs)
+	}
+	return fmt.Sprintf("%s %s", i.Kind, i.Path)
+}
+
+// objectPageSize is the number of objects listed per database request.
+const objectPageSize = 100
+
+// Doctor checks that the notes, their metadata files, the index and the
+// database objects agree, and reconciles them.
+type Doctor struct {
+	config   *config.Config
+	storage  db.Storage
+	store    *state.Store
+	enricher *MetadataEnricher
+}
+
+func NewDoctor(storage db.Storage, config *config.Config, store *state.Store, enricher *MetadataEnricher) *Doctor {
+	return &Doctor{
+		config:   config,
+		storage:  storage,
+		store:    store,
+		enricher: enricher,
+	}
+}
+
+func readIndexFile(config *config.Config) (map[string]map[string]interface{}, error) {
+	indexData := make(map[string]map[string]interface{})
+	content, err := os.ReadFile(filepath.Join(config.Repository.Path, "z-metadata", "index.json"))
+	if os.IsNotExist(err) {
+		return indexData, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > 0 {
+		err = json.Unmarshal(content, &indexData)
+	}
+	return indexData, err
+}
+
+// listObjects returns the IDs of the database objects of the class grouped by
+// path.
+func listObjects(ctx context.Context, storage db.Storage, class string) (map[string][]string, error) {
+	objects := map[string][]string{}
+	after := ""
+	for {
+		page, err := storage.List(ctx, class, objectPageSize, after)
+		if err != nil {
+			return nil, transientError("list objects", "", err)
+		}
+		for _, object := range page {
+			properties, _ := object.Properties.(map[string]interface{})
+			path, _ := properties["path"].(string)
+			objects[path] = append(objects[path], object.ID.String())
+		}
+		if len(page) < objectPageSize {
+			return objects, nil
+		}
+		after = page[len(page)-1].ID.String()
+	}
+}
+
+// Check returns the inconsistencies between the notes, z-metadata, index.json
+// and the database, ordered by kind and path.
+func (d *Doctor) Check(ctx context.Context) ([]*Issue, error) {
+	files, err := d.enricher.reindexFiles(ReindexOptions{})
+	if err != nil {
+		return nil, err
+	}
+	notes := make(map[string]struct{}, len(files))
+	for _, file := range files {
+		notes[file] = struct{}{}
+	}
+
+	metadataFiles, err := listMetadataFiles(d.config)
+	if err != nil {
+		return nil, permanentError("list metadata files", "", err)
+	}
+	indexData, err := readIndexFile(d.config)
+	if err != nil {
+		return nil, permanentError("read index file", "", err)
+	}
+	objects, err := listObjects(ctx, d.storage, db.ClassName)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := listObjects(ctx, d.storage, db.ChunkClassName)
+	if err != nil {
+		return nil, err
+	}
+
+	var issues []*Issue
+	for path := range metadataFiles {
+		if _, found := notes[path]; !found {
+			issues = append(issues, &Issue{Kind: OrphanedMetadata, Path: path})
+		}
+		if _, found := indexData[path]; !found {
+			issues = append(issues, &Issue{Kind: MissingIndexEntry, Path: path})
+		}
+	}
+	for path := range notes {
+		if _, found := metadataFiles[path]; !found {
+			issues = append(issues, &Issue{Kind: MissingMetadata, Path: path})
+		}
+	}
+	for path := range indexData {
+		if _, found := metadataFiles[path]; !found {
+			issues = append(issues, &Issue{Kind: StaleIndexEntry, Path: path})
+		}
+	}
+
+	objectIDs := map[string]struct{}{}
+	for path, ids := range objects {
+		for _, id := range ids {
+			objectIDs[id] = struct{}{}
+		}
+		if _, found := notes[path]; !found {
+			issues = append(issues, &Issue{Kind: OrphanedObject, Path: path, ObjectIDs: ids})
+			continue
+		}
+		var duplicates []string
+		for _, id := range ids {
+			if id != db.ObjectID(path) {
+				duplicates = append(duplicates, id)
+			}
+		}
+		if len(duplicates) > 0 {
+			issues = append(issues, &Issue{Kind: DuplicateObjects, Path: path, ObjectIDs: duplicates})
+		}
+	}
+	for path, ids := range chunks {
+		if _, found := notes[path]; !found {
+			issues = append(issues, &Issue{Kind: OrphanedChunks, Path: path, ObjectIDs: ids})
+		}
+	}
+	for path := range metadataFiles {
+		_, noteFound := notes[path]
+		if _, found := objectIDs[db.ObjectID(path)]; !found && noteFound {
+			issues = append(issues, &Issue{Kind: DanglingObjectID, Path: path, ObjectIDs: []string{db.ObjectID(path)}})
+		}
+	}
+
+	sort.Slice(issues, func(i, j int) bool {
+		if issues[i].Kind != issues[j].Kind {
+			return issues[i].Kind < issues[j].Kind
+		}
+		return issues[i].Path < issues[j].Path
+	})
+	return issues, nil
+}
+
+// Fix reconciles the issues found by Check. Notes stay the source of truth:
+// metadata, index entries and objects without a note are removed, notes without
+// metadata are enriched and the rest is rebuilt from z-metadata. Failures are
+// recorded in the issues, only fatal errors stop the fix.
+func (d *Doctor) Fix(ctx context.Context, issues []*Issue) error {
+	indexFilePath := filepath.Join(d.config.Repository.Path, "z-metadata", "index.json")
+	missing := &ChangeSet{}
+	missingIssues := map[string]*Issue{}
+
+	for _, issue := range issues {
+		switch issue.Kind {
+		case OrphanedMetadata:
+			metadataFilePath := fmt.Sprintf("%s.json", filepath.Join(d.config.Repository.Path, "z-metadata", issue.Path))
+			if err := os.Remove(metadataFilePath); err != nil && !os.IsNotExist(err) {
+				issue.Err = permanentError("remove metadata", issue.Path, err)
+				break
+			}
+			issue.Err = updateIndexFile(indexFilePath, issue.Path, nil)
+			if issue.Err == nil {
+				issue.Err = d.store.Delete(issue.Path)
+			}
+		case StaleIndexEntry:
+			issue.Err = updateIndexFile(indexFilePath, issue.Path, nil)
+		case MissingIndexEntry:
+			data, err := ReadMetadata(d.config, issue.Path)
+			if err != nil || data == nil {
+				issue.Err = err
+				break
+			}
+			issue.Err = updateIndexFile(indexFilePath, issue.Path, map[string]interface{}{
+				"highlights": data["highlights"],
+				"summary":    data["summary"],
+			})
+		case MissingMetadata:
+			missing.Changes = append(missing.Changes, &FileChange{Path: issue.Path, Status: git.Modified})
+			missingIssues[issue.Path] = issue
+			continue
+		case OrphanedObject:
+			issue.Err = d.deleteObjects(ctx, issue.ObjectIDs)
+		case DuplicateObjects:
+			issue.Err = d.deleteObjects(ctx, issue.ObjectIDs)
+		case OrphanedChunks:
+			issue.Err = DeleteChunks(ctx, d.storage, issue.Path, "")
+		case DanglingObjectID:
+			issue.Err = d.fixDangling(ctx, issue)
+		}
+		if KindOf(issue.Err) == Fatal {
+			return issue.Err
+		}
+		issue.Fixed = issue.Err == nil
+	}
+
+	if len(missing.Changes) == 0 {
+		return nil
+	}
+	if err := d.enricher.HandleChangeSet(ctx, missing); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return fatalError("fix missing metadata", err)
+	}
+	for _, failure := range missing.Failures() {
+		missingIssues[failure.Change.Path].Err = failure.Err
+	}
+	for _, issue := range missingIssues {
+		issue.Fixed = issue.Err == nil
+	}
+	return nil
+}
+
+func (d *Doctor) deleteObjects(ctx context.Context, ids []string) error {
+	for _, id := range ids {
+		if err := DeleteObject(ctx, d.storage, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fixDangling writes the object again from the metadata of the note. Dangling
+// issues sort before duplicates, so a note whose only object has a legacy ID
+// gets its own before the legacy one is deleted.
+func (d *Doctor) fixDangling(ctx context.Context, issue *Issue) error {
+	data, err := ReadMetadata(d.config, issue.Path)
+	if err != nil || data == nil {
+		return err
+	}
+
+	hash := ""
+	fileState, err := d.store.Get(issue.Path)
+	if err != nil {
+		return transientError("get file state", issue.Path, err)
+	}
+	if fileState != nil {
+		hash = fileState.ContentHash
+	}
+	object := metadataObject(issue.Path, data, hash)
+	failures, err := UpsertObjects(ctx, d.storage, []*models.Object{object})
+	if err != nil {
+		return err
+	}
+	return failures[object.ID.String()]
+}
@@ -0,0 +1,70 @@
+package tools_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/margostino/babel-agent/internal/db"
+	"github.com/margostino/babel-agent/internal/testharness"
+	"github.com/margostino/babel-agent/internal/tools"
+)
+
+func TestDoctorRemovesOrphanedChunks(t *testing.T) {
+	h := testharness.New(t, nil)
+	h.Config.Db.ChunkTokens = 50
+	h.Repo.WriteFile("RESOURCES/go", "# Go\n\n## Channels\n\nSend and receive.\n\n## Goroutines\n\nLightweight threads.\n")
+	h.Repo.WriteFile("RESOURCES/rust", "# Rust\n\nOwnership.\n")
+	if _, err := h.UpdateGit(context.Background(), nil); err != nil {
+		t.Fatalf("UpdateGit() = %v", err)
+	}
+	if len(chunkPaths(h)) == 0 {
+		t.Fatal("no chunks were indexed")
+	}
+
+	// The note is deleted while the agent is not running.
+	h.Repo.RemoveFile("RESOURCES/go")
+	enricher := tools.NewMetadataEnricher(h.Storage, h.Provider, h.Config, h.Queue, h.Store)
+	doctor := tools.NewDoctor(h.Storage, h.Config, h.Store, enricher)
+	issues, err := doctor.Check(context.Background())
+	if err != nil {
+		t.Fatalf("Check() = %v", err)
+	}
+	kinds := map[tools.IssueKind]string{}
+	for _, issue := range issues {
+		kinds[issue.Kind] = issue.Path
+	}
+	want := map[tools.IssueKind]string{
+		tools.OrphanedChunks:   "RESOURCES/go",
+		tools.OrphanedMetadata: "RESOURCES/go",
+		tools.OrphanedObject:   "RESOURCES/go",
+	}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Fatalf("issues = %v, want %v", issues, want)
+	}
+
+	if err := doctor.Fix(context.Background(), issues); err != nil {
+		t.Fatalf("Fix() = %v", err)
+	}
+	for _, issue := range issues {
+		if !issue.Fixed {
+			t.Errorf("%s was not fixed: %v", issue, issue.Err)
+		}
+	}
+	if paths := chunkPaths(h); !reflect.DeepEqual(paths, map[string]bool{"RESOURCES/rust": true}) {
+		t.Errorf("paths of the chunks = %v, want only RESOURCES/rust", paths)
+	}
+	if issues, err := doctor.Check(context.Background()); err != nil || len(issues) > 0 {
+		t.Errorf("Check() after fixing = %v, %v", issues, err)
+	}
+}
+
+// chunkPaths returns the paths of the notes with chunks in the database.
+func chunkPaths(h *testharness.Harness) map[string]bool {
+	paths := map[string]bool{}
+	for _, object := range h.Weaviate.Objects(db.ChunkClassName) {
+		path, _ := object.Properties["path"].(string)
+		paths[path] = true
+	}
+	return paths
+}
@@ -0,0 +1,107 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/margostino/babel-agent/internal/llm"
+)
+
+// ErrorKind tells the agent how to react to a failure.
+type ErrorKind int
+
+const (
+	// Transient errors (network, rate limits, remote unavailable) are retried in
+	// a later cycle.
+	Transient ErrorKind = iota
+	// Permanent errors affect a single file and are not retried until the file
+	// changes again.
+	Permanent
+	// Fatal errors leave the agent unable to work, e.g. a missing repository.
+	Fatal
+	// Conflict errors are local and remote changes the configured strategy does
+	// not integrate. Syncing stops until they are resolved by hand.
+	Conflict
+	// Offline errors are a remote that cannot be reached. Local changes keep
+	// being committed and are pushed once the remote is reachable again.
+	Offline
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case Transient:
+		return "transient"
+	case Permanent:
+		return "permanent"
+	case Fatal:
+		return "fatal"
+	case Conflict:
+		return "conflict"
+	case Offline:
+		return "offline"
+	default:
+		return "unknown"
+	}
+}
+
+type Error struct {
+	Kind ErrorKind
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Path != "" {
+		return fmt.Sprintf("%s %s: %v", e.Op, e.Path, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func transientError(op string, path string, err error) error {
+	return &Error{Kind: Transient, Op: op, Path: path, Err: err}
+}
+
+func permanentError(op string, path string, err error) error {
+	return &Error{Kind: Permanent, Op: op, Path: path, Err: err}
+}
+
+func fatalError(op string, err error) error {
+	return &Error{Kind: Fatal, Op: op, Err: err}
+}
+
+func conflictError(op string, err error) error {
+	return &Error{Kind: Conflict, Op: op, Err: err}
+}
+
+func offlineError(op string, err error) error {
+	return &Error{Kind: Offline, Op: op, Err: err}
+}
+
+// llmError classifies an error returned by the LLM client: client errors other
+// than rate limiting are permanent, everything else is worth retrying.
+func llmError(op string, path string, err error) error {
+	var apiErr *llm.ApiError
+	if errors.As(err, &apiErr) && apiErr.StatusCode >= 400 && apiErr.StatusCode < 500 && apiErr.StatusCode != 429 {
+		return permanentError(op, path, err)
+	}
+	return transientError(op, path, err)
+}
+
+// KindOf returns the kind of the error. Errors that were not classified by the
+// tools are considered transient, except for cancellations which are fatal.
+func KindOf(err error) ErrorKind {
+	var toolErr *Error
+	if errors.As(err, &toolErr) {
+		return toolErr.Kind
+	}
+	if errors.Is(err, context.Canceled) {
+		return Fatal
+	}
+	return Transient
+}
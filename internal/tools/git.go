@@ -1,17 +1,16 @@
 package tools
 
 import (
-	"log"
-	"sync"
-	"time"
+	"context"
+	"strings"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
-	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/margostino/babel-agent/internal/common"
 	"github.com/margostino/babel-agent/internal/config"
+	"github.com/margostino/babel-agent/internal/llm"
+	"github.com/margostino/babel-agent/internal/state"
 	"github.com/margostino/babel-agent/internal/utils"
-	"github.com/weaviate/weaviate-go-client/v4/weaviate"
 )
 
 func getPulledFiles(repo *git.Repository, oldHash, newHash plumbing.Hash) ([]string, error) {
@@ -38,128 +37,74 @@ func getPulledFiles(repo *git.Repository, oldHash, newHash plumbing.Hash) ([]str
 	return pulledFiles, nil
 }
 
-func pull(config *config.Config) (git.Status, *git.Worktree, *git.Repository, []string) {
-	path := config.Repository.Path
-	repo, err := git.PlainOpen(path)
-	common.Check(err, "Failed to open git repo")
-	workTree, err := repo.Worktree()
-	common.Check(err, "Failed to get work tree from repo")
-	headBefore, err := repo.Head()
-	common.Check(err, "Failed to get current HEAD")
-	err = workTree.Pull(&git.PullOptions{RemoteName: "origin", Auth: config.Ssh.PublicKey})
-	if err != nil && err.Error() != "already up-to-date" {
-		common.Check(err, "Failed to pull")
-	}
-	status, err := workTree.Status()
-	common.Check(err, "Failed to get status")
-
-	headAfter, err := repo.Head()
-	common.Check(err, "Failed to get new HEAD")
-
-	pulledFiles, err := getPulledFiles(repo, headBefore.Hash(), headAfter.Hash())
-	common.Check(err, "Failed to get pulled files")
-
-	return status, workTree, repo, pulledFiles
-}
+// paraFolders are the top-level folders of the notes, in PARA order.
+var paraFolders = []string{"0-INBOX", "PROJECTS", "AREAS", "RESOURCES", "A-ARCHIVES"}
 
 func isValidForMetadata(filePath string) bool {
-	validFolderNames := []string{"0-INBOX", "AREAS", "PROJECTS", "RESOURCES", "A-ARCHIVES"}
-	validFolderNamesMap := utils.ListToMap(validFolderNames)
+	validFolderNamesMap := utils.ListToMap(paraFolders)
 	prefix := common.NewString(filePath).GetPrefixBy("/")
 
 	_, found := validFolderNamesMap[*prefix]
 	return found
 }
 
-func UpdateGit(dbClient *weaviate.Client, config *config.Config) (bool, error) {
-	status, workTree, repo, pulledFiles := pull(config)
-
-	if len(pulledFiles) > 0 && status.IsClean() {
-		log.Printf("Pulled changes %d files from remote", len(pulledFiles))
-		return true, nil
-	}
-
-	for _, file := range pulledFiles {
-		if !isValidForMetadata(file) {
+// filterStatus keeps only the status entries matching one of the changed paths,
+// either exactly or as a file nested under a changed directory.
+func filterStatus(status git.Status, changedPaths []string) git.Status {
+	filtered := make(git.Status)
+	for _, changedPath := range changedPaths {
+		if fileStatus, found := status[changedPath]; found {
+			filtered[changedPath] = fileStatus
 			continue
 		}
-		pulledStatus := &git.FileStatus{
-			Staging:  git.Unmodified,
-			Worktree: git.Modified,
-			Extra:    "",
-		}
-		status[file] = pulledStatus
-	}
-
-	if !status.IsClean() {
-		var wg sync.WaitGroup
-		for key, value := range status {
-			var normalizedFileName = key
-
-			if !isValidForMetadata(normalizedFileName) {
-				continue
-			}
-
-			if config.Tools.AssetsCleanerEnabled && value.Worktree != git.Deleted {
-				normalizedFileName = CleanAssets(config, key)
-			}
-			if config.Tools.MetadataEnricherEnabled {
-				var id *string
-				var err error
-				if value.Worktree != git.Untracked {
-					id, err = GetObject(dbClient, config, normalizedFileName)
-					if err != nil {
-						log.Printf("Failed to get object for file %s: %v\n", normalizedFileName, err)
-						continue
-					}
-				}
-				wg.Add(1)
-				if value.Worktree == git.Deleted {
-					go DeleteMetadata(dbClient, *id, config, normalizedFileName, &wg)
-					log.Printf("File %s has been deleted.\n", normalizedFileName)
-				} else {
-					go EnrichMetadata(dbClient, id, config, normalizedFileName, &wg)
-				}
-			}
-		}
-		wg.Wait()
-
-		_, err := workTree.Add(".")
-		common.Check(err, "Failed to add file to git")
-
-		trackedFilesCount := len(status)
-		modifiedCount := 0
-		deletedCount := 0
-		addedCount := 0
-
-		for _, s := range status {
-			if s.Staging == git.Added {
-				addedCount++
-			}
-			if s.Staging == git.Deleted {
-				deletedCount++
-			}
-			if s.Staging == git.Modified {
-				modifiedCount++
+		for file, fileStatus := range status {
+			if strings.HasPrefix(file, changedPath+"/") {
+				filtered[file] = fileStatus
 			}
 		}
+	}
+	return filtered
+}
 
-		log.Printf("Tracked files: %d (modified: %d added: %d deleted: %d)", trackedFilesCount, modifiedCount, addedCount, deletedCount)
+// SyncOptions select the changes a sync cycle processes and how far it goes.
+type SyncOptions struct {
+	// ChangedPaths, relative to the repository root, restrict the changes
+	// reported by git status that are processed first. Every change is when
+	// nil. Other changed notes are still processed before they are committed.
+	ChangedPaths []string
+	// Retries are changes that failed in a previous run, processed again even
+	// when git no longer reports them.
+	Retries []*FileChange
+	// Offline stops the cycle once the changes are committed.
+	Offline bool
+}
 
-		commit, err := workTree.Commit(config.Repository.Message, &git.CommitOptions{
-			Author: &object.Signature{
-				Name:  config.User.Username,
-				Email: config.User.Email,
-				When:  time.Now(),
-			},
-		})
-		common.Check(err, "Failed to commit")
-		obj, err := repo.CommitObject(commit)
-		common.Check(err, "Failed to get commit object")
-		err = repo.Push(&git.PushOptions{Auth: config.Ssh.PublicKey})
-		common.Check(err, "Failed to push")
-		log.Printf("Commit [%s] pushed successfully", obj.Hash.String())
+// UpdateGit runs a sync cycle: the local changes are processed by the tools
+// pipeline and committed before the remote commits are fetched and integrated,
+// then everything is pushed. The provider writes the commit messages when they
+// are generated. The processed change set is returned so that the caller can
+// inspect its failures.
+func UpdateGit(ctx context.Context, registry *Registry, config *config.Config, store *state.Store, provider llm.Provider, options SyncOptions) (*ChangeSet, error) {
+	repo, err := git.PlainOpen(config.Repository.Path)
+	if err != nil {
+		return &ChangeSet{}, fatalError("open git repo", err)
+	}
+	workTree, err := repo.Worktree()
+	if err != nil {
+		return &ChangeSet{}, fatalError("get work tree from repo", err)
 	}
 
-	return true, nil
+	cycle := &syncCycle{
+		registry:  registry,
+		config:    config,
+		store:     store,
+		provider:  provider,
+		repo:      repo,
+		workTree:  workTree,
+		state:     SyncIdle,
+		changeSet: &ChangeSet{},
+		offline:   options.Offline,
+	}
+	err = cycle.run(ctx, options.ChangedPaths, options.Retries)
+	return cycle.changeSet, err
 }
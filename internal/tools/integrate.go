@@ -0,0 +1,497 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/utils/merkletrie"
+	"github.com/margostino/babel-agent/internal/config"
+)
+
+// Strategies integrating the remote commits missing locally, when the local
+// branch has commits of its own or local changes touch the same notes.
+const (
+	// RebaseStrategy replays the local commits on top of the remote ones and
+	// stops when a note changed on both sides.
+	RebaseStrategy = "rebase"
+	// KeepBothStrategy replays the local commits like RebaseStrategy and keeps
+	// the local version of the notes changed on both sides as conflict copies.
+	KeepBothStrategy = "keep-both"
+	// StopStrategy stops whenever the local branch cannot fast-forward.
+	StopStrategy = "stop"
+)
+
+// backupRefName points to the local commits while they are replayed, so that
+// they stay reachable if the agent stops halfway. It is removed once a push
+// published the replayed commits.
+const backupRefName = plumbing.ReferenceName("refs/babel-agent/local")
+
+// interruptedRefPrefix keeps the backups of the integrations interrupted by a
+// crash, named after the time of the recovery, for the user to remove.
+const interruptedRefPrefix = "refs/babel-agent/interrupted/"
+
+const indexFileRelativePath = "z-metadata/index.json"
+
+// ConflictError lists the paths changed locally and on the remote that the
+// strategy does not integrate. The repository is left as it was.
+type ConflictError struct {
+	Strategy string
+	// Paths is empty when the strategy stops on any divergence.
+	Paths []string
+}
+
+func (e *ConflictError) Error() string {
+	if len(e.Paths) == 0 {
+		return fmt.Sprintf("local and remote branches diverged (%s strategy)", e.Strategy)
+	}
+	return fmt.Sprintf("changed locally and on the remote (%s strategy): %s", e.Strategy, strings.Join(e.Paths, ", "))
+}
+
+// fileVersion is the content of a path to write in the work tree.
+type fileVersion struct {
+	content []byte
+	mode    filemode.FileMode
+}
+
+// integration brings the remote commit into the local branch.
+type integration struct {
+	config   *config.Config
+	repo     *git.Repository
+	workTree *git.Worktree
+	base     *object.Commit
+	remote   *object.Commit
+	// remoteChanges are the paths changed by the remote since the merge base,
+	// nil when the remote deleted them.
+	remoteChanges map[string]*fileVersion
+	// localPaths are the paths changed by the local commits or in the work tree.
+	localPaths map[string]struct{}
+	// localCommits are the local commits missing on the remote, oldest first.
+	localCommits []*object.Commit
+}
+
+// integrate brings the remote commit into the local branch without losing local
+// edits, committed or not, and returns the paths changed by the remote and the
+// number of local commits replayed on top of them. A ConflictError is returned,
+// as a conflict error, when the strategy stops.
+func integrate(config *config.Config, repo *git.Repository, workTree *git.Worktree, headHash plumbing.Hash, remoteHash plumbing.Hash) ([]string, int, error) {
+	strategy := config.Sync.ConflictStrategy
+	switch strategy {
+	case RebaseStrategy, KeepBothStrategy, StopStrategy:
+	default:
+		return nil, 0, fatalError("pull", fmt.Errorf("unknown conflict strategy %q, use %s, %s or %s", strategy, RebaseStrategy, KeepBothStrategy, StopStrategy))
+	}
+	if headHash == remoteHash {
+		return nil, 0, nil
+	}
+
+	head, err := repo.CommitObject(headHash)
+	if err != nil {
+		return nil, 0, transientError("get local commit", "", err)
+	}
+	remote, err := repo.CommitObject(remoteHash)
+	if err != nil {
+		return nil, 0, transientError("get remote commit", "", err)
+	}
+	bases, err := head.MergeBase(remote)
+	if err != nil {
+		return nil, 0, transientError("find merge base", "", err)
+	}
+	if len(bases) == 0 {
+		return nil, 0, conflictError("pull", &ConflictError{Strategy: strategy})
+	}
+	if bases[0].Hash == remote.Hash {
+		// Only the local branch has new commits, they are pushed as usual.
+		return nil, 0, nil
+	}
+
+	i := &integration{config: config, repo: repo, workTree: workTree, base: bases[0], remote: remote}
+	if err := i.load(head); err != nil {
+		return nil, 0, err
+	}
+	if strategy == StopStrategy && len(i.localCommits) > 0 {
+		return nil, 0, conflictError("pull", &ConflictError{Strategy: strategy})
+	}
+
+	writes, skipped, conflicts, err := i.plan()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(conflicts) > 0 && strategy != KeepBothStrategy {
+		return nil, 0, conflictError("pull", &ConflictError{Strategy: strategy, Paths: conflicts})
+	}
+
+	if err := i.apply(head, writes, skipped, conflicts); err != nil {
+		return nil, 0, err
+	}
+
+	pulledFiles := make([]string, 0, len(i.remoteChanges))
+	for file := range i.remoteChanges {
+		pulledFiles = append(pulledFiles, file)
+	}
+	sort.Strings(pulledFiles)
+	if len(i.localCommits) > 0 {
+		log.Printf("Replayed %d local commits on top of %d remote changes\n", len(i.localCommits), len(pulledFiles))
+	}
+	return pulledFiles, len(i.localCommits), nil
+}
+
+// load collects the changes of both sides since the merge base.
+func (i *integration) load(head *object.Commit) error {
+	baseTree, err := i.base.Tree()
+	if err != nil {
+		return transientError("get merge base tree", "", err)
+	}
+	remoteTree, err := i.remote.Tree()
+	if err != nil {
+		return transientError("get remote tree", "", err)
+	}
+	headTree, err := head.Tree()
+	if err != nil {
+		return transientError("get local tree", "", err)
+	}
+
+	remoteChanges, err := object.DiffTree(baseTree, remoteTree)
+	if err != nil {
+		return transientError("diff remote changes", "", err)
+	}
+	i.remoteChanges = map[string]*fileVersion{}
+	for _, change := range remoteChanges {
+		if change.To.Name == "" {
+			i.remoteChanges[change.From.Name] = nil
+			continue
+		}
+		if change.From.Name != "" && change.From.Name != change.To.Name {
+			i.remoteChanges[change.From.Name] = nil
+		}
+		content, err := i.blob(change.To.TreeEntry.Hash)
+		if err != nil {
+			return transientError("read remote file", change.To.Name, err)
+		}
+		i.remoteChanges[change.To.Name] = &fileVersion{content: content, mode: change.To.TreeEntry.Mode}
+	}
+
+	i.localPaths = map[string]struct{}{}
+	localChanges, err := object.DiffTree(baseTree, headTree)
+	if err != nil {
+		return transientError("diff local changes", "", err)
+	}
+	for _, change := range localChanges {
+		for _, name := range []string{change.From.Name, change.To.Name} {
+			if name != "" {
+				i.localPaths[name] = struct{}{}
+			}
+		}
+	}
+	status, err := i.workTree.Status()
+	if err != nil {
+		return transientError("get status", "", err)
+	}
+	for file, fileStatus := range status {
+		if fileStatus.Worktree != git.Unmodified || fileStatus.Staging != git.Unmodified {
+			i.localPaths[file] = struct{}{}
+		}
+	}
+
+	for commit := head; commit.Hash != i.base.Hash; {
+		i.localCommits = append([]*object.Commit{commit}, i.localCommits...)
+		if commit.NumParents() == 0 {
+			break
+		}
+		commit, err = commit.Parent(0)
+		if err != nil {
+			return transientError("get local commit", "", err)
+		}
+	}
+	return nil
+}
+
+func (i *integration) blob(hash plumbing.Hash) ([]byte, error) {
+	blob, err := i.repo.BlobObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// plan decides what to write in the work tree for every path changed by the
+// remote. Skipped paths are left out of the replayed local commits, their
+// resolution is committed by the sync. Conflicts are notes whose local version
+// differs from the remote one; metadata is generated, so the index is merged
+// entry by entry and the other metadata files take the remote version.
+func (i *integration) plan() (map[string]*fileVersion, map[string]struct{}, []string, error) {
+	writes := map[string]*fileVersion{}
+	skipped := map[string]struct{}{}
+	var conflicts []string
+
+	for file, remote := range i.remoteChanges {
+		if _, found := i.localPaths[file]; !found {
+			writes[file] = remote
+			continue
+		}
+		local, err := os.ReadFile(filepath.Join(i.config.Repository.Path, file))
+		localExists := err == nil
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, nil, transientError("read local file", file, err)
+		}
+		if remote == nil && !localExists || remote != nil && localExists && bytes.Equal(local, remote.content) {
+			continue
+		}
+
+		if file == indexFileRelativePath && remote != nil && localExists {
+			merged, err := i.mergeIndex(local, remote.content)
+			if err == nil {
+				writes[file] = &fileVersion{content: merged, mode: remote.mode}
+				skipped[file] = struct{}{}
+				continue
+			}
+			log.Printf("Failed to merge %s, keeping the remote version: %v\n", file, err)
+		}
+		if strings.HasPrefix(file, "z-metadata/") {
+			writes[file] = remote
+			skipped[file] = struct{}{}
+			continue
+		}
+
+		conflicts = append(conflicts, file)
+		skipped[file] = struct{}{}
+		if remote != nil {
+			writes[file] = remote
+		}
+	}
+	sort.Strings(conflicts)
+	return writes, skipped, conflicts, nil
+}
+
+// mergeIndex applies the entries changed locally since the merge base to the
+// remote index.
+func (i *integration) mergeIndex(local []byte, remote []byte) ([]byte, error) {
+	var base []byte
+	if file, err := i.base.File(indexFileRelativePath); err == nil {
+		contents, err := file.Contents()
+		if err != nil {
+			return nil, err
+		}
+		base = []byte(contents)
+	}
+
+	baseData, localData, remoteData := map[string]json.RawMessage{}, map[string]json.RawMessage{}, map[string]json.RawMessage{}
+	for _, side := range []struct {
+		content []byte
+		data    map[string]json.RawMessage
+	}{{base, baseData}, {local, localData}, {remote, remoteData}} {
+		if len(bytes.TrimSpace(side.content)) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(side.content, &side.data); err != nil {
+			return nil, err
+		}
+	}
+
+	for key, value := range localData {
+		if !sameJSON(value, baseData[key]) {
+			remoteData[key] = value
+		}
+	}
+	for key := range baseData {
+		if _, found := localData[key]; !found {
+			delete(remoteData, key)
+		}
+	}
+	return json.MarshalIndent(remoteData, "", "  ")
+}
+
+func sameJSON(a json.RawMessage, b json.RawMessage) bool {
+	var compactA, compactB bytes.Buffer
+	if json.Compact(&compactA, a) != nil || json.Compact(&compactB, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(compactA.Bytes(), compactB.Bytes())
+}
+
+// apply keeps the local version of the conflicts as copies, writes the remote
+// changes in the work tree, moves the branch to the remote commit and replays
+// the local commits. Files are written before the branch moves, so stopping
+// halfway leaves them as local changes to commit.
+func (i *integration) apply(head *object.Commit, writes map[string]*fileVersion, skipped map[string]struct{}, conflicts []string) error {
+	root := i.config.Repository.Path
+	if err := i.repo.Storer.SetReference(plumbing.NewHashReference(backupRefName, head.Hash)); err != nil {
+		return transientError("save local commits", "", err)
+	}
+
+	now := time.Now()
+	for _, file := range conflicts {
+		local, err := os.ReadFile(filepath.Join(root, file))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return transientError("read local file", file, err)
+		}
+		if writes[file] == nil {
+			// Deleted on the remote, the local version stays in place.
+			continue
+		}
+		copyPath, err := writeConflictCopy(root, file, local, now)
+		if err != nil {
+			return err
+		}
+		log.Printf("Note %s changed locally and on the remote, kept the local version as %s\n", file, copyPath)
+	}
+
+	for file, version := range writes {
+		target := filepath.Join(root, file)
+		if version == nil {
+			if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+				return transientError("remove file", file, err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return transientError("write file", file, err)
+		}
+		perm := os.FileMode(0644)
+		if version.mode == filemode.Executable {
+			perm = 0755
+		}
+		if err := os.WriteFile(target, version.content, perm); err != nil {
+			return transientError("write file", file, err)
+		}
+	}
+
+	if err := i.workTree.Reset(&git.ResetOptions{Commit: i.remote.Hash, Mode: git.MixedReset}); err != nil {
+		return transientError("move branch to remote", "", err)
+	}
+	for _, commit := range i.localCommits {
+		if err := i.replay(commit, skipped); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replay commits the changes of the local commit again on top of the branch,
+// through the index so that the work tree is not touched.
+func (i *integration) replay(commit *object.Commit, skipped map[string]struct{}) error {
+	var parentTree *object.Tree
+	if commit.NumParents() > 0 {
+		parent, err := commit.Parent(0)
+		if err != nil {
+			return transientError("get local commit", "", err)
+		}
+		if parentTree, err = parent.Tree(); err != nil {
+			return transientError("get local tree", "", err)
+		}
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return transientError("get local tree", "", err)
+	}
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return transientError("diff local commit", "", err)
+	}
+
+	idx, err := i.repo.Storer.Index()
+	if err != nil {
+		return transientError("read index", "", err)
+	}
+	applied := false
+	for _, change := range changes {
+		action, err := change.Action()
+		if err != nil {
+			return transientError("diff local commit", "", err)
+		}
+		if action == merkletrie.Delete {
+			if _, found := skipped[change.From.Name]; found {
+				continue
+			}
+			if _, err := idx.Remove(change.From.Name); err != nil && !errors.Is(err, index.ErrEntryNotFound) {
+				return transientError("update index", change.From.Name, err)
+			}
+			applied = true
+			continue
+		}
+		if _, found := skipped[change.To.Name]; found {
+			continue
+		}
+		entry, err := idx.Entry(change.To.Name)
+		if err != nil {
+			entry = idx.Add(change.To.Name)
+		}
+		entry.Hash = change.To.TreeEntry.Hash
+		entry.Mode = change.To.TreeEntry.Mode
+		applied = true
+	}
+	if !applied {
+		return nil
+	}
+	if err := i.repo.Storer.SetIndex(idx); err != nil {
+		return transientError("write index", "", err)
+	}
+
+	committer := object.Signature{Name: i.config.User.Username, Email: i.config.User.Email, When: time.Now()}
+	if _, err := i.workTree.Commit(commit.Message, &git.CommitOptions{Author: &commit.Author, Committer: &committer}); err != nil {
+		return transientError("replay commit", commit.Hash.String(), err)
+	}
+	return nil
+}
+
+// hostname returns the short name of the machine, "local" when unknown.
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "local"
+	}
+	host, _, _ = strings.Cut(host, ".")
+	return host
+}
+
+// writeConflictCopy writes the local version of the note next to it, under a
+// name that the assets cleaner keeps, and returns its path.
+func writeConflictCopy(root string, rel string, content []byte, now time.Time) (string, error) {
+	dir, name := path.Split(rel)
+	stem := fmt.Sprintf("%s_conflict_%s_%s", normalizeFileName(name), normalizeFileName(hostname()), now.Format("20060102_150405"))
+
+	for n := 1; ; n++ {
+		copyName := stem
+		if n > 1 {
+			copyName = fmt.Sprintf("%s_%d", stem, n)
+		}
+		copyPath := dir + copyName
+		file, err := os.OpenFile(filepath.Join(root, copyPath), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", transientError("write conflict copy", copyPath, err)
+		}
+		_, err = file.Write(content)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return "", transientError("write conflict copy", copyPath, err)
+		}
+		return copyPath, nil
+	}
+}
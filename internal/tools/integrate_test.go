@@ -0,0 +1,134 @@
+package tools_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/margostino/babel-agent/internal/testharness"
+	"github.com/margostino/babel-agent/internal/tools"
+)
+
+const (
+	baseNote   = "# Go\n\nChannels.\n"
+	localNote  = "# Go\n\nChannels, edited locally.\n"
+	remoteNote = "# Go\n\nChannels, edited remotely.\n"
+)
+
+func TestUpdateGitIntegratesRemoteCommits(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		// remotePath is the note the other machine changes.
+		remotePath string
+		wantErr    bool
+		// wantNote is the content of RESOURCES/go after the cycle.
+		wantNote string
+		wantCopy bool
+	}{
+		{name: "rebase", strategy: tools.RebaseStrategy, remotePath: "RESOURCES/rust", wantNote: localNote},
+		{name: "rebase conflict", strategy: tools.RebaseStrategy, remotePath: "RESOURCES/go", wantErr: true, wantNote: localNote},
+		{name: "keep-both", strategy: tools.KeepBothStrategy, remotePath: "RESOURCES/rust", wantNote: localNote},
+		{name: "keep-both conflict", strategy: tools.KeepBothStrategy, remotePath: "RESOURCES/go", wantNote: remoteNote, wantCopy: true},
+		{name: "stop", strategy: tools.StopStrategy, remotePath: "RESOURCES/rust", wantErr: true, wantNote: localNote},
+		{name: "stop conflict", strategy: tools.StopStrategy, remotePath: "RESOURCES/go", wantErr: true, wantNote: localNote},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := testharness.New(t, map[string]string{"RESOURCES/go": baseNote})
+			h.Config.Sync.ConflictStrategy = test.strategy
+			other := h.Repo.Clone()
+			other.WriteFile(test.remotePath, remoteNote)
+			other.Commit("Remote edit")
+			other.Push()
+			h.Repo.WriteFile("RESOURCES/go", localNote)
+
+			_, err := h.UpdateGit(context.Background(), nil)
+			if test.wantErr {
+				if tools.KindOf(err) != tools.Conflict {
+					t.Fatalf("UpdateGit() = %v, want a conflict error", err)
+				}
+				if log := h.Repo.RemoteLog(); log[0] != "Remote edit" {
+					t.Errorf("remote log = %q, want nothing pushed", log)
+				}
+				if _, err := os.Stat(filepath.Join(h.Repo.Path, "RESOURCES/rust")); test.remotePath == "RESOURCES/rust" && !os.IsNotExist(err) {
+					t.Errorf("the remote note was checked out: %v", err)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("UpdateGit() = %v", err)
+				}
+				if h.Repo.ReadFile(test.remotePath) != remoteNote {
+					t.Errorf("the remote edit of %s was not pulled", test.remotePath)
+				}
+				if log := h.Repo.RemoteLog(); log[0] == "Remote edit" {
+					t.Errorf("remote log = %q, want the local commits pushed", log)
+				}
+				if !h.Repo.Status().IsClean() {
+					t.Errorf("work tree not clean after the sync: %v", h.Repo.Status())
+				}
+			}
+
+			if got := h.Repo.ReadFile("RESOURCES/go"); got != test.wantNote {
+				t.Errorf("RESOURCES/go = %q, want %q", got, test.wantNote)
+			}
+			copies := conflictCopies(t, h.Repo.Path)
+			if test.wantCopy != (len(copies) == 1) {
+				t.Errorf("conflict copies = %q, want one: %v", copies, test.wantCopy)
+			}
+			if !containsNote(t, h.Repo.Path, localNote) {
+				t.Error("the local edit was lost")
+			}
+		})
+	}
+}
+
+// conflictCopies returns the conflict copies of notes in the repository.
+func conflictCopies(t *testing.T, root string) []string {
+	t.Helper()
+	var copies []string
+	walkNotes(t, root, func(path string, content string) {
+		if strings.Contains(path, "_conflict_") {
+			copies = append(copies, path)
+		}
+	})
+	return copies
+}
+
+// containsNote reports whether a note of the repository has the content.
+func containsNote(t *testing.T, root string, content string) bool {
+	t.Helper()
+	found := false
+	walkNotes(t, root, func(path string, noteContent string) {
+		found = found || noteContent == content
+	})
+	return found
+}
+
+func walkNotes(t *testing.T, root string, visit func(path string, content string)) {
+	t.Helper()
+	err := filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if entry.Name() == ".git" || entry.Name() == "z-metadata" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		relativePath, _ := filepath.Rel(root, path)
+		visit(filepath.ToSlash(relativePath), string(content))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to walk the repository: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package tools
+
+import (
+	"regexp"
+	"strings"
+)
+
+// headingPattern matches an ATX heading line, e.g. "## Setup".
+var headingPattern = regexp.MustCompile(`^(#{1,6})[ \t]+(.*?)[ \t#]*$`)
+
+// passage is a part of a note under a single heading. Start and End are byte
+// offsets of the passage in the note.
+type passage struct {
+	Heading string
+	Content string
+	Start   int
+	End     int
+}
+
+// section is the text between two headings, with the headings it is under.
+type section struct {
+	headings []string
+	start    int
+	end      int
+}
+
+// splitMarkdown splits the note into passages: first at its headings, then
+// sections over maxTokens are split like the chunks sent to the LLM. Front
+// matter and sections holding only their heading are left out.
+func splitMarkdown(content string, maxTokens int) []passage {
+	bodyStart := len(content) - len(stripFrontMatter(content))
+
+	var sections []section
+	var headings []string
+	current := section{start: bodyStart}
+	fenced := false
+	for offset := bodyStart; offset < len(content); {
+		lineEnd := strings.IndexByte(content[offset:], '\n')
+		if lineEnd == -1 {
+			lineEnd = len(content)
+		} else {
+			lineEnd += offset + 1
+		}
+		line := strings.TrimRight(content[offset:lineEnd], "\r\n")
+
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fenced = !fenced
+		} else if match := headingPattern.FindStringSubmatch(line); match != nil && !fenced {
+			current.end = offset
+			sections = append(sections, current)
+
+			level := len(match[1])
+			if len(headings) >= level {
+				headings = headings[:level-1]
+			}
+			for len(headings) < level-1 {
+				headings = append(headings, "")
+			}
+			headings = append(headings, match[2])
+			current = section{headings: append([]string(nil), headings...), start: offset}
+		}
+		offset = lineEnd
+	}
+	current.end = len(content)
+	sections = append(sections, current)
+
+	var passages []passage
+	for _, section := range sections {
+		text := content[section.start:section.end]
+		if !hasBody(text) {
+			continue
+		}
+		heading := joinHeadings(section.headings)
+
+		parts := []string{text}
+		if maxTokens > 0 && countTokens(text) > maxTokens {
+			parts = splitIntoChunks(text, maxTokens)
+		}
+		// The parts cover the section in order, only a blank tail is dropped.
+		start := section.start
+		for _, part := range parts {
+			end := start + len(part)
+			trimmedStart := start + len(part) - len(strings.TrimLeft(part, " \t\r\n"))
+			trimmedEnd := start + len(strings.TrimRight(part, " \t\r\n"))
+			if trimmedStart < trimmedEnd {
+				passages = append(passages, passage{
+					Heading: heading,
+					Content: content[trimmedStart:trimmedEnd],
+					Start:   trimmedStart,
+					End:     trimmedEnd,
+				})
+			}
+			start = end
+		}
+	}
+	return passages
+}
+
+// hasBody reports whether the section has text besides its heading line.
+func hasBody(text string) bool {
+	firstLine, rest, found := strings.Cut(text, "\n")
+	if headingPattern.MatchString(strings.TrimRight(firstLine, "\r")) {
+		if !found {
+			return false
+		}
+		text = rest
+	}
+	return strings.TrimSpace(text) != ""
+}
+
+func joinHeadings(headings []string) string {
+	var nonEmpty []string
+	for _, heading := range headings {
+		if heading != "" {
+			nonEmpty = append(nonEmpty, heading)
+		}
+	}
+	return strings.Join(nonEmpty, " > ")
+}
@@ -0,0 +1,83 @@
+package tools
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitMarkdown(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		maxTokens int
+		want      []passage
+	}{
+		{
+			name:    "no headings",
+			content: "Just some text.\n",
+			want:    []passage{{Heading: "", Content: "Just some text.", Start: 0, End: 15}},
+		},
+		{
+			name:    "nested headings",
+			content: "# Go\n\nIntro.\n\n## Channels\n\nSend and receive.\n\n# Rust\n\nOwnership.\n",
+			want: []passage{
+				{Heading: "Go", Content: "# Go\n\nIntro.", Start: 0, End: 12},
+				{Heading: "Go > Channels", Content: "## Channels\n\nSend and receive.", Start: 14, End: 44},
+				{Heading: "Rust", Content: "# Rust\n\nOwnership.", Start: 46, End: 64},
+			},
+		},
+		{
+			name:    "skipped heading level",
+			content: "# Go\n\n### Deep\n\nText.\n",
+			want: []passage{
+				{Heading: "Go > Deep", Content: "### Deep\n\nText.", Start: 6, End: 21},
+			},
+		},
+		{
+			name:    "sections with only a heading are left out",
+			content: "# Empty\n\n# Full\n\nText.\n",
+			want: []passage{
+				{Heading: "Full", Content: "# Full\n\nText.", Start: 9, End: 22},
+			},
+		},
+		{
+			name:    "headings in code blocks are text",
+			content: "# Shell\n\n```\n# a comment\n```\n",
+			want: []passage{
+				{Heading: "Shell", Content: "# Shell\n\n```\n# a comment\n```", Start: 0, End: 28},
+			},
+		},
+		{
+			name:    "front matter is left out",
+			content: "---\ntags: [go]\n---\n# Go\n\nText.\n",
+			want: []passage{
+				{Heading: "Go", Content: "# Go\n\nText.", Start: 19, End: 30},
+			},
+		},
+		{
+			name:      "long sections are split",
+			content:   "# Long\n\n" + strings.Repeat("a", 10) + "\n\n" + strings.Repeat("b", 10) + "\n",
+			maxTokens: 4,
+			want: []passage{
+				{Heading: "Long", Content: "# Long", Start: 0, End: 6},
+				{Heading: "Long", Content: strings.Repeat("a", 10), Start: 8, End: 18},
+				{Heading: "Long", Content: strings.Repeat("b", 10), Start: 20, End: 30},
+			},
+		},
+		{name: "empty", content: "", want: nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := splitMarkdown(test.content, test.maxTokens)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("splitMarkdown(%q) =\n%+v\nwant\n%+v", test.content, got, test.want)
+			}
+			for _, passage := range got {
+				if test.content[passage.Start:passage.End] != passage.Content {
+					t.Errorf("offsets %d-%d of %q do not point to its content", passage.Start, passage.End, passage.Content)
+				}
+			}
+		})
+	}
+}
@@ -1,19 +1,26 @@
 package tools
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/margostino/babel-agent/internal/common"
 	"github.com/margostino/babel-agent/internal/config"
-	"github.com/margostino/babel-agent/internal/openai"
+	"github.com/margostino/babel-agent/internal/db"
+	"github.com/margostino/babel-agent/internal/llm"
+	"github.com/margostino/babel-agent/internal/metadata"
+	"github.com/margostino/babel-agent/internal/queue"
+	"github.com/margostino/babel-agent/internal/state"
 	"github.com/margostino/babel-agent/internal/utils"
-	"github.com/weaviate/weaviate-go-client/v4/weaviate"
+	"github.com/weaviate/weaviate/entities/models"
 )
 
 func getRelativePath(absolutePath string) (string, error) {
@@ -27,43 +34,49 @@ func getRelativePath(absolutePath string) (string, error) {
 	return relativePath, nil
 }
 
-func writePrettyJSONToFile(metadataContent string, filePath string, metadataPath string, relativeFilePath string) map[string]interface{} {
-	var data map[string]interface{}
-	err := json.Unmarshal([]byte(metadataContent), &data)
-	common.Check(err, "Failed to unmarshal JSON")
-
+func writePrettyJSONToFile(data map[string]interface{}, filePath string, metadataPath string, relativeFilePath string) error {
 	prettyJSON, err := json.MarshalIndent(data, "", "  ")
-	common.Check(err, "Failed to marshal JSON")
+	if err != nil {
+		return permanentError("marshal metadata", relativeFilePath, err)
+	}
 
 	dir := filepath.Dir(filePath)
 	err = os.MkdirAll(dir, 0755)
-	common.Check(err, "Failed to create directory")
+	if err != nil {
+		return permanentError("create metadata directory", relativeFilePath, err)
+	}
 
 	err = os.WriteFile(fmt.Sprintf("%s.json", filePath), prettyJSON, 0644)
-	common.Check(err, "Failed to write JSON to file")
+	if err != nil {
+		return permanentError("write metadata", relativeFilePath, err)
+	}
 
 	indexFilePath := filepath.Join(metadataPath, "index.json")
 	newIndexEntry := map[string]interface{}{
 		"highlights": data["highlights"],
 		"summary":    data["summary"],
 	}
-	updateIndexFile(indexFilePath, relativeFilePath, newIndexEntry)
-	return data
+	return updateIndexFile(indexFilePath, relativeFilePath, newIndexEntry)
 }
 
-func updateIndexFile(indexFilePath, relativeFilePath string, newIndexEntry map[string]interface{}) {
+// indexMutex serializes the read-modify-write cycles of the index file, which
+// is shared by all the files being enriched concurrently.
+var indexMutex sync.Mutex
+
+func updateIndexFile(indexFilePath, relativeFilePath string, newIndexEntry map[string]interface{}) error {
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+
 	indexFileContent, err := os.ReadFile(indexFilePath)
 	if err != nil && !os.IsNotExist(err) {
-		log.Printf("Failed to read index file: %v\n", err)
-		return
+		return permanentError("read index file", relativeFilePath, err)
 	}
 
 	indexData := make(map[string]map[string]interface{})
 	if len(indexFileContent) > 0 {
 		err = json.Unmarshal(indexFileContent, &indexData)
 		if err != nil {
-			log.Printf("Failed to unmarshal index file: %v\n", err)
-			return
+			return permanentError("unmarshal index file", relativeFilePath, err)
 		}
 	}
 
@@ -75,20 +88,19 @@ func updateIndexFile(indexFilePath, relativeFilePath string, newIndexEntry map[s
 
 	indexJSON, err := json.MarshalIndent(indexData, "", "  ")
 	if err != nil {
-		log.Printf("Failed to marshal index data to JSON: %v\n", err)
-		return
+		return permanentError("marshal index file", relativeFilePath, err)
 	}
 
 	err = os.WriteFile(indexFilePath, indexJSON, 0644)
 	if err != nil {
-		log.Printf("Failed to write JSON to index file %s: %v\n", indexFilePath, err)
+		return permanentError("write index file", relativeFilePath, err)
 	}
+	return nil
 }
 
-func DeleteMetadata(dbClient *weaviate.Client, id string, config *config.Config, relativeFilePath string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	// log.Println(fmt.Sprintf("Running MetadataDeletion tool for file: %s", relativeFilePath))
-
+// DeleteMetadata removes the metadata of the file from z-metadata, the index and
+// the database.
+func DeleteMetadata(ctx context.Context, storage db.Storage, config *config.Config, relativeFilePath string) error {
 	root := config.Repository.Path
 	metadataPath := filepath.Join(root, "z-metadata")
 	indexFilePath := filepath.Join(metadataPath, "index.json")
@@ -97,51 +109,446 @@ func DeleteMetadata(dbClient *weaviate.Client, id string, config *config.Config,
 
 	if _, err := os.Stat(metadataFilePath); !os.IsNotExist(err) {
 		err := os.Remove(metadataFilePath)
-		common.Check(err, "Failed to remove metadata file")
+		if err != nil {
+			return permanentError("remove metadata", relativeFilePath, err)
+		}
 		log.Printf("Deleted metadata for %s\n", relativeFilePath)
-		updateIndexFile(indexFilePath, relativeFilePath, nil)
+		if err := updateIndexFile(indexFilePath, relativeFilePath, nil); err != nil {
+			return err
+		}
+	}
 
-		DeleteObject(dbClient, id)
+	// The objects are deleted even when the metadata file is already gone.
+	if err := DeleteChunks(ctx, storage, relativeFilePath, ""); err != nil {
+		return err
 	}
+	return DeleteObject(ctx, storage, db.ObjectID(relativeFilePath))
 }
 
-func EnrichMetadata(dbClient *weaviate.Client, id *string, config *config.Config, relativeFilePath string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	// log.Println(fmt.Sprintf("Running MetadataEnrichment tool for file: %s", relativeFilePath))
-	openAiAPIKey := config.OpenAi.ApiKey
-	root := config.Repository.Path
-	absoluteFilePath := filepath.Join(root, relativeFilePath)
+// metadataSkipNames are the names of the files and folders that never get
+// metadata.
+var metadataSkipNames = []string{".git", "z-metadata", "0-description", "0-babel", "metadata_index"}
+
+// readFileForMetadata returns the content of the file, or nil when the path is
+// not a file that gets metadata.
+func readFileForMetadata(config *config.Config, relativeFilePath string) ([]byte, error) {
+	absoluteFilePath := filepath.Join(config.Repository.Path, relativeFilePath)
 
-	skipNames := []string{".git", "z-metadata", "0-description", "0-babel", "metadata_index"}
-	skipNamesMap := utils.ListToMap(skipNames)
+	skipNamesMap := utils.ListToMap(metadataSkipNames)
 
 	info, err := os.Stat(absoluteFilePath)
-	if os.IsNotExist(err) {
-		log.Fatalf("path does not exist: %v", err)
-	} else if err != nil {
-		log.Fatalf("failed to get file info: %v", err)
+	if err != nil {
+		return nil, permanentError("enrich metadata", relativeFilePath, err)
 	}
 	if info.IsDir() {
 		log.Printf("skipping directory: %s\n", absoluteFilePath)
-		return
+		return nil, nil
+	}
+	if _, found := skipNamesMap[info.Name()]; found {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(absoluteFilePath)
+	if err != nil {
+		return nil, permanentError("read file", relativeFilePath, err)
 	}
+	return content, nil
+}
 
-	if _, found := skipNamesMap[info.Name()]; !found {
-		metadataPath := filepath.Join(root, "z-metadata")
-		metadataFilePath := filepath.Join(metadataPath, relativeFilePath)
-		content, err := os.ReadFile(absoluteFilePath)
-		common.Check(err, "Failed to read file content")
+// writeMetadataFile writes the validated metadata to z-metadata and the index.
+func writeMetadataFile(config *config.Config, relativeFilePath string, data map[string]interface{}) error {
+	metadataPath := filepath.Join(config.Repository.Path, "z-metadata")
+	metadataFilePath := filepath.Join(metadataPath, relativeFilePath)
+	return writePrettyJSONToFile(data, metadataFilePath, metadataPath, relativeFilePath)
+}
 
-		metadataContent, err := openai.GetChatCompletionForMetadata(openAiAPIKey, relativeFilePath, string(content))
-		common.Check(err, "Failed to get metadata")
+func metadataExists(config *config.Config, relativeFilePath string) bool {
+	metadataFilePath := fmt.Sprintf("%s.json", filepath.Join(config.Repository.Path, "z-metadata", relativeFilePath))
+	_, err := os.Stat(metadataFilePath)
+	return err == nil
+}
 
-		fileContent, err := writePrettyJSONToFile(metadataContent, metadataFilePath, metadataPath, relativeFilePath), nil
+// ReadMetadata returns the metadata of the note in z-metadata, or nil when it has
+// none.
+func ReadMetadata(config *config.Config, relativeFilePath string) (map[string]interface{}, error) {
+	metadataFilePath := fmt.Sprintf("%s.json", filepath.Join(config.Repository.Path, "z-metadata", relativeFilePath))
+	content, err := os.ReadFile(metadataFilePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, permanentError("read metadata", relativeFilePath, err)
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(content, &data); err != nil {
+		return nil, permanentError("unmarshal metadata", relativeFilePath, err)
+	}
+	return data, nil
+}
 
-		if id == nil {
-			CreateObject(dbClient, fileContent)
+// listMetadataFiles returns the paths of the notes that have a metadata file.
+func listMetadataFiles(config *config.Config) (map[string]struct{}, error) {
+	metadataPath := filepath.Join(config.Repository.Path, "z-metadata")
+	paths := map[string]struct{}{}
+	err := filepath.WalkDir(metadataPath, func(path string, entry fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		relativeFilePath, err := filepath.Rel(metadataPath, path)
+		if err != nil {
+			return err
+		}
+		relativeFilePath = filepath.ToSlash(relativeFilePath)
+		if relativeFilePath == "index.json" || !strings.HasSuffix(relativeFilePath, ".json") {
+			return nil
+		}
+		paths[strings.TrimSuffix(relativeFilePath, ".json")] = struct{}{}
+		return nil
+	})
+	return paths, err
+}
+
+// MetadataPaths returns the paths of the notes that have a metadata file, in
+// lexical order.
+func MetadataPaths(config *config.Config) ([]string, error) {
+	files, err := listMetadataFiles(config)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+type MetadataEnricher struct {
+	config   *config.Config
+	storage  db.Storage
+	provider llm.Provider
+	queue    *queue.Queue
+	store    *state.Store
+}
+
+func NewMetadataEnricher(storage db.Storage, provider llm.Provider, config *config.Config, jobs *queue.Queue, store *state.Store) *MetadataEnricher {
+	return &MetadataEnricher{
+		config:   config,
+		storage:  storage,
+		provider: provider,
+		queue:    jobs,
+		store:    store,
+	}
+}
+
+func (t *MetadataEnricher) Name() string {
+	return "metadata_enricher"
+}
+
+func (t *MetadataEnricher) Enabled() bool {
+	return t.config.Tools.MetadataEnricherEnabled
+}
+
+func (t *MetadataEnricher) DependsOn() []string {
+	return []string{"assets_cleaner"}
+}
+
+// pendingWrite is metadata saved to z-metadata whose database objects are not
+// written yet: the object of the note, unless its metadata is unchanged, and the
+// chunks of its content. Once they are, the stale chunks of the note are deleted
+// and commit records the enrichment in the store.
+type pendingWrite struct {
+	change    *FileChange
+	objects   []*models.Object
+	chunkHash string
+	commit    func() error
+}
+
+func (t *MetadataEnricher) HandleChangeSet(ctx context.Context, changeSet *ChangeSet) error {
+	var results []<-chan error
+	var changes []*FileChange
+	writes := make([]*pendingWrite, len(changeSet.Changes))
+
+	for i, change := range changeSet.Changes {
+		// The intent is recorded first, so that a crash in the middle of the
+		// processing is resumed in the next run.
+		operation := state.EnrichOperation
+		if change.IsDeleted() {
+			operation = state.DeleteOperation
+		}
+		err := t.store.Update(change.Path, func(fileState *state.FileState) {
+			fileState.Pending = operation
+		})
+		if err != nil {
+			return fatalError("record pending file", err)
+		}
+
+		i, change := i, change
+		relativeFilePath := change.Path
+		var job queue.Job
+		if change.IsDeleted() {
+			job = queue.Job{
+				Name: "delete " + relativeFilePath,
+				Run: func(ctx context.Context) error {
+					if err := DeleteMetadata(ctx, t.storage, t.config, relativeFilePath); err != nil {
+						return err
+					}
+					return t.store.Delete(relativeFilePath)
+				},
+			}
+			log.Printf("File %s has been deleted.\n", relativeFilePath)
 		} else {
-			UpdateObject(dbClient, *id, fileContent)
+			// The provider waits on the rate limiter before each of the requests
+			// of the job, see llm.Limit.
+			job = queue.Job{
+				Name: "enrich " + relativeFilePath,
+				Run: func(ctx context.Context) error {
+					write, err := t.enrich(ctx, relativeFilePath)
+					if write != nil {
+						write.change = change
+					}
+					writes[i] = write
+					return err
+				},
+			}
+		}
+		results = append(results, t.queue.Submit(ctx, job))
+		changes = append(changes, change)
+	}
+
+	var pending []*pendingWrite
+	for i, result := range results {
+		if err := <-result; err != nil {
+			t.fail(changeSet, changes[i], err)
+		}
+	}
+	for _, write := range writes {
+		if write != nil && len(write.objects) > 0 {
+			pending = append(pending, write)
 		}
 	}
+	t.writeObjects(ctx, changeSet, pending)
+	return nil
+}
+
+// batchSize is the number of objects written per database request.
+func (t *MetadataEnricher) batchSize() int {
+	if t.config.Db.BatchSize > 0 {
+		return t.config.Db.BatchSize
+	}
+	return defaultBatchSize
+}
+
+// writeObjects upserts the objects of the enriched files in batches of about
+// the batch size, the objects of a file are never split. A file whose objects
+// fail to be written stays pending and is retried.
+func (t *MetadataEnricher) writeObjects(ctx context.Context, changeSet *ChangeSet, writes []*pendingWrite) {
+	for start := 0; start < len(writes); {
+		end, count := start, 0
+		for end < len(writes) && (count == 0 || count+len(writes[end].objects) <= t.batchSize()) {
+			count += len(writes[end].objects)
+			end++
+		}
+		batch := writes[start:end]
+		start = end
+
+		objects := make([]*models.Object, 0, count)
+		for _, write := range batch {
+			objects = append(objects, write.objects...)
+		}
+		failures, err := UpsertObjects(ctx, t.storage, objects)
+		if err != nil {
+			for _, write := range batch {
+				t.fail(changeSet, write.change, err)
+			}
+			continue
+		}
+
+		for _, write := range batch {
+			if err := writeFailure(write, failures); err != nil {
+				log.Printf("Failed to write the objects of %s: %v\n", write.change.Path, err)
+				t.fail(changeSet, write.change, err)
+				continue
+			}
+			if write.chunkHash != "" {
+				if err := DeleteChunks(ctx, t.storage, write.change.Path, write.chunkHash); err != nil {
+					t.fail(changeSet, write.change, err)
+					continue
+				}
+			}
+			if err := write.commit(); err != nil {
+				t.fail(changeSet, write.change, transientError("save file state", write.change.Path, err))
+			}
+		}
+		log.Printf("Wrote %d objects (%d failed)\n", len(objects), len(failures))
+	}
+}
 
+// writeFailure returns the error of the first object of the write that failed.
+func writeFailure(write *pendingWrite, failures map[string]error) error {
+	for _, object := range write.objects {
+		if err, failed := failures[object.ID.String()]; failed {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkObjects returns the chunk objects of the file, none when chunks are
+// disabled.
+func (t *MetadataEnricher) chunkObjects(relativeFilePath string, content []byte, hash string) []*models.Object {
+	if t.config.Db.ChunkTokens <= 0 {
+		return nil
+	}
+	return chunkObjects(relativeFilePath, content, hash, t.config.Db.ChunkTokens)
+}
+
+// enrich enriches the file unless its current content was already enriched with
+// the current prompt and schema, which makes a resumed or repeated run free.
+// Changes below the configured threshold keep the previous metadata, and
+// metadata generated before for the same content, prompt, schema and model is
+// reused instead of asking the LLM again, with the path and category of this
+// note. The metadata is saved to z-metadata and the returned write holds its
+// database object, nil when there is nothing to write.
+func (t *MetadataEnricher) enrich(ctx context.Context, relativeFilePath string) (*pendingWrite, error) {
+	content, err := readFileForMetadata(t.config, relativeFilePath)
+	if err != nil || content == nil {
+		return nil, err
+	}
+
+	normalizedContent := normalizeContent(content)
+	hash := contentHash(normalizedContent)
+	version, err := currentMetadataVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	fileState, err := t.store.Get(relativeFilePath)
+	if err != nil {
+		return nil, transientError("get file state", relativeFilePath, err)
+	}
+	enriched := version.enriched(fileState) && metadataExists(t.config, relativeFilePath)
+
+	if enriched && fileState.ContentHash == hash {
+		log.Printf("Metadata for %s is up to date\n", relativeFilePath)
+		return nil, t.complete(relativeFilePath)
+	}
+
+	if enriched && t.config.Enrichment.MinChangeRatio > 0 {
+		previousContent, err := t.store.GetEnrichedContent(relativeFilePath)
+		if err != nil {
+			return nil, transientError("get enriched content", relativeFilePath, err)
+		}
+		if previousContent != nil {
+			if ratio := changeRatio(previousContent, normalizedContent); ratio < t.config.Enrichment.MinChangeRatio {
+				log.Printf("Change of %s (%.2f) is below the threshold, keeping its metadata\n", relativeFilePath, ratio)
+				// The chunks and the state follow the content even when the
+				// metadata does not.
+				chunks := t.chunkObjects(relativeFilePath, content, hash)
+				if len(chunks) == 0 {
+					return nil, t.keep(relativeFilePath, hash)
+				}
+				return &pendingWrite{
+					objects:   chunks,
+					chunkHash: hash,
+					commit: func() error {
+						return t.keep(relativeFilePath, hash)
+					},
+				}, nil
+			}
+		}
+	}
+
+	cacheKey := metadataCacheKey(hash, version, t.provider.Name()+"/"+t.provider.Model())
+	cachedMetadata, err := t.store.GetCachedMetadata(cacheKey)
+	if err != nil {
+		return nil, transientError("get cached metadata", relativeFilePath, err)
+	}
+
+	var metadataContent string
+	if cachedMetadata != nil {
+		log.Printf("Reusing cached metadata for %s\n", relativeFilePath)
+		metadataContent = string(cachedMetadata)
+	} else {
+		metadataContent, err = GenerateMetadata(ctx, t.provider, t.config, relativeFilePath, content)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := ValidateMetadata(ctx, t.provider, t.config, relativeFilePath, metadataContent)
+	if err != nil {
+		return nil, err
+	}
+	metadata.Locate(data, relativeFilePath)
+
+	if err := writeMetadataFile(t.config, relativeFilePath, data); err != nil {
+		return nil, err
+	}
+
+	if validMetadata, err := json.Marshal(data); err == nil {
+		if err := t.store.PutCachedMetadata(cacheKey, validMetadata); err != nil {
+			log.Printf("Failed to cache metadata for %s: %v\n", relativeFilePath, err)
+		}
+	}
+
+	object := metadataObject(relativeFilePath, data, hash)
+	chunks := t.chunkObjects(relativeFilePath, content, hash)
+	write := &pendingWrite{
+		objects: append([]*models.Object{object}, chunks...),
+		commit: func() error {
+			if err := t.store.PutEnrichedContent(relativeFilePath, normalizedContent); err != nil {
+				log.Printf("Failed to store enriched content for %s: %v\n", relativeFilePath, err)
+			}
+			return t.store.Update(relativeFilePath, func(fileState *state.FileState) {
+				fileState.ContentHash = hash
+				fileState.EnrichedAt = time.Now()
+				fileState.ObjectID = object.ID.String()
+				fileState.PromptVersion = version.prompt
+				fileState.SchemaVersion = version.schema
+				fileState.Pending = state.NoOperation
+				fileState.LastError = ""
+			})
+		},
+	}
+	if len(chunks) > 0 {
+		write.chunkHash = hash
+	}
+	return write, nil
+}
+
+// complete marks the file as processed without changing its metadata.
+func (t *MetadataEnricher) complete(relativeFilePath string) error {
+	return t.store.Update(relativeFilePath, func(fileState *state.FileState) {
+		fileState.Pending = state.NoOperation
+		fileState.LastError = ""
+	})
+}
+
+// keep marks the file as processed with the given content hash, keeping the
+// metadata generated for a previous content.
+func (t *MetadataEnricher) keep(relativeFilePath string, hash string) error {
+	return t.store.Update(relativeFilePath, func(fileState *state.FileState) {
+		fileState.ContentHash = hash
+		fileState.Pending = state.NoOperation
+		fileState.LastError = ""
+	})
+}
+
+// fail records the failure in the change set and in the store. Permanent
+// failures are no longer pending, they wait for the file to change again.
+func (t *MetadataEnricher) fail(changeSet *ChangeSet, change *FileChange, err error) {
+	changeSet.Fail(change, err)
+	updateErr := t.store.Update(change.Path, func(fileState *state.FileState) {
+		fileState.LastError = err.Error()
+		if KindOf(err) == Permanent {
+			fileState.Pending = state.NoOperation
+		}
+	})
+	if updateErr != nil {
+		log.Printf("Failed to record the failure of file %s: %v\n", change.Path, updateErr)
+	}
 }
@@ -0,0 +1,153 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/margostino/babel-agent/internal/config"
+)
+
+// inboxFolder is the PARA folder new notes are captured in.
+const inboxFolder = "0-INBOX"
+
+// Commit is a commit of the repository with the notes it changed.
+type Commit struct {
+	Hash    string    `json:"hash"`
+	Message string    `json:"message"`
+	Author  string    `json:"author"`
+	When    time.Time `json:"when"`
+	Notes   []string  `json:"notes"`
+}
+
+// ReadNote returns the content of a note of the PARA folders.
+func ReadNote(config *config.Config, relativeFilePath string) ([]byte, error) {
+	relativeFilePath = filepath.ToSlash(filepath.Clean(relativeFilePath))
+	if !filepath.IsLocal(relativeFilePath) || !isValidForMetadata(relativeFilePath) {
+		return nil, permanentError("read note", relativeFilePath, errors.New("not a note of the PARA folders"))
+	}
+	content, err := readFileForMetadata(config, relativeFilePath)
+	if err != nil {
+		return nil, err
+	}
+	if content == nil {
+		return nil, permanentError("read note", relativeFilePath, errors.New("not a note"))
+	}
+	return content, nil
+}
+
+// NoteExcerpt returns the normalized content of a note cut to the given tokens,
+// to fit in a prompt.
+func NoteExcerpt(config *config.Config, relativeFilePath string, maxTokens int) (string, error) {
+	content, err := ReadNote(config, relativeFilePath)
+	if err != nil {
+		return "", err
+	}
+	text := string(normalizeContent(content))
+	if maxTokens > 0 {
+		text = truncateToTokens(text, maxTokens)
+	}
+	return text, nil
+}
+
+// TruncateToTokens cuts the text to the given tokens, at a line boundary when
+// there is one, to fit in a prompt.
+func TruncateToTokens(text string, maxTokens int) string {
+	return truncateToTokens(text, maxTokens)
+}
+
+// AddInboxNote writes a new note to the inbox, named after its title, and
+// returns its path. Existing notes are never overwritten, a suffix is added to
+// the name instead. The note is committed by the next sync.
+func AddInboxNote(config *config.Config, title string, content string) (string, error) {
+	name := normalizeFileName(strings.ReplaceAll(title, "/", " "))
+	if name == "" {
+		return "", permanentError("add inbox note", "", errors.New("empty title"))
+	}
+	folder := filepath.Join(config.Repository.Path, inboxFolder)
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return "", permanentError("add inbox note", inboxFolder, err)
+	}
+
+	text := fmt.Sprintf("# %s\n\n%s\n", strings.TrimSpace(title), strings.TrimSpace(content))
+	for i := 1; ; i++ {
+		fileName := name
+		if i > 1 {
+			fileName = fmt.Sprintf("%s_%d", name, i)
+		}
+		file, err := os.OpenFile(filepath.Join(folder, fileName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		relativeFilePath := inboxFolder + "/" + fileName
+		if err != nil {
+			return "", permanentError("add inbox note", relativeFilePath, err)
+		}
+		_, err = io.WriteString(file, text)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return "", permanentError("add inbox note", relativeFilePath, err)
+		}
+		return relativeFilePath, nil
+	}
+}
+
+// RecentChanges returns the last commits of the repository, newest first, with
+// the notes each one changed.
+func RecentChanges(config *config.Config, limit int) ([]*Commit, error) {
+	repo, err := git.PlainOpen(config.Repository.Path)
+	if err != nil {
+		return nil, fatalError("open git repo", err)
+	}
+	commits, err := repo.Log(&git.LogOptions{})
+	if err != nil {
+		return nil, transientError("get git log", "", err)
+	}
+	defer commits.Close()
+
+	var changes []*Commit
+	for len(changes) < limit {
+		commit, err := commits.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, transientError("get git log", "", err)
+		}
+		notes, err := changedNotes(commit)
+		if err != nil {
+			return nil, transientError("get changed files", commit.Hash.String(), err)
+		}
+		changes = append(changes, &Commit{
+			Hash:    commit.Hash.String(),
+			Message: strings.TrimSpace(commit.Message),
+			Author:  commit.Author.Name,
+			When:    commit.Author.When,
+			Notes:   notes,
+		})
+	}
+	return changes, nil
+}
+
+// changedNotes returns the notes of the PARA folders changed by the commit.
+func changedNotes(commit *object.Commit) ([]string, error) {
+	stats, err := commit.Stats()
+	if err != nil {
+		return nil, err
+	}
+	notes := []string{}
+	for _, fileStat := range stats {
+		if isValidForMetadata(fileStat.Name) {
+			notes = append(notes, fileStat.Name)
+		}
+	}
+	return notes, nil
+}
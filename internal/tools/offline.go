@@ -0,0 +1,132 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/margostino/babel-agent/internal/config"
+)
+
+// probeTimeout bounds a connectivity probe, so that a hanging connection counts
+// as unreachable.
+const probeTimeout = 30 * time.Second
+
+// unreachableMessages are the errors, sometimes only left as text by the
+// transports, of a remote that cannot be reached.
+var unreachableMessages = []string{
+	"no such host",
+	"connection refused",
+	"connection reset",
+	"network is unreachable",
+	"no route to host",
+	"i/o timeout",
+}
+
+// remoteError classifies an error talking to the remote: an unreachable remote
+// is an offline error, anything else is transient.
+func remoteError(op string, err error) error {
+	if isUnreachable(err) {
+		return offlineError(op, err)
+	}
+	return transientError(op, "", err)
+}
+
+// isUnreachable reports whether the error means the network or the remote is
+// down, as opposed to the remote refusing the request. A repository not found
+// is refused: hosts answer so to a wrong URL or to missing permissions, which
+// probing would never fix.
+func isUnreachable(err error) bool {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	if errors.As(err, &opErr) || errors.As(err, &dnsErr) {
+		return true
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	message := strings.ToLower(err.Error())
+	for _, unreachable := range unreachableMessages {
+		if strings.Contains(message, unreachable) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProbeRemote checks whether the remote can be reached by listing its
+// references. It returns an offline error while it cannot.
+func ProbeRemote(ctx context.Context, config *config.Config) error {
+	repo, err := git.PlainOpen(config.Repository.Path)
+	if err != nil {
+		return fatalError("open git repo", err)
+	}
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return fatalError("get remote", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	if _, err := remote.ListContext(ctx, &git.ListOptions{Auth: config.GitAuth()}); err != nil {
+		if errors.Is(err, context.Canceled) {
+			return fatalError("probe remote", err)
+		}
+		return remoteError("probe remote", err)
+	}
+	return nil
+}
+
+// UnpushedCommits returns the number of local commits the remote-tracking
+// branch lacks, as of the last fetch. Every commit is unpushed when the remote
+// does not have the branch yet.
+func UnpushedCommits(config *config.Config) (int, error) {
+	repo, err := git.PlainOpen(config.Repository.Path)
+	if err != nil {
+		return 0, fatalError("open git repo", err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return 0, fatalError("get current HEAD", err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return 0, transientError("get local commit", "", err)
+	}
+
+	remote, err := remoteBranch(repo, head)
+	if err != nil {
+		return 0, err
+	}
+	var base *object.Commit
+	if remote != nil {
+		remoteCommit, err := repo.CommitObject(remote.Hash())
+		if err != nil {
+			return 0, transientError("get remote commit", "", err)
+		}
+		bases, err := commit.MergeBase(remoteCommit)
+		if err != nil {
+			return 0, transientError("find merge base", "", err)
+		}
+		if len(bases) > 0 {
+			base = bases[0]
+		}
+	}
+
+	count := 0
+	for base == nil || commit.Hash != base.Hash {
+		count++
+		if commit.NumParents() == 0 {
+			break
+		}
+		commit, err = commit.Parent(0)
+		if err != nil {
+			return 0, transientError("get local commit", "", err)
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,348 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/margostino/babel-agent/internal/state"
+	"github.com/margostino/babel-agent/internal/utils"
+	"github.com/weaviate/weaviate/entities/models"
+)
+
+const (
+	// reindexDoneKey holds the files an interrupted reindex completed, as a JSON
+	// array. Failed files are left out, so that resuming retries them.
+	reindexDoneKey    = "reindex.done"
+	reindexOptionsKey = "reindex.options"
+)
+
+// ReindexOptions selects the files a reindex goes through. Without filters every
+// file of the PARA folders is reindexed.
+type ReindexOptions struct {
+	// OnlyMissing keeps the files without metadata in z-metadata.
+	OnlyMissing bool
+	// Since keeps the files changed between this commit and HEAD.
+	Since string
+	// Folder keeps the files under this folder, relative to the repository root.
+	Folder string
+	// BatchSize is the number of files processed, and objects written, at once.
+	// It defaults to the database batch size.
+	BatchSize int
+	// Restart ignores the progress of an interrupted reindex with the same options.
+	Restart bool
+}
+
+func (o ReindexOptions) String() string {
+	return fmt.Sprintf("onlyMissing=%t since=%s folder=%s", o.OnlyMissing, o.Since, o.Folder)
+}
+
+// ReindexReport sums up a reindex.
+type ReindexReport struct {
+	Files    int
+	Resumed  int
+	Upserted int
+	Enriched int
+	Failures []FailedChange
+}
+
+// reindexFiles returns the files of the PARA folders matching the options, in
+// lexical order.
+func (t *MetadataEnricher) reindexFiles(options ReindexOptions) ([]string, error) {
+	root := t.config.Repository.Path
+	skipNamesMap := utils.ListToMap(metadataSkipNames)
+	folder := strings.Trim(filepath.ToSlash(filepath.Clean(options.Folder)), "/")
+	if folder == "." {
+		folder = ""
+	}
+	if folder != "" && !isValidForMetadata(folder) {
+		return nil, permanentError("reindex", folder, fmt.Errorf("not a PARA folder"))
+	}
+
+	var changed map[string]struct{}
+	if options.Since != "" {
+		paths, err := changedSince(root, options.Since)
+		if err != nil {
+			return nil, err
+		}
+		changed = utils.ListToMap(paths)
+	}
+
+	var files []string
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if _, found := skipNamesMap[entry.Name()]; found {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relativeFilePath, err := filepath.Rel(root, path)
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		relativeFilePath = filepath.ToSlash(relativeFilePath)
+
+		if !isValidForMetadata(relativeFilePath) {
+			return nil
+		}
+		if folder != "" && !strings.HasPrefix(relativeFilePath, folder+"/") {
+			return nil
+		}
+		if changed != nil {
+			if _, found := changed[relativeFilePath]; !found {
+				return nil
+			}
+		}
+		if options.OnlyMissing && metadataExists(t.config, relativeFilePath) {
+			return nil
+		}
+		files = append(files, relativeFilePath)
+		return nil
+	})
+	if err != nil {
+		return nil, permanentError("list files to reindex", "", err)
+	}
+	return files, nil
+}
+
+// changedSince returns the files changed between the commit and HEAD.
+func changedSince(root string, since string) ([]string, error) {
+	repo, err := git.PlainOpen(root)
+	if err != nil {
+		return nil, fatalError("open git repo", err)
+	}
+	sinceHash, err := repo.ResolveRevision(plumbing.Revision(since))
+	if err != nil {
+		return nil, permanentError("resolve commit", since, err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return nil, fatalError("get current HEAD", err)
+	}
+	paths, err := getPulledFiles(repo, *sinceHash, head.Hash())
+	if err != nil {
+		return nil, permanentError("get changed files", since, err)
+	}
+	return paths, nil
+}
+
+// Reindex enriches or re-upserts the files selected by the options, including
+// the ones git never reported as changed. Files whose metadata is up to date are
+// written to the database again from z-metadata without calling the LLM, the
+// rest are enriched. Files are processed in batches and the completed ones are
+// saved after each batch, so an interrupted reindex with the same options
+// resumes with the files it did not complete, failed and new ones included.
+func (t *MetadataEnricher) Reindex(ctx context.Context, options ReindexOptions) (*ReindexReport, error) {
+	if options.BatchSize <= 0 {
+		options.BatchSize = t.batchSize()
+	}
+	report := &ReindexReport{}
+
+	files, err := t.reindexFiles(options)
+	if err != nil {
+		return report, err
+	}
+	report.Files = len(files)
+
+	savedOptions, err := t.store.GetMeta(reindexOptionsKey)
+	if err != nil {
+		return report, fatalError("get reindex progress", err)
+	}
+	done := map[string]struct{}{}
+	if !options.Restart && savedOptions == options.String() {
+		if done, err = t.reindexDone(); err != nil {
+			return report, err
+		}
+	}
+	if len(done) > 0 {
+		remaining := files[:0]
+		for _, file := range files {
+			if _, found := done[file]; found {
+				report.Resumed++
+				continue
+			}
+			remaining = append(remaining, file)
+		}
+		files = remaining
+		log.Printf("Resuming reindex (%d files already done)\n", report.Resumed)
+	}
+	if err := t.store.PutMeta(reindexOptionsKey, options.String()); err != nil {
+		return report, fatalError("save reindex progress", err)
+	}
+
+	for start := 0; start < len(files); start += options.BatchSize {
+		end := start + options.BatchSize
+		if end > len(files) {
+			end = len(files)
+		}
+		batch := files[start:end]
+		failures := len(report.Failures)
+		if err := t.reindexBatch(ctx, batch, report); err != nil {
+			return report, err
+		}
+
+		failed := map[string]struct{}{}
+		for _, failure := range report.Failures[failures:] {
+			failed[failure.Change.Path] = struct{}{}
+		}
+		for _, file := range batch {
+			if _, found := failed[file]; !found {
+				done[file] = struct{}{}
+			}
+		}
+		if err := t.saveReindexDone(done); err != nil {
+			return report, err
+		}
+		log.Printf("Reindexed %d of %d files\n", report.Resumed+end, report.Files)
+	}
+
+	if err := t.store.PutMeta(reindexDoneKey, ""); err != nil {
+		return report, fatalError("save reindex progress", err)
+	}
+	return report, nil
+}
+
+// reindexDone returns the files completed by an interrupted reindex.
+func (t *MetadataEnricher) reindexDone() (map[string]struct{}, error) {
+	saved, err := t.store.GetMeta(reindexDoneKey)
+	if err != nil {
+		return nil, fatalError("get reindex progress", err)
+	}
+	if saved == "" {
+		return map[string]struct{}{}, nil
+	}
+	var files []string
+	if err := json.Unmarshal([]byte(saved), &files); err != nil {
+		log.Printf("Ignoring unreadable reindex progress: %v\n", err)
+		return map[string]struct{}{}, nil
+	}
+	return utils.ListToMap(files), nil
+}
+
+func (t *MetadataEnricher) saveReindexDone(done map[string]struct{}) error {
+	files := make([]string, 0, len(done))
+	for file := range done {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	saved, err := json.Marshal(files)
+	if err != nil {
+		return fatalError("save reindex progress", err)
+	}
+	if err := t.store.PutMeta(reindexDoneKey, string(saved)); err != nil {
+		return fatalError("save reindex progress", err)
+	}
+	return nil
+}
+
+// reindexBatch upserts the files with up to date metadata in batch requests and
+// submits the others for enrichment.
+func (t *MetadataEnricher) reindexBatch(ctx context.Context, files []string, report *ReindexReport) error {
+	version, err := currentMetadataVersion()
+	if err != nil {
+		return err
+	}
+
+	changeSet := &ChangeSet{}
+	upserts := &ChangeSet{}
+	var writes []*pendingWrite
+	for _, relativeFilePath := range files {
+		change := &FileChange{Path: relativeFilePath, Status: git.Modified}
+		write, err := t.upToDateWrite(relativeFilePath, version)
+		if err != nil {
+			report.Failures = append(report.Failures, FailedChange{Change: change, Err: err})
+			continue
+		}
+		if write == nil {
+			changeSet.Changes = append(changeSet.Changes, change)
+			continue
+		}
+		write.change = change
+		upserts.Changes = append(upserts.Changes, change)
+		writes = append(writes, write)
+	}
+
+	t.writeObjects(ctx, upserts, writes)
+	if err := ctx.Err(); err != nil {
+		return fatalError("reindex", err)
+	}
+	upsertFailures := upserts.Failures()
+	report.Upserted += len(writes) - len(upsertFailures)
+	report.Failures = append(report.Failures, upsertFailures...)
+
+	if len(changeSet.Changes) == 0 {
+		return nil
+	}
+	if err := t.HandleChangeSet(ctx, changeSet); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return fatalError("reindex", err)
+	}
+	failed := changeSet.Failures()
+	report.Enriched += len(changeSet.Changes) - len(failed)
+	report.Failures = append(report.Failures, failed...)
+	return nil
+}
+
+// upToDateWrite returns the database objects of the file built from its
+// metadata in z-metadata and its content, or nil when the file must be enriched
+// first.
+func (t *MetadataEnricher) upToDateWrite(relativeFilePath string, version metadataVersion) (*pendingWrite, error) {
+	fileState, err := t.store.Get(relativeFilePath)
+	if err != nil {
+		return nil, transientError("get file state", relativeFilePath, err)
+	}
+	if !version.enriched(fileState) {
+		return nil, nil
+	}
+
+	content, err := readFileForMetadata(t.config, relativeFilePath)
+	if err != nil || content == nil {
+		return nil, err
+	}
+	hash := contentHash(normalizeContent(content))
+	if fileState.ContentHash != hash {
+		return nil, nil
+	}
+
+	metadataFilePath := fmt.Sprintf("%s.json", filepath.Join(t.config.Repository.Path, "z-metadata", relativeFilePath))
+	metadataContent, err := os.ReadFile(metadataFilePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, permanentError("read metadata", relativeFilePath, err)
+	}
+	var properties map[string]interface{}
+	if err := json.Unmarshal(metadataContent, &properties); err != nil {
+		// Broken metadata is generated again.
+		return nil, nil
+	}
+
+	object := metadataObject(relativeFilePath, properties, hash)
+	chunks := t.chunkObjects(relativeFilePath, content, hash)
+	write := &pendingWrite{
+		objects: append([]*models.Object{object}, chunks...),
+		commit: func() error {
+			return t.store.Update(relativeFilePath, func(fileState *state.FileState) {
+				fileState.ObjectID = object.ID.String()
+			})
+		},
+	}
+	if len(chunks) > 0 {
+		write.chunkHash = hash
+	}
+	return write, nil
+}
@@ -0,0 +1,413 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/margostino/babel-agent/internal/config"
+	"github.com/margostino/babel-agent/internal/llm"
+	"github.com/margostino/babel-agent/internal/state"
+)
+
+// SyncState is a step of the sync cycle. The state is saved in the state store
+// on every transition, so that a cycle interrupted by a crash is recovered on
+// the next start.
+type SyncState string
+
+const (
+	// SyncIdle is the state between cycles.
+	SyncIdle SyncState = "idle"
+	// SyncSnapshot collects the local changes.
+	SyncSnapshot SyncState = "snapshot"
+	// SyncProcess runs the tools pipeline over the collected changes.
+	SyncProcess SyncState = "process"
+	// SyncCommit commits the work tree.
+	SyncCommit SyncState = "commit"
+	// SyncFetch fetches the remote branch.
+	SyncFetch SyncState = "fetch"
+	// SyncIntegrate brings the remote commits into the local branch.
+	SyncIntegrate SyncState = "integrate"
+	// SyncPush pushes the local commits, going back to SyncFetch when the remote
+	// rejects them for having new commits.
+	SyncPush SyncState = "push"
+)
+
+const syncStateKey = "sync.state"
+
+// syncCycle moves a sync cycle from state to state, committing the local
+// changes before anything is pulled so that no remote change lands on an
+// uncommitted edit.
+type syncCycle struct {
+	registry *Registry
+	config   *config.Config
+	store    *state.Store
+	provider llm.Provider
+	repo     *git.Repository
+	workTree *git.Worktree
+	state    SyncState
+	// changeSet holds the changes processed in the cycle, pending the ones
+	// collected for the next process state.
+	changeSet *ChangeSet
+	pending   *ChangeSet
+	// localChanges is set when the snapshot found changes to process.
+	localChanges bool
+	integrated   bool
+	pushRetries  int
+	// offline stops the cycle after the commit, the remote is not reached.
+	offline bool
+}
+
+func (c *syncCycle) run(ctx context.Context, changedPaths []string, retries []*FileChange) error {
+	defer func() {
+		// A cycle that returns, failed or not, leaves nothing to recover.
+		if err := c.transition(SyncIdle); err != nil {
+			log.Printf("Failed to save sync state: %v\n", err)
+		}
+	}()
+
+	next := SyncSnapshot
+	for next != SyncIdle {
+		if c.offline && next == SyncFetch {
+			break
+		}
+		if err := c.transition(next); err != nil {
+			return err
+		}
+		var err error
+		switch next {
+		case SyncSnapshot:
+			next, err = c.snapshot(changedPaths, retries)
+		case SyncProcess:
+			next, err = c.process(ctx)
+		case SyncCommit:
+			next, err = c.commit(ctx)
+		case SyncFetch:
+			next, err = c.fetch(ctx)
+		case SyncIntegrate:
+			next, err = c.integrate()
+		case SyncPush:
+			next, err = c.push(ctx)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *syncCycle) transition(next SyncState) error {
+	if next == c.state {
+		return nil
+	}
+	log.Printf("Sync %s -> %s\n", c.state, next)
+	c.state = next
+	if err := c.store.PutMeta(syncStateKey, string(next)); err != nil {
+		return transientError("save sync state", "", err)
+	}
+	return nil
+}
+
+// snapshot collects the changes reported by git status, only the changed paths
+// among them when given, and the retries.
+func (c *syncCycle) snapshot(changedPaths []string, retries []*FileChange) (SyncState, error) {
+	status, err := c.workTree.Status()
+	if err != nil {
+		return SyncIdle, transientError("get status", "", err)
+	}
+	if changedPaths != nil {
+		status = filterStatus(status, changedPaths)
+	}
+
+	changes := &ChangeSet{}
+	for file, fileStatus := range status {
+		if isValidForMetadata(file) {
+			changes.Changes = append(changes.Changes, &FileChange{Path: file, Status: fileStatus.Worktree})
+		}
+	}
+	for _, retry := range retries {
+		if _, found := status[retry.Path]; !found {
+			changes.Changes = append(changes.Changes, &FileChange{Path: retry.Path, Status: retry.Status})
+		}
+	}
+
+	if status.IsClean() && len(changes.Changes) == 0 {
+		return SyncFetch, nil
+	}
+	c.localChanges = true
+	c.pending = changes
+	return SyncProcess, nil
+}
+
+// process runs the tools pipeline over the pending changes.
+func (c *syncCycle) process(ctx context.Context) (SyncState, error) {
+	pending := c.pending
+	c.pending = nil
+	err := c.registry.Run(ctx, pending)
+	c.changeSet.add(pending)
+	if err != nil {
+		return SyncIdle, err
+	}
+	return SyncCommit, nil
+}
+
+// commit commits every change of the work tree, the notes and what the tools
+// wrote for them. Notes changed besides the processed ones, e.g. while the
+// watcher waited for another path, are processed first: a note committed
+// without going through the pipeline would never be enriched, git status no
+// longer reports it.
+func (c *syncCycle) commit(ctx context.Context) (SyncState, error) {
+	next := SyncFetch
+	if c.integrated {
+		next = SyncPush
+	}
+
+	if _, err := c.workTree.Add("."); err != nil {
+		return SyncIdle, transientError("add files to git", "", err)
+	}
+	status, err := c.workTree.Status()
+	if err != nil {
+		return SyncIdle, transientError("get status", "", err)
+	}
+	if status.IsClean() {
+		return next, nil
+	}
+	if unprocessed := c.unprocessed(status); len(unprocessed.Changes) > 0 {
+		log.Printf("%d changed notes were not processed yet, processing them before committing\n", len(unprocessed.Changes))
+		c.pending = unprocessed
+		return SyncProcess, nil
+	}
+
+	now := time.Now()
+	info := newCommitInfo(status, now)
+	log.Printf("Tracked files: %d (modified: %d added: %d deleted: %d)\n", len(status), info.Modified, info.Added, info.Deleted)
+
+	changes, err := stagedNoteChanges(c.config, c.repo, status)
+	if err != nil {
+		return SyncIdle, err
+	}
+	message, err := commitMessage(ctx, c.config, c.provider, changes, info)
+	if err != nil {
+		return SyncIdle, err
+	}
+	commit, err := c.workTree.Commit(message, &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  c.config.User.Username,
+			Email: c.config.User.Email,
+			When:  now,
+		},
+	})
+	if err != nil {
+		return SyncIdle, transientError("commit", "", err)
+	}
+	log.Printf("Committed [%s]\n", commit.String())
+	return next, nil
+}
+
+// unprocessed returns the staged notes missing in the change set of the cycle.
+func (c *syncCycle) unprocessed(status git.Status) *ChangeSet {
+	processed := map[string]struct{}{}
+	for _, change := range c.changeSet.Changes {
+		processed[change.Path] = struct{}{}
+	}
+	changes := &ChangeSet{}
+	for file, fileStatus := range status {
+		if _, found := processed[file]; found || fileStatus.Staging == git.Unmodified || !isValidForMetadata(file) {
+			continue
+		}
+		changeStatus := git.Modified
+		if fileStatus.Staging == git.Deleted {
+			changeStatus = git.Deleted
+		}
+		changes.Changes = append(changes.Changes, &FileChange{Path: file, Status: changeStatus})
+	}
+	return changes
+}
+
+func (c *syncCycle) fetch(ctx context.Context) (SyncState, error) {
+	err := c.repo.FetchContext(ctx, &git.FetchOptions{RemoteName: "origin", Auth: c.config.GitAuth()})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return SyncIdle, remoteError("fetch", err)
+	}
+	return SyncIntegrate, nil
+}
+
+// remoteBranch returns the remote-tracking reference of the branch, nil when
+// the remote does not have the branch yet.
+func remoteBranch(repo *git.Repository, head *plumbing.Reference) (*plumbing.Reference, error) {
+	ref, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", head.Name().Short()), true)
+	if err == plumbing.ErrReferenceNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, transientError("get remote branch", "", err)
+	}
+	return ref, nil
+}
+
+// integrate brings the fetched commits into the local branch. What the
+// integration leaves in the work tree (conflict copies, merged metadata) and
+// the notes pulled along with local changes, new or committed in an earlier
+// cycle, are processed and committed before pushing.
+func (c *syncCycle) integrate() (SyncState, error) {
+	head, err := c.repo.Head()
+	if err != nil {
+		return SyncIdle, fatalError("get current HEAD", err)
+	}
+	remote, err := remoteBranch(c.repo, head)
+	if err != nil || remote == nil {
+		return SyncPush, err
+	}
+	pulledFiles, replayed, err := integrate(c.config, c.repo, c.workTree, head.Hash(), remote.Hash())
+	if err != nil {
+		return SyncIdle, err
+	}
+	c.integrated = true
+	if len(pulledFiles) > 0 {
+		log.Printf("Pulled changes %d files from remote\n", len(pulledFiles))
+	}
+
+	status, err := c.workTree.Status()
+	if err != nil {
+		return SyncIdle, transientError("get status", "", err)
+	}
+	changes := &ChangeSet{}
+	for file, fileStatus := range status {
+		if isValidForMetadata(file) {
+			changes.Changes = append(changes.Changes, &FileChange{Path: file, Status: fileStatus.Worktree})
+		}
+	}
+	if c.localChanges || replayed > 0 {
+		for _, file := range pulledFiles {
+			if _, found := status[file]; found || !isValidForMetadata(file) {
+				continue
+			}
+			pulledStatus := git.Modified
+			if _, err := os.Stat(filepath.Join(c.config.Repository.Path, file)); os.IsNotExist(err) {
+				pulledStatus = git.Deleted
+			}
+			changes.Changes = append(changes.Changes, &FileChange{Path: file, Status: pulledStatus})
+		}
+	}
+
+	if status.IsClean() && len(changes.Changes) == 0 {
+		return SyncPush, nil
+	}
+	c.pending = changes
+	return SyncProcess, nil
+}
+
+// push pushes the local commits the remote lacks. A rejection because the
+// remote moved since the fetch is retried from SyncFetch.
+func (c *syncCycle) push(ctx context.Context) (SyncState, error) {
+	head, err := c.repo.Head()
+	if err != nil {
+		return SyncIdle, fatalError("get current HEAD", err)
+	}
+	remote, err := remoteBranch(c.repo, head)
+	if err != nil {
+		return SyncIdle, err
+	}
+	if remote != nil && remote.Hash() == head.Hash() {
+		c.removeBackup()
+		return SyncIdle, nil
+	}
+
+	err = c.repo.PushContext(ctx, &git.PushOptions{RemoteName: "origin", Auth: c.config.GitAuth()})
+	if err == nil || err == git.NoErrAlreadyUpToDate {
+		log.Printf("Commit [%s] pushed successfully\n", head.Hash().String())
+		c.removeBackup()
+		return SyncIdle, nil
+	}
+	if isPushRejected(err) && c.pushRetries < c.config.Sync.PushRetries {
+		c.pushRetries++
+		log.Printf("Push rejected, the remote has new commits (retry %d of %d): %v\n", c.pushRetries, c.config.Sync.PushRetries, err)
+		return SyncFetch, nil
+	}
+	return SyncIdle, remoteError("push", err)
+}
+
+// removeBackup removes the backup of the local commits once the remote has
+// them, replayed on top of its own commits.
+func (c *syncCycle) removeBackup() {
+	if _, err := c.repo.Reference(backupRefName, false); err != nil {
+		return
+	}
+	if err := c.repo.Storer.RemoveReference(backupRefName); err != nil {
+		log.Printf("Failed to remove %s: %v\n", backupRefName, err)
+	}
+}
+
+// isPushRejected reports whether the push failed because the remote branch has
+// commits missing locally, whether go-git or the remote noticed it.
+func isPushRejected(err error) bool {
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return true
+	}
+	message := err.Error()
+	return strings.Contains(message, "non-fast-forward") || strings.Contains(message, "fetch first")
+}
+
+// RecoverSync cleans up after a sync cycle interrupted by a crash, before the
+// first cycle of the agent. Local changes are never discarded: whatever was not
+// committed yet is still in the work tree and is committed by the next cycle.
+func RecoverSync(config *config.Config, store *state.Store) error {
+	previous, err := store.GetMeta(syncStateKey)
+	if err != nil {
+		return transientError("get sync state", "", err)
+	}
+	if previous == "" || SyncState(previous) == SyncIdle {
+		return nil
+	}
+	log.Printf("Recovering the sync cycle interrupted in state %s\n", previous)
+
+	repo, err := git.PlainOpen(config.Repository.Path)
+	if err != nil {
+		return fatalError("open git repo", err)
+	}
+	workTree, err := repo.Worktree()
+	if err != nil {
+		return fatalError("get work tree from repo", err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return fatalError("get current HEAD", err)
+	}
+
+	if _, err := repo.Storer.Index(); err != nil {
+		log.Printf("Rebuilding the git index from HEAD, it could not be read: %v\n", err)
+		if err := repo.Storer.SetIndex(&index.Index{Version: 2}); err != nil {
+			return fatalError("rebuild git index", err)
+		}
+		if err := workTree.Reset(&git.ResetOptions{Commit: head.Hash(), Mode: git.MixedReset}); err != nil {
+			return fatalError("rebuild git index", err)
+		}
+	}
+
+	// The backup of an interrupted integration is kept under its own name, so
+	// that the next integration does not overwrite it before the changes
+	// restored in the work tree are committed and pushed.
+	if backup, err := repo.Reference(backupRefName, false); err == nil && backup.Hash() != head.Hash() {
+		interrupted := plumbing.ReferenceName(interruptedRefPrefix + time.Now().UTC().Format("20060102T150405Z"))
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(interrupted, backup.Hash())); err != nil {
+			return transientError("save backup ref", "", err)
+		}
+		if err := repo.Storer.RemoveReference(backupRefName); err != nil {
+			return transientError("remove backup ref", "", err)
+		}
+		log.Printf("Integration of the remote commits was interrupted, the changes of the local commits stay in the work tree and the commits are kept as %s\n", interrupted)
+	}
+
+	if err := store.PutMeta(syncStateKey, string(SyncIdle)); err != nil {
+		return transientError("save sync state", "", err)
+	}
+	return nil
+}
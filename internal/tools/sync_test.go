@@ -0,0 +1,231 @@
+package tools_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/margostino/babel-agent/internal/db"
+	"github.com/margostino/babel-agent/internal/testharness"
+	"github.com/margostino/babel-agent/internal/tools"
+)
+
+const syncStateKey = "sync.state"
+
+func TestUpdateGitPullsRemoteChanges(t *testing.T) {
+	h := testharness.New(t, nil)
+	other := h.Repo.Clone()
+	other.WriteFile("RESOURCES/rust", "# Rust\n\nOwnership.\n")
+	other.Commit("Add rust")
+	other.Push()
+
+	// Without local changes the pulled note is only checked out: the agent
+	// that pushed it enriched it.
+	if _, err := h.UpdateGit(context.Background(), nil); err != nil {
+		t.Fatalf("UpdateGit() = %v", err)
+	}
+	if got := h.Repo.ReadFile("RESOURCES/rust"); got != "# Rust\n\nOwnership.\n" {
+		t.Errorf("pulled note = %q", got)
+	}
+	if len(h.LLM.Requests()) != 0 {
+		t.Errorf("the pulled note was enriched again (%d requests)", len(h.LLM.Requests()))
+	}
+	if log := h.Repo.RemoteLog(); !reflect.DeepEqual(log, []string{"Add rust", "Initial commit"}) {
+		t.Errorf("remote log = %q", log)
+	}
+
+	// Pulled along with local changes, it is processed with them.
+	other.WriteFile("RESOURCES/zig", "# Zig\n\nComptime.\n")
+	other.Commit("Add zig")
+	other.Push()
+	h.Repo.WriteFile("RESOURCES/go", "# Go\n\nChannels.\n")
+	if _, err := h.UpdateGit(context.Background(), nil); err != nil {
+		t.Fatalf("UpdateGit() with local changes = %v", err)
+	}
+	for _, path := range []string{"RESOURCES/go", "RESOURCES/zig"} {
+		if h.Weaviate.ObjectByPath(db.ClassName, path) == nil {
+			t.Errorf("%s was not indexed", path)
+		}
+	}
+	if h.Repo.ReadFile("RESOURCES/zig") != "# Zig\n\nComptime.\n" {
+		t.Error("RESOURCES/zig was not pulled")
+	}
+	if log := h.Repo.RemoteLog(); len(log) < 4 || log[len(log)-3] != "Add zig" {
+		t.Errorf("remote log = %q, want the local commits on top of the pulled ones", log)
+	}
+	if !h.Repo.Status().IsClean() {
+		t.Errorf("work tree not clean after the sync: %v", h.Repo.Status())
+	}
+}
+
+func TestUpdateGitCommitsBeforePulling(t *testing.T) {
+	h := testharness.New(t, nil)
+	other := h.Repo.Clone()
+	other.WriteFile("RESOURCES/rust", "# Rust\n\nOwnership.\n")
+	other.Commit("Add rust")
+	other.Push()
+
+	var mu sync.Mutex
+	states := map[string]string{}
+	h.LLM.Respond(func(request testharness.ChatRequest) (string, int) {
+		syncState, _ := h.Store.GetMeta(syncStateKey)
+		mu.Lock()
+		states[request.FilePath()] = syncState
+		mu.Unlock()
+		return testharness.DefaultResponse(request)
+	})
+	h.Repo.WriteFile("RESOURCES/go", "# Go\n\nChannels.\n")
+	if _, err := h.UpdateGit(context.Background(), nil); err != nil {
+		t.Fatalf("UpdateGit() = %v", err)
+	}
+
+	want := map[string]string{"RESOURCES/go": string(tools.SyncProcess), "RESOURCES/rust": string(tools.SyncProcess)}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("sync states of the LLM requests = %v, want %v", states, want)
+	}
+	// The local note was committed on its own, before the remote commit was
+	// pulled, and replayed on top of it.
+	log := h.Repo.RemoteLog()
+	if len(log) < 3 || log[len(log)-2] != "Add rust" {
+		t.Fatalf("remote log = %q, want the local commits on top of the remote one", log)
+	}
+	head, err := h.Repo.Repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := h.Repo.Repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(log)-3; i++ {
+		if commit, err = commit.Parent(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := commit.File("RESOURCES/go"); err != nil {
+		t.Errorf("the commit on top of the remote one lacks the local note: %v", err)
+	}
+	if syncState, _ := h.Store.GetMeta(syncStateKey); syncState != string(tools.SyncIdle) {
+		t.Errorf("sync state = %q, want %q", syncState, tools.SyncIdle)
+	}
+}
+
+func TestUpdateGitRetriesRejectedPush(t *testing.T) {
+	h := testharness.New(t, nil)
+	other := h.Repo.Clone()
+	other.WriteFile("RESOURCES/rust", "# Rust\n\nOwnership.\n")
+	other.Commit("Add rust")
+	other.Push()
+
+	// The pulled note is processed after the fetch: pushing from the other
+	// machine then makes the remote move before the agent pushes.
+	third := h.Repo.Clone()
+	var once sync.Once
+	h.LLM.Respond(func(request testharness.ChatRequest) (string, int) {
+		if request.FilePath() == "RESOURCES/rust" {
+			once.Do(func() {
+				third.WriteFile("RESOURCES/zig", "# Zig\n\nComptime.\n")
+				third.Commit("Add zig")
+				third.Push()
+			})
+		}
+		return testharness.DefaultResponse(request)
+	})
+	h.Repo.WriteFile("RESOURCES/go", "# Go\n\nChannels.\n")
+	if _, err := h.UpdateGit(context.Background(), nil); err != nil {
+		t.Fatalf("UpdateGit() = %v", err)
+	}
+
+	if h.Repo.ReadFile("RESOURCES/zig") != "# Zig\n\nComptime.\n" {
+		t.Error("the commit pushed during the cycle was not integrated")
+	}
+	log := h.Repo.RemoteLog()
+	if len(log) < 4 || log[len(log)-3] != "Add zig" {
+		t.Errorf("remote log = %q, want the local commits on top of both remote ones", log)
+	}
+	if !h.Repo.Status().IsClean() {
+		t.Errorf("work tree not clean after the sync: %v", h.Repo.Status())
+	}
+}
+
+func TestRecoverSync(t *testing.T) {
+	h := testharness.New(t, map[string]string{"RESOURCES/go": "# Go\n\nChannels.\n"})
+	initial, err := h.Repo.Repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Repo.WriteFile("RESOURCES/rust", "# Rust\n\nOwnership.\n")
+	h.Repo.Commit("Local commit")
+
+	// A crash while integrating: the state says so, the index is corrupt and
+	// the backup of the local commits is left behind.
+	h.Repo.WriteFile("RESOURCES/zig", "# Zig\n\nComptime.\n")
+	if err := os.WriteFile(filepath.Join(h.Repo.Path, ".git", "index"), []byte("DIRC broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backup := plumbing.NewHashReference("refs/babel-agent/local", initial.Hash())
+	if err := h.Repo.Repo.Storer.SetReference(backup); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Store.PutMeta(syncStateKey, string(tools.SyncIntegrate)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tools.RecoverSync(h.Config, h.Store); err != nil {
+		t.Fatalf("RecoverSync() = %v", err)
+	}
+	if syncState, _ := h.Store.GetMeta(syncStateKey); syncState != string(tools.SyncIdle) {
+		t.Errorf("sync state = %q, want %q", syncState, tools.SyncIdle)
+	}
+	if _, err := h.Repo.Repo.Reference("refs/babel-agent/local", false); err == nil {
+		t.Error("the backup was left where the next integration overwrites it")
+	}
+	kept := false
+	refs, err := h.Repo.Repo.References()
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Hash() == initial.Hash() && filepath.Dir(ref.Name().String()) == "refs/babel-agent/interrupted" {
+			kept = true
+		}
+		return nil
+	})
+	if !kept {
+		t.Error("the backup of the interrupted integration was deleted")
+	}
+
+	// Nothing local was lost: the next cycle commits and pushes it.
+	if _, err := h.UpdateGit(context.Background(), nil); err != nil {
+		t.Fatalf("UpdateGit() after recovering = %v", err)
+	}
+	if h.Repo.ReadFile("RESOURCES/zig") != "# Zig\n\nComptime.\n" {
+		t.Error("the uncommitted note was lost")
+	}
+	if h.Weaviate.ObjectByPath(db.ClassName, "RESOURCES/zig") == nil {
+		t.Error("the uncommitted note was not indexed")
+	}
+	if log := h.Repo.RemoteLog(); len(log) != 3 || log[1] != "Local commit" {
+		t.Errorf("remote log = %q, want the local commit pushed", log)
+	}
+	if !h.Repo.Status().IsClean() {
+		t.Errorf("work tree not clean after the sync: %v", h.Repo.Status())
+	}
+}
+
+func TestRecoverSyncAfterCleanStop(t *testing.T) {
+	h := testharness.New(t, nil)
+	if err := tools.RecoverSync(h.Config, h.Store); err != nil {
+		t.Fatalf("RecoverSync() without a previous cycle = %v", err)
+	}
+	if err := h.Store.PutMeta(syncStateKey, string(tools.SyncIdle)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tools.RecoverSync(h.Config, h.Store); err != nil {
+		t.Fatalf("RecoverSync() after an idle stop = %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/margostino/babel-agent/internal/config"
+)
+
+// FileChange is a single path of a change set. Tools may rewrite Path (e.g. when
+// a file gets renamed) so that the following tools see the new location.
+type FileChange struct {
+	Path   string
+	Status git.StatusCode
+}
+
+func (f *FileChange) IsDeleted() bool {
+	return f.Status == git.Deleted
+}
+
+func (f *FileChange) IsUntracked() bool {
+	return f.Status == git.Untracked
+}
+
+type FailedChange struct {
+	Change *FileChange
+	Err    error
+}
+
+type ChangeSet struct {
+	Changes []*FileChange
+
+	mu       sync.Mutex
+	failures []FailedChange
+}
+
+// Fail records that a tool could not process the change. It is safe to call
+// from concurrent handlers.
+func (c *ChangeSet) Fail(change *FileChange, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	log.Printf("Failed to process file %s (%s error): %v\n", change.Path, KindOf(err), err)
+	c.failures = append(c.failures, FailedChange{Change: change, Err: err})
+}
+
+// add appends the changes and failures of another change set.
+func (c *ChangeSet) add(other *ChangeSet) {
+	failures := other.Failures()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Changes = append(c.Changes, other.Changes...)
+	c.failures = append(c.failures, failures...)
+}
+
+func (c *ChangeSet) Failures() []FailedChange {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]FailedChange{}, c.failures...)
+}
+
+// Tool is a step of the pipeline run over every change set. A tool must also
+// implement FileHandler, ChangeSetHandler or both.
+type Tool interface {
+	Name() string
+	Enabled() bool
+	// DependsOn lists the names of the tools that must run before this one when
+	// they are part of the pipeline.
+	DependsOn() []string
+}
+
+// FileHandler processes the changes of a change set one at a time.
+type FileHandler interface {
+	HandleFile(ctx context.Context, change *FileChange) error
+}
+
+// ChangeSetHandler processes a whole change set at once.
+type ChangeSetHandler interface {
+	HandleChangeSet(ctx context.Context, changeSet *ChangeSet) error
+}
+
+type Registry struct {
+	config *config.Config
+	tools  map[string]Tool
+	names  []string
+}
+
+// NewRegistry creates an empty registry. When the configured pipeline is not
+// empty only the tools listed there are run, preferably in that order.
+func NewRegistry(config *config.Config) *Registry {
+	return &Registry{
+		config: config,
+		tools:  make(map[string]Tool),
+	}
+}
+
+func (r *Registry) Register(tool Tool) error {
+	_, isFileHandler := tool.(FileHandler)
+	_, isChangeSetHandler := tool.(ChangeSetHandler)
+	if !isFileHandler && !isChangeSetHandler {
+		return fmt.Errorf("tool %s has no file or change set handler", tool.Name())
+	}
+	if _, found := r.tools[tool.Name()]; found {
+		return fmt.Errorf("tool %s is already registered", tool.Name())
+	}
+	r.tools[tool.Name()] = tool
+	r.names = append(r.names, tool.Name())
+	return nil
+}
+
+// Pipeline returns the enabled tools sorted so that every tool runs after its
+// dependencies.
+func (r *Registry) Pipeline() ([]Tool, error) {
+	names := r.names
+	if len(r.config.Tools.Pipeline) > 0 {
+		names = r.config.Tools.Pipeline
+	}
+
+	rank := make(map[string]int)
+	for i, name := range names {
+		tool, found := r.tools[name]
+		if !found {
+			return nil, fmt.Errorf("tool %s is not registered", name)
+		}
+		if tool.Enabled() {
+			rank[name] = i
+		}
+	}
+
+	var ordered []Tool
+	visited := make(map[string]bool)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		done, seen := visited[name]
+		if seen && done {
+			return nil
+		}
+		if seen {
+			return fmt.Errorf("tool dependency cycle: %v", append(path, name))
+		}
+		visited[name] = false
+
+		tool := r.tools[name]
+		dependencies := append([]string{}, tool.DependsOn()...)
+		sort.SliceStable(dependencies, func(i, j int) bool {
+			return rank[dependencies[i]] < rank[dependencies[j]]
+		})
+		for _, dependency := range dependencies {
+			if _, found := r.tools[dependency]; !found {
+				return fmt.Errorf("tool %s depends on unknown tool %s", name, dependency)
+			}
+			// Dependencies outside of the pipeline only constrain the order.
+			if _, enabled := rank[dependency]; !enabled {
+				continue
+			}
+			if err := visit(dependency, append(path, name)); err != nil {
+				return err
+			}
+		}
+
+		visited[name] = true
+		ordered = append(ordered, tool)
+		return nil
+	}
+
+	for _, name := range names {
+		if _, enabled := rank[name]; !enabled {
+			continue
+		}
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return ordered, nil
+}
+
+// Run runs the pipeline over the change set. Files that fail are recorded in the
+// change set and do not prevent the following files or tools from running; only
+// fatal errors stop the pipeline.
+func (r *Registry) Run(ctx context.Context, changeSet *ChangeSet) error {
+	pipeline, err := r.Pipeline()
+	if err != nil {
+		return fatalError("build pipeline", err)
+	}
+
+	for _, tool := range pipeline {
+		if handler, ok := tool.(FileHandler); ok {
+			for _, change := range changeSet.Changes {
+				if err := handler.HandleFile(ctx, change); err != nil {
+					if KindOf(err) == Fatal {
+						return err
+					}
+					changeSet.Fail(change, err)
+				}
+			}
+		}
+		if handler, ok := tool.(ChangeSetHandler); ok {
+			if err := handler.HandleChangeSet(ctx, changeSet); err != nil {
+				if KindOf(err) == Fatal {
+					return err
+				}
+				log.Printf("Tool %s failed: %v\n", tool.Name(), err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/margostino/babel-agent/internal/config"
+	"github.com/margostino/babel-agent/internal/llm"
+	"github.com/margostino/babel-agent/internal/metadata"
+	"github.com/margostino/babel-agent/internal/openai"
+)
+
+// ValidateMetadata parses the metadata returned by the model and checks it
+// against the metadata schema. Invalid metadata is repaired locally when the fix
+// is obvious, otherwise the model is asked to repair it. Metadata that is still
+// invalid is quarantined and a permanent error is returned.
+func ValidateMetadata(ctx context.Context, provider llm.Provider, config *config.Config, relativeFilePath string, metadataContent string) (map[string]interface{}, error) {
+	schema, err := metadata.LoadSchema()
+	if err != nil {
+		return nil, fatalError("load metadata schema", err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		var data map[string]interface{}
+		var violations []string
+		if err := json.Unmarshal([]byte(metadataContent), &data); err != nil {
+			violations = []string{fmt.Sprintf("$ is not a JSON object: %v", err)}
+		} else {
+			schema.Repair(data, relativeFilePath)
+			violations = schema.Validate(data)
+		}
+
+		if len(violations) == 0 {
+			return data, nil
+		}
+
+		if attempt >= config.Enrichment.RepairAttempts {
+			quarantineErr := quarantineMetadata(config, relativeFilePath, metadataContent, violations)
+			if quarantineErr != nil {
+				log.Printf("Failed to quarantine metadata of %s: %v\n", relativeFilePath, quarantineErr)
+			}
+			return nil, permanentError("validate metadata", relativeFilePath, fmt.Errorf("metadata does not follow the schema: %v", violations))
+		}
+
+		log.Printf("Metadata of %s does not follow the schema, asking for a repair: %v\n", relativeFilePath, violations)
+		metadataContent, err = openai.GetChatCompletionForMetadataRepair(ctx, provider, schema.String(), metadataContent, violations)
+		if err != nil {
+			return nil, llmError("repair metadata", relativeFilePath, err)
+		}
+	}
+}
+
+// quarantineMetadata keeps the invalid metadata under the state directory for
+// inspection, instead of writing it to z-metadata and the database.
+func quarantineMetadata(config *config.Config, relativeFilePath string, metadataContent string, violations []string) error {
+	quarantinePath := filepath.Join(config.Agent.StateDir, "quarantine", relativeFilePath+".json")
+	if err := os.MkdirAll(filepath.Dir(quarantinePath), 0755); err != nil {
+		return err
+	}
+
+	entry, err := json.MarshalIndent(map[string]interface{}{
+		"path":          relativeFilePath,
+		"response":      metadataContent,
+		"errors":        violations,
+		"quarantinedAt": time.Now(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Quarantined metadata of %s in %s\n", relativeFilePath, quarantinePath)
+	return os.WriteFile(quarantinePath, entry, 0644)
+}
@@ -0,0 +1,78 @@
+package tools_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/margostino/babel-agent/internal/db"
+	"github.com/margostino/babel-agent/internal/testharness"
+	"github.com/margostino/babel-agent/internal/tools"
+)
+
+func TestUpdateGitRefusesAdditionalProperties(t *testing.T) {
+	tests := []struct {
+		name string
+		// repaired is whether the model drops the property when asked to
+		// repair the metadata.
+		repaired bool
+	}{
+		{name: "repaired by the model", repaired: true},
+		{name: "quarantined", repaired: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := testharness.New(t, nil)
+			// The metadata of RESOURCES/go, with a property the schema does
+			// not allow.
+			respond := func(additional bool) (string, int) {
+				request := testharness.ChatRequest{Messages: []testharness.ChatMessage{{Content: "File Path: RESOURCES/go"}}}
+				content, status := testharness.DefaultResponse(request)
+				if additional {
+					content = strings.Replace(content, "{", `{"mood":"happy",`, 1)
+				}
+				return content, status
+			}
+			repairs := 0
+			h.LLM.Respond(func(request testharness.ChatRequest) (string, int) {
+				// Repair requests send the invalid metadata instead of a note.
+				if request.FilePath() == "" {
+					repairs++
+					return respond(!test.repaired)
+				}
+				return respond(true)
+			})
+			h.Repo.WriteFile("RESOURCES/go", "# Go\n\nChannels.\n")
+
+			changes, err := h.UpdateGit(context.Background(), nil)
+			if err != nil {
+				t.Fatalf("UpdateGit() = %v", err)
+			}
+			if repairs != h.Config.Enrichment.RepairAttempts {
+				t.Errorf("%d repair requests, want %d", repairs, h.Config.Enrichment.RepairAttempts)
+			}
+			object := h.Weaviate.ObjectByPath(db.ClassName, "RESOURCES/go")
+			_, quarantineErr := os.Stat(filepath.Join(h.Config.Agent.StateDir, "quarantine", "RESOURCES/go.json"))
+			if test.repaired {
+				if object == nil || object.Properties["mood"] != nil {
+					t.Errorf("object of RESOURCES/go = %+v, want it without the additional property", object)
+				}
+				if quarantineErr == nil {
+					t.Error("the repaired metadata was quarantined")
+				}
+				return
+			}
+			if object != nil {
+				t.Errorf("the invalid metadata was indexed: %+v", object)
+			}
+			if quarantineErr != nil {
+				t.Errorf("the invalid metadata was not quarantined: %v", quarantineErr)
+			}
+			if failures := changes.Failures(); len(failures) != 1 || tools.KindOf(failures[0].Err) != tools.Permanent {
+				t.Errorf("failures = %+v, want a permanent error", failures)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"net"
+	"net/url"
+)
+
+// IsLoopbackHost reports whether the host name or IP is the local machine.
+func IsLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// IsLocalOrigin reports whether the Origin header of a request is a page served
+// by the local machine.
+func IsLocalOrigin(origin string) bool {
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return IsLoopbackHost(parsed.Hostname())
+}
@@ -0,0 +1,7 @@
+// Package version holds the version of the agent, set at build time with
+//
+//	go build -ldflags "-X github.com/margostino/babel-agent/internal/version.Version=v1.2.3"
+package version
+
+// Version is the version of the agent, "dev" for local builds.
+var Version = "dev"
@@ -0,0 +1,180 @@
+package watcher
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/margostino/babel-agent/internal/utils"
+)
+
+// Watcher watches a repository recursively and emits debounced sets of changed
+// paths, relative to the repository root.
+type Watcher struct {
+	root      string
+	debounce  time.Duration
+	skipNames map[string]struct{}
+	fsWatcher *fsnotify.Watcher
+	// changes holds at most one change set, the paths changed since the
+	// consumer last received one.
+	changes chan []string
+}
+
+func NewWatcher(root string, debounce time.Duration, skipNames []string) (*Watcher, error) {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{
+		root:      filepath.Clean(root),
+		debounce:  debounce,
+		skipNames: utils.ListToMap(skipNames),
+		fsWatcher: fsWatcher,
+		changes:   make(chan []string, 1),
+	}
+
+	if err := w.addRecursive(w.root, nil); err != nil {
+		fsWatcher.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Changes returns the channel where debounced change sets are delivered. Sets
+// the consumer is too busy to receive are merged, so no path is lost and the
+// watcher never blocks.
+func (w *Watcher) Changes() <-chan []string {
+	return w.changes
+}
+
+// Run consumes filesystem events until the context is cancelled. Bursts of
+// events (e.g. editor saves) are collapsed into a single change set once no
+// new event has been seen for the debounce interval.
+func (w *Watcher) Run(ctx context.Context) {
+	defer w.fsWatcher.Close()
+
+	pending := make(map[string]struct{})
+	timer := time.NewTimer(w.debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case event, ok := <-w.fsWatcher.Events:
+			if !ok {
+				return
+			}
+			w.handleEvent(event, pending)
+			if len(pending) > 0 {
+				timer.Reset(w.debounce)
+			}
+		case err, ok := <-w.fsWatcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Watcher error: %v\n", err)
+		case <-timer.C:
+			if len(pending) == 0 {
+				continue
+			}
+			w.deliver(pending)
+			pending = make(map[string]struct{})
+		}
+	}
+}
+
+// deliver queues the pending paths for the consumer, merged with the change set
+// it has not received yet if any. The watcher is the only sender, so once the
+// queued set is taken back the send cannot block.
+func (w *Watcher) deliver(pending map[string]struct{}) {
+	select {
+	case queued := <-w.changes:
+		for _, path := range queued {
+			pending[path] = struct{}{}
+		}
+	default:
+	}
+
+	changeSet := make([]string, 0, len(pending))
+	for path := range pending {
+		changeSet = append(changeSet, path)
+	}
+	sort.Strings(changeSet)
+	w.changes <- changeSet
+}
+
+func (w *Watcher) handleEvent(event fsnotify.Event, pending map[string]struct{}) {
+	relativePath, ok := w.relativePath(event.Name)
+	if !ok {
+		return
+	}
+
+	if event.Has(fsnotify.Create) {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			// A new directory (or one moved into the tree) may already hold files,
+			// so it is watched and its content reported as changed.
+			if err := w.addRecursive(event.Name, pending); err != nil {
+				log.Printf("Failed to watch directory %s: %v\n", event.Name, err)
+			}
+			return
+		}
+	}
+
+	if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write) {
+		return
+	}
+
+	pending[relativePath] = struct{}{}
+}
+
+// relativePath returns the path relative to the repository root and whether it
+// should be reported at all.
+func (w *Watcher) relativePath(absolutePath string) (string, bool) {
+	relativePath, err := filepath.Rel(w.root, absolutePath)
+	if err != nil || relativePath == "." || strings.HasPrefix(relativePath, "..") {
+		return "", false
+	}
+	relativePath = filepath.ToSlash(relativePath)
+
+	for _, part := range strings.Split(relativePath, "/") {
+		if _, found := w.skipNames[part]; found {
+			return "", false
+		}
+	}
+
+	return relativePath, true
+}
+
+func (w *Watcher) addRecursive(root string, pending map[string]struct{}) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != w.root {
+			if _, found := w.skipNames[info.Name()]; found {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if info.IsDir() {
+			return w.fsWatcher.Add(path)
+		}
+		if pending != nil {
+			if relativePath, ok := w.relativePath(path); ok {
+				pending[relativePath] = struct{}{}
+			}
+		}
+		return nil
+	})
+}
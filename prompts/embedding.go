@@ -4,7 +4,7 @@ import (
 	"embed"
 )
 
-//go:embed metadata_enricher.yml
+//go:embed *.yml *.json
 var embeddedConfig embed.FS
 
 func GetEmbeddedPrompt() embed.FS {